@@ -1,6 +1,9 @@
 package boxer
 
 import (
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
 	"github.com/hongsam14/boxer/internal/vmcontroller"
 	"github.com/hongsam14/boxer/vmstate"
 )
@@ -15,6 +18,10 @@ const (
 	START
 	// RESTART represents restarting a VM.
 	RESTORE
+	// REFRESH represents probing the actual state of a VM with the status command.
+	REFRESH
+	// RECOVER represents hard-stopping a VM and restoring its snapshot, e.g. to get it out of the ERROR state.
+	RECOVER
 )
 
 // String() returns the string representation of the BoxerOp.
@@ -26,6 +33,10 @@ func (op BoxerOp) String() string {
 		return "START"
 	case RESTORE:
 		return "RESTORE"
+	case REFRESH:
+		return "REFRESH"
+	case RECOVER:
+		return "RECOVER"
 	default:
 		return "UNKNOWN"
 	}
@@ -73,8 +84,16 @@ type Box interface {
 	IP() string
 	// OS returns the operating system of the VM.
 	OS() string
+	// Labels returns the labels of the VM, including the standard labels os and group.
+	Labels() map[string]string
 	// State returns the current state of the VM.
 	State() vmstate.VMState
+	// Expires returns when the lease of the Box expires, or the zero time if the leases are disabled.
+	// The Box must be renewed before, or it is reclaimed.
+	Expires() time.Time
+	// Token returns the allocation token of the Box, empty if the Box is not handed out by Balloc.
+	// It proves that the Box is held by its caller, and it is invalidated when the Box is freed.
+	Token() string
 }
 
 type box struct {
@@ -82,7 +101,10 @@ type box struct {
 	machine string
 	ip      string
 	os      string
+	labels  map[string]string
 	state   vmstate.VMState
+	expires time.Time
+	token   string
 }
 
 // Machine returns the name of the VM.
@@ -104,11 +126,26 @@ func (b *box) OS() string {
 	return b.os
 }
 
+// Labels returns the labels of the VM, including the standard labels os and group.
+func (b *box) Labels() map[string]string {
+	return b.labels
+}
+
 // State returns the current state of the VM.
 func (b *box) State() vmstate.VMState {
 	return b.state
 }
 
+// Expires returns when the lease of the Box expires, or the zero time if the leases are disabled.
+func (b *box) Expires() time.Time {
+	return b.expires
+}
+
+// Token returns the allocation token of the Box, empty if the Box is not handed out by Balloc.
+func (b *box) Token() string {
+	return b.token
+}
+
 // NewBox creates a new Box instance with the provided parameters.
 func NewBox(vmCtx *vmcontroller.VMContext) Box {
 	return &box{
@@ -116,18 +153,36 @@ func NewBox(vmCtx *vmcontroller.VMContext) Box {
 		group:   vmCtx.Group(),
 		ip:      vmCtx.IP(),
 		os:      vmCtx.OS(),
+		labels:  vmCtx.Labels(),
 		state:   vmCtx.State(),
 	}
 }
 
+// QuarantinedBox is a Box kept out of the allocation because its operations keep failing.
+type QuarantinedBox struct {
+	Box      Box
+	Failures uint      // Failures is the number of consecutive failed operations of the Box
+	Since    time.Time // Since is when the Box is quarantined
+	// Until is when the Box is released, zero if it is kept until Unquarantine
+	Until time.Time
+}
+
 // BoxerRequest is used to request an operation on a BoxerClient
 type BoxerRequest struct {
 	OP      BoxerOp
 	BoxInfo Box
 }
 
+// BoxRequirement is a number of Boxes of a group allocated together by BallocMany
+type BoxRequirement struct {
+	Group string
+	Count uint
+}
+
 // BoxerResponse is used to return the result of an operation on a BoxerClient
 type BoxerResponse struct {
 	Code    ReturnCode
 	BoxInfo Box
+	// Result is the result of the VM control command, nil if no command is executed
+	Result *berror.CommandResult
 }
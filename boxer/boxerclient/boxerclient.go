@@ -1,15 +1,47 @@
 package boxer
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/hongsam14/boxer/config"
 	berror "github.com/hongsam14/boxer/error"
 	"github.com/hongsam14/boxer/internal/vmcontroller"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
+	"github.com/hongsam14/boxer/vmstate"
 )
 
+// StateChangeHandler is called when the state of a VM is corrected by its status command,
+// either by the background reconciler or by a REFRESH request.
+// box holds the corrected state, and old is the state boxer believed before.
+type StateChangeHandler func(box Box, old vmstate.VMState)
+
+// LeaseExpiredHandler is called when a Box whose lease has expired is reclaimed.
+// box holds the state of the VM after it is reset by the free policy of its group.
+type LeaseExpiredHandler func(box Box)
+
+// leaseReapInterval is the interval for checking the expired leases.
+const leaseReapInterval = time.Second
+
+// tokenBytes is the number of the random bytes of an allocation token.
+const tokenBytes = 16
+
 // BoxerClient represents a request to perform an operation on a Box.
+//
+// A BoxerClient is safe for concurrent use by multiple goroutines.
+// Balloc never hands out the same Box twice until it is freed, and operations on a Box
+// are serialized so that conflicting operations fail with berror.InvalidState instead of racing.
+// An operation that is already running on a Box is not interrupted by Bfree.
+// Every Box handed out by Balloc carries an unguessable token, and Bfree, Do and Renew only accept a Box
+// with the token of its current allocation, so a stale or forged Box fails with berror.InvalidToken.
+// The owner set by WithOwner on the context of Balloc is recorded on the allocation, and the context
+// of Bfree, Do and Renew must carry the same owner, so a tenant cannot use a Box leaked by another one.
 type BoxerClient interface {
 	// Balloc allocates a Box for the given group.
 	// It returns a Box instance or an error if allocation fails.
@@ -17,19 +49,96 @@ type BoxerClient interface {
 	Balloc(group string) (Box, error)
 	// Bfree frees the allocated Box.
 	// It returns an error if the Box cannot be freed.
+	// The VM of the Box is reset by the free_policy of its group before it is freed, and a Box
+	// in the ERROR state is recovered if recover_on_free is set in the VM control policy.
+	// If the reset fails, the Box is freed into the quarantine and the error of the reset is returned.
 	Bfree(box Box) error
 	// Do performs an operation on the Box.
 	// The operation is specified in the BoxerRequest.
 	// It returns a BoxerResponse with the result of the operation or an error if the operation fails.
+	// The result of the VM control command, including its stdout and stderr, is in BoxerResponse.Result
+	// and attached to the error (see berror.ResultOf).
+	// If the VM control command hangs longer than the policy timeout, the error code is berror.Timeout.
 	Do(req BoxerRequest) (BoxerResponse, error)
+
+	// BallocContext works like Balloc, but it does not allocate if ctx is already done.
+	BallocContext(ctx context.Context, group string) (Box, error)
+	// BallocWait allocates a Box for the given group, waiting until one is available.
+	// The waiting callers of a group are served in FIFO order, and a freed Box is handed
+	// directly to the longest waiter. It never returns berror.Full,
+	// instead it returns berror.Canceled or berror.Timeout when ctx is done.
+	BallocWait(ctx context.Context, group string) (Box, error)
+	// BallocSelector allocates a Box of any group whose labels match the selector, e.g. "os=windows, office".
+	// The labels of a Box are the labels of its VM and the standard labels os and group; see config.Selector
+	// for the syntax. It returns berror.InvalidArgument for a malformed selector and berror.Full if no matching
+	// Box is available.
+	BallocSelector(ctx context.Context, selector string) (Box, error)
+	// BallocMany allocates the Boxes of every BoxRequirement all at once, or none of them,
+	// so two callers each holding a part of the set they need never deadlock.
+	// The Boxes are returned in the order of the requirements, and the whole set counts
+	// against the maximum number of VM operations. It returns berror.Full if the whole set
+	// is not available, and berror.InvalidArgument if it can never be, e.g. it is larger than a group.
+	BallocMany(ctx context.Context, reqs []BoxRequirement) ([]Box, error)
+	// BallocManyWait works like BallocMany, but it waits until the whole set is available.
+	// The waiting sets are served in FIFO order, and while a set waits the younger callers of
+	// BallocWait do not take the Boxes it needs. It returns berror.Canceled or berror.Timeout when ctx is done,
+	// and berror.InvalidState if the set cannot be allocated until the Boxes quarantined without
+	// quarantine_duration or in the ERROR state are released.
+	BallocManyWait(ctx context.Context, reqs []BoxRequirement) ([]Box, error)
+	// BfreeContext works like Bfree, but it does not free if ctx is already done.
+	BfreeContext(ctx context.Context, box Box) error
+	// DoContext works like Do, but the operation is bound to ctx.
+	// When ctx is canceled or its deadline expires, the running VM control command is killed
+	// and the error code is berror.Canceled or berror.Timeout.
+	DoContext(ctx context.Context, req BoxerRequest) (BoxerResponse, error)
+
+	// Quarantined returns the quarantined Boxes, ordered by group and machine name.
+	// A Box is quarantined when its operations fail quarantine_threshold times in a row,
+	// and it is not allocated until it is released by Unquarantine or after quarantine_duration.
+	Quarantined() []QuarantinedBox
+	// Unquarantine releases the quarantined Box, so it can be allocated again.
+	// It is an admin operation: a quarantined Box is allocated to nobody, so neither its token nor
+	// the owner of WithOwner is checked, and it must not be exposed to the tenants of a shared client.
+	Unquarantine(box Box) error
+
+	// Renew extends the lease of the allocated Box by lease_duration and returns the Box with the new expiry.
+	// If lease_duration is set in the VM control policy, a Box which is not renewed before its lease expires
+	// is reclaimed like Bfree does. Renew returns berror.LeaseExpired while the expired Box is being reclaimed,
+	// and berror.InvalidToken once it is reclaimed.
+	Renew(box Box) (Box, error)
+	// RenewContext works like Renew, but it checks the owner carried by ctx.
+	RenewContext(ctx context.Context, box Box) (Box, error)
+	// SetLeaseExpiredHandler sets the handler called when a Box whose lease has expired is reclaimed.
+	// A nil handler removes the handler.
+	SetLeaseExpiredHandler(handler LeaseExpiredHandler)
+
+	// SetStateChangeHandler sets the handler called when the state of a VM is corrected by its status command.
+	// The background reconciler runs if the reconcile interval of the VM control policy is not zero.
+	// A nil handler removes the handler.
+	SetStateChangeHandler(handler StateChangeHandler)
+	// Close stops the background reconciler and the reaper of the expired leases. It does not stop or free the VMs.
+	Close() error
 }
 
 type boxerClient struct {
 	config *config.BoxerConfig
 	vmc    vmcontroller.VMController
 	vc     vmcontroller.VMCompose
-	// context pool key: group:machine, value: VMContext
-	ctxPool map[string]*vmcontroller.VMContext
+	// context pool key: group:machine, value: the allocated VMContext and its token
+	// ctxPoolMux guards the ctxPool.
+	ctxPoolMux sync.Mutex
+	ctxPool    map[string]*allocation
+
+	// handlerMux guards the stateChangeHandler and the leaseExpiredHandler.
+	handlerMux          sync.Mutex
+	stateChangeHandler  StateChangeHandler
+	leaseExpiredHandler LeaseExpiredHandler
+	// stopReconciler stops the background reconciler, and reconcilerDone is closed when it returns.
+	stopReconciler context.CancelFunc
+	reconcilerDone chan struct{}
+	// stopReaper stops the reaper of the expired leases, and reaperDone is closed when it returns.
+	stopReaper context.CancelFunc
+	reaperDone chan struct{}
 }
 
 // NewBoxerClient creates a new BoxerClient with the provided configuration and file descriptors.
@@ -48,19 +157,65 @@ func NewBoxerClient(conf *config.BoxerConfig, fdin *os.File, fdout *os.File) (Bo
 	// dependency injection for configuration
 	newClient.config = conf
 	// Initialize context pool
-	newClient.ctxPool = make(map[string]*vmcontroller.VMContext)
+	newClient.ctxPool = make(map[string]*allocation)
 	// Initialize VMController and VMCompose with the provided configuration
 	newClient.vmc = vmcontroller.NewVMController(
-		fdin,
+		exec.NewProcessExecutor(fdin),
 		fdout,
 		&conf.VMControl,
 		&conf.VMControlPolicy,
+		conf.Hosts,
+		exec.SystemClock,
 	)
 	newClient.vc, err = vmcontroller.NewVMCompose(
-		conf.VMInfo,
+		conf.ResolvedVMInfo(),
 		&conf.VMControlPolicy,
 	)
-	return newClient, err
+	if err != nil {
+		return newClient, err
+	}
+	// set the allocation strategy of each group
+	for groupName, group := range conf.Groups {
+		if group.AllocationStrategy == "" {
+			continue
+		}
+		strategy, err := vmcontroller.NewAllocationStrategy(group.AllocationStrategy)
+		if err == nil {
+			err = newClient.vc.SetAllocationStrategy(groupName, strategy)
+		}
+		if err != nil {
+			return newClient, berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in NewBoxerClient",
+				Origin: fmt.Errorf("failed to set the allocation strategy of group %s: %w", groupName, err),
+			}
+		}
+	}
+	// start the background reconciler if it is enabled
+	if conf.VMControlPolicy.ReconcileIntervalSec > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		newClient.stopReconciler = cancel
+		newClient.reconcilerDone = make(chan struct{})
+		go func() {
+			defer close(newClient.reconcilerDone)
+			vmcontroller.Reconcile(ctx, newClient.vmc, newClient.vc,
+				time.Duration(conf.VMControlPolicy.ReconcileIntervalSec)*time.Second,
+				newClient.notifyStateChange)
+		}()
+	}
+	// start the reaper of the expired leases if the leases are enabled
+	if conf.VMControlPolicy.LeaseSec > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		newClient.stopReaper = cancel
+		newClient.reaperDone = make(chan struct{})
+		go func() {
+			defer close(newClient.reaperDone)
+			newClient.vc.Reap(ctx, leaseReapInterval, func(vmCtx *vmcontroller.VMContext) {
+				newClient.reclaim(ctx, vmCtx)
+			})
+		}()
+	}
+	return newClient, nil
 }
 
 func (bc *boxerClient) generateContextPoolKey(group, machine string) string {
@@ -72,6 +227,11 @@ func (bc *boxerClient) generateContextPoolKey(group, machine string) string {
 // It returns a Box instance or an error if allocation fails.
 // Check error code in github.com/hongsam14/boxer/error by using berror.Is(err, berror.Full)
 func (bc *boxerClient) Balloc(group string) (Box, error) {
+	return bc.BallocContext(context.Background(), group)
+}
+
+// BallocContext works like Balloc, but it does not allocate if ctx is already done.
+func (bc *boxerClient) BallocContext(ctx context.Context, group string) (Box, error) {
 	// check validate the group parameter
 	if group == "" {
 		return nil, berror.BoxerError{
@@ -80,10 +240,10 @@ func (bc *boxerClient) Balloc(group string) (Box, error) {
 			Origin: fmt.Errorf("group cannot be empty"),
 		}
 	}
-	vmCtx, err := bc.vc.AllocateVMContext(group)
+	vmCtx, err := bc.vc.AllocateVMContext(ctx, group)
 	if err != nil {
 		return nil, berror.BoxerError{
-			Code:   berror.InternalError,
+			Code:   errorCode(err),
 			Msg:    "error in Balloc",
 			Origin: fmt.Errorf("failed to allocate Box: %w", err),
 		}
@@ -99,24 +259,249 @@ func (bc *boxerClient) Balloc(group string) (Box, error) {
 			Origin: fmt.Errorf("no available VM to be allocated in this env"),
 		}
 	}
+	return bc.registerBox(ctx, vmCtx)
+}
+
+// BallocWait allocates a Box for the given group, waiting until one is available.
+// The waiting callers of a group are served in FIFO order, and a freed Box is handed
+// directly to the longest waiter. It never returns berror.Full,
+// instead it returns berror.Canceled or berror.Timeout when ctx is done.
+func (bc *boxerClient) BallocWait(ctx context.Context, group string) (Box, error) {
+	// check validate the group parameter
+	if group == "" {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in BallocWait",
+			Origin: fmt.Errorf("group cannot be empty"),
+		}
+	}
+	vmCtx, err := bc.vc.AllocateVMContextWait(ctx, group)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   errorCode(err),
+			Msg:    "error in BallocWait",
+			Origin: fmt.Errorf("failed to allocate Box: %w", err),
+		}
+	}
+	return bc.registerBox(ctx, vmCtx)
+}
+
+// allocation is a VMContext allocated by Balloc, the token handed out with its Box and the owner it is allocated to.
+type allocation struct {
+	vmCtx *vmcontroller.VMContext
+	token string
+	owner string
+}
+
+// ownerKey is the context key of the owner set by WithOwner.
+type ownerKey struct{}
+
+// WithOwner returns a copy of ctx carrying the owner identity, e.g. the name of a tenant.
+// A Box allocated with the returned context can be freed, operated and renewed only with
+// a context carrying the same owner. A context without an owner is the owner "".
+func WithOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, ownerKey{}, owner)
+}
+
+// OwnerFrom returns the owner identity carried by ctx, or "" if it is not set.
+func OwnerFrom(ctx context.Context) string {
+	owner, _ := ctx.Value(ownerKey{}).(string)
+	return owner
+}
+
+// newToken returns a new unguessable allocation token.
+func newToken() (string, error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// BallocSelector allocates a Box of any group whose labels match the selector.
+// It returns berror.InvalidArgument for a malformed selector and berror.Full if no matching Box is available.
+func (bc *boxerClient) BallocSelector(ctx context.Context, selector string) (Box, error) {
+	parsed, err := config.ParseSelector(selector)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in BallocSelector",
+			Origin: err,
+		}
+	}
+	vmCtx, err := bc.vc.AllocateVMContextSelector(ctx, parsed)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   errorCode(err),
+			Msg:    "error in BallocSelector",
+			Origin: fmt.Errorf("failed to allocate Box: %w", err),
+		}
+	}
+	if vmCtx == nil {
+		return nil, berror.BoxerError{
+			Code:   berror.Full,
+			Msg:    "error in BallocSelector",
+			Origin: fmt.Errorf("no available VM matches the selector %q", parsed),
+		}
+	}
+	return bc.registerBox(ctx, vmCtx)
+}
+
+// BallocMany allocates the Boxes of every BoxRequirement all at once, or none of them.
+// It returns berror.Full if the whole set is not available.
+func (bc *boxerClient) BallocMany(ctx context.Context, reqs []BoxRequirement) ([]Box, error) {
+	vmCtxs, err := bc.vc.AllocateVMContexts(ctx, groupCounts(reqs))
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   setErrorCode(err),
+			Msg:    "error in BallocMany",
+			Origin: fmt.Errorf("failed to allocate Boxes: %w", err),
+		}
+	}
+	if vmCtxs == nil {
+		return nil, berror.BoxerError{
+			Code:   berror.Full,
+			Msg:    "error in BallocMany",
+			Origin: fmt.Errorf("the requested set of VMs is not available in this env"),
+		}
+	}
+	return bc.registerBoxes(ctx, vmCtxs)
+}
+
+// BallocManyWait works like BallocMany, but it waits until the whole set is available.
+func (bc *boxerClient) BallocManyWait(ctx context.Context, reqs []BoxRequirement) ([]Box, error) {
+	vmCtxs, err := bc.vc.AllocateVMContextsWait(ctx, groupCounts(reqs))
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   setErrorCode(err),
+			Msg:    "error in BallocManyWait",
+			Origin: fmt.Errorf("failed to allocate Boxes: %w", err),
+		}
+	}
+	return bc.registerBoxes(ctx, vmCtxs)
+}
+
+// groupCounts converts the BoxRequirements to the GroupCounts of the VMCompose.
+func groupCounts(reqs []BoxRequirement) []vmcontroller.GroupCount {
+	counts := make([]vmcontroller.GroupCount, len(reqs))
+	for i, req := range reqs {
+		counts[i] = vmcontroller.GroupCount{Group: req.Group, Count: req.Count}
+	}
+	return counts
+}
+
+// setErrorCode returns the error code to report for an error allocating a set of Boxes.
+// A set that can never be allocated is reported as berror.InvalidArgument, one stalled by the quarantine
+// as berror.InvalidState, and the others like errorCode.
+func setErrorCode(err error) berror.BoxerErrorCode {
+	if berror.Is(err, berror.InvalidArgument) {
+		return berror.InvalidArgument
+	}
+	if berror.Is(err, berror.InvalidState) {
+		return berror.InvalidState
+	}
+	return errorCode(err)
+}
+
+// registerBoxes registers every allocated VMContext of a set and returns the Boxes for them.
+// If one of them fails, the whole set is given back, so the set stays all or nothing.
+func (bc *boxerClient) registerBoxes(ctx context.Context, vmCtxs []*vmcontroller.VMContext) ([]Box, error) {
+	boxes := make([]Box, 0, len(vmCtxs))
+	for i, vmCtx := range vmCtxs {
+		b, err := bc.registerBox(ctx, vmCtx)
+		if err != nil {
+			// registerBox has given back the failed one, give back the others
+			for _, rest := range vmCtxs[i+1:] {
+				_ = bc.vc.FreeVMContext(rest)
+			}
+			bc.ctxPoolMux.Lock()
+			for _, registered := range boxes {
+				delete(bc.ctxPool, bc.generateContextPoolKey(registered.Group(), registered.Machine()))
+			}
+			bc.ctxPoolMux.Unlock()
+			for _, registered := range vmCtxs[:i] {
+				_ = bc.vc.FreeVMContext(registered)
+			}
+			return nil, err
+		}
+		boxes = append(boxes, b)
+	}
+	return boxes, nil
+}
+
+// registerBox stores the allocated VMContext in the context pool with a new token and the owner of ctx,
+// and returns a Box for it.
+func (bc *boxerClient) registerBox(ctx context.Context, vmCtx *vmcontroller.VMContext) (Box, error) {
+	token, err := newToken()
+	if err != nil {
+		_ = bc.vc.FreeVMContext(vmCtx)
+		return nil, berror.BoxerError{
+			Code:   berror.SystemError,
+			Msg:    "error in registerBox",
+			Origin: fmt.Errorf("failed to generate allocation token: %w", err),
+		}
+	}
 	// check if the VMContext exists in the context pool
 	key := bc.generateContextPoolKey(vmCtx.Group(), vmCtx.Machine())
+	bc.ctxPoolMux.Lock()
+	defer bc.ctxPoolMux.Unlock()
 	if _, exists := bc.ctxPool[key]; exists {
+		// give the VMContext back, so that it is not leaked from the VMCompose
+		_ = bc.vc.FreeVMContext(vmCtx)
 		return nil, berror.BoxerError{
 			Code:   berror.InternalError,
-			Msg:    "error in Balloc",
+			Msg:    "error in registerBox",
 			Origin: fmt.Errorf("VMContext already exists in the context pool for group %s and machine %s", vmCtx.Group(), vmCtx.Machine()),
 		}
 	}
 	// store the VMContext in the context pool
-	bc.ctxPool[key] = vmCtx
+	alloc := &allocation{vmCtx: vmCtx, token: token, owner: OwnerFrom(ctx)}
+	bc.ctxPool[key] = alloc
 	// create a new Box instance with the VMContext
-	return NewBox(vmCtx), nil
+	return bc.newBox(alloc), nil
+}
+
+// newBox creates a Box for the allocation with its token and the expiry of its lease.
+func (bc *boxerClient) newBox(alloc *allocation) Box {
+	b := NewBox(alloc.vmCtx).(*box)
+	b.expires, _ = bc.vc.Lease(alloc.vmCtx)
+	b.token = alloc.token
+	return b
+}
+
+// lookupLocked returns the context pool key and the allocation of the Box after verifying its token and owner.
+// It returns berror.InvalidToken if the Box is not allocated or its token does not match the allocation,
+// because the Box is stale, e.g. it has been freed, or forged, and if the owner of ctx is not the owner of the allocation.
+// bc.ctxPoolMux must be held by the caller.
+func (bc *boxerClient) lookupLocked(ctx context.Context, box Box) (string, *allocation, error) {
+	key := bc.generateContextPoolKey(box.Group(), box.Machine())
+	alloc, exists := bc.ctxPool[key]
+	if !exists || subtle.ConstantTimeCompare([]byte(alloc.token), []byte(box.Token())) != 1 {
+		return key, nil, berror.BoxerError{
+			Code:   berror.InvalidToken,
+			Msg:    "error in boxerClient lookup",
+			Origin: fmt.Errorf("box for group %s and machine %s is not allocated with its token", box.Group(), box.Machine()),
+		}
+	}
+	if alloc.owner != OwnerFrom(ctx) {
+		return key, nil, berror.BoxerError{
+			Code:   berror.InvalidToken,
+			Msg:    "error in boxerClient lookup",
+			Origin: fmt.Errorf("box for group %s and machine %s is not allocated to owner %q", box.Group(), box.Machine(), OwnerFrom(ctx)),
+		}
+	}
+	return key, alloc, nil
 }
 
 // Bfree frees the allocated Box.
 // It returns an error if the Box cannot be freed.
 func (bc *boxerClient) Bfree(box Box) error {
+	return bc.BfreeContext(context.Background(), box)
+}
+
+// BfreeContext works like Bfree, but it does not free if ctx is already done.
+// The reset of the Box is bound to ctx.
+func (bc *boxerClient) BfreeContext(ctx context.Context, box Box) error {
 	// check if the box parameter is nil
 	if box == nil {
 		return berror.BoxerError{
@@ -125,32 +510,128 @@ func (bc *boxerClient) Bfree(box Box) error {
 			Origin: fmt.Errorf("box cannot be nil"),
 		}
 	}
-	key := bc.generateContextPoolKey(box.Group(), box.Machine())
-	if _, exists := bc.ctxPool[key]; !exists {
+	if err := ctx.Err(); err != nil {
 		return berror.BoxerError{
-			Code:   berror.InternalError,
+			Code:   berror.ContextErrorCode(err),
+			Msg:    "error in Bfree",
+			Origin: err,
+		}
+	}
+	bc.ctxPoolMux.Lock()
+	key, alloc, err := bc.lookupLocked(ctx, box)
+	if err != nil {
+		bc.ctxPoolMux.Unlock()
+		return berror.BoxerError{
+			Code:   berror.InvalidToken,
+			Msg:    "error in Bfree",
+			Origin: err,
+		}
+	}
+	vmCtx := alloc.vmCtx
+	// delete the VMContext from the context pool first,
+	// so that the Box cannot be freed twice or operated while it is recovered
+	delete(bc.ctxPool, key)
+	bc.ctxPoolMux.Unlock()
+
+	// reset the VM by the free policy of its group before it is handed out again
+	if result, err := bc.resetVM(ctx, vmCtx); err != nil {
+		resetErr := berror.BoxerError{
+			Code:   errorCode(err),
 			Msg:    "error in Bfree",
-			Origin: fmt.Errorf("VMContext does not exist in the context pool for group %s and machine %s", box.Group(), box.Machine()),
+			Origin: fmt.Errorf("failed to reset Box: %w", err),
+			Result: result,
+		}
+		// a VM which is not clean must not be allocated again
+		if err := bc.vc.Quarantine(vmCtx); err != nil {
+			bc.ctxPoolMux.Lock()
+			bc.ctxPool[key] = alloc
+			bc.ctxPoolMux.Unlock()
+			return berror.BoxerError{
+				Code:   berror.InternalError,
+				Msg:    "error in Bfree",
+				Origin: fmt.Errorf("failed to quarantine Box: %w", err),
+			}
 		}
+		return resetErr
 	}
 	// free the VMContext using the VMController
-	if err := bc.vc.FreeVMContext(bc.ctxPool[key]); err != nil {
+	if err := bc.vc.FreeVMContext(vmCtx); err != nil {
+		// put the VMContext back, so that the Box is still allocated
+		bc.ctxPoolMux.Lock()
+		bc.ctxPool[key] = alloc
+		bc.ctxPoolMux.Unlock()
 		return berror.BoxerError{
 			Code:   berror.InternalError,
 			Msg:    "error in Bfree",
 			Origin: fmt.Errorf("failed to free Box: %w", err),
 		}
 	}
-	// delete the VMContext from the context pool
-	delete(bc.ctxPool, key)
 	return nil
 }
 
+// resetVM brings the freed VM to the state required by the free policy of its group.
+// A VM in the ERROR state is recovered if recover_on_free is set or the free policy is restore,
+// and it cannot be reset by the stop policy.
+func (bc *boxerClient) resetVM(ctx context.Context, vmCtx *vmcontroller.VMContext) (*berror.CommandResult, error) {
+	policy := bc.config.Groups[vmCtx.Group()].FreePolicy
+	vmPolicy := vmCtx.Policy()
+	if vmCtx.State() == vmstate.ERROR {
+		switch {
+		case vmPolicy.RecoversOnFree(), policy == config.FREE_POLICY_RESTORE:
+			result, err := bc.vmc.RecoverVM(ctx, vmCtx)
+			bc.reportResult(ctx, vmCtx, err)
+			if err != nil && result == nil {
+				result = berror.ResultOf(err)
+			}
+			return result, err
+		case policy == config.FREE_POLICY_STOP:
+			return nil, berror.BoxerError{
+				Code:   berror.InvalidState,
+				Msg:    "error in Bfree",
+				Origin: fmt.Errorf("VM in the ERROR state cannot be stopped by the free policy %s", policy),
+			}
+		}
+		return nil, nil
+	}
+	if policy != config.FREE_POLICY_STOP && policy != config.FREE_POLICY_RESTORE {
+		return nil, nil
+	}
+	if vmCtx.State() != vmstate.STOPPED {
+		result, err := bc.vmc.StopVM(ctx, vmCtx)
+		bc.reportResult(ctx, vmCtx, err)
+		if err != nil {
+			if result == nil {
+				result = berror.ResultOf(err)
+			}
+			return result, err
+		}
+	}
+	if policy == config.FREE_POLICY_RESTORE {
+		result, err := bc.vmc.RestoreSnapshot(ctx, vmCtx)
+		bc.reportResult(ctx, vmCtx, err)
+		if err != nil && result == nil {
+			result = berror.ResultOf(err)
+		}
+		return result, err
+	}
+	return nil, nil
+}
+
 // Do performs an operation on the Box.
 // The operation is specified in the BoxerRequest.
 // It returns a BoxerResponse with the result of the operation or an error if the operation fails.
 func (bc *boxerClient) Do(req BoxerRequest) (BoxerResponse, error) {
-	var err error
+	return bc.DoContext(context.Background(), req)
+}
+
+// DoContext works like Do, but the operation is bound to ctx.
+// When ctx is canceled or its deadline expires, the running VM control command is killed
+// and the error code is berror.Canceled or berror.Timeout.
+func (bc *boxerClient) DoContext(ctx context.Context, req BoxerRequest) (BoxerResponse, error) {
+	var (
+		err    error
+		result *berror.CommandResult
+	)
 
 	// check if the request is valid
 	if req.BoxInfo == nil {
@@ -164,45 +645,256 @@ func (bc *boxerClient) Do(req BoxerRequest) (BoxerResponse, error) {
 				Origin: fmt.Errorf("box info cannot be nil"),
 			}
 	}
-	// check if box is allocated
-	key := bc.generateContextPoolKey(req.BoxInfo.Group(), req.BoxInfo.Machine())
-	vmCtx, exists := bc.ctxPool[key]
-	if !exists {
+	// check if box is allocated to the caller
+	bc.ctxPoolMux.Lock()
+	_, alloc, err := bc.lookupLocked(ctx, req.BoxInfo)
+	bc.ctxPoolMux.Unlock()
+	if err != nil {
 		return BoxerResponse{
 				Code:    NOT_FOUND,
 				BoxInfo: req.BoxInfo,
 			},
 			berror.BoxerError{
-				Code:   berror.InvalidState,
+				Code:   berror.InvalidToken,
 				Msg:    "error in Do",
-				Origin: fmt.Errorf("box is not allocated for group %s and machine %s", req.BoxInfo.Group(), req.BoxInfo.Machine()),
+				Origin: err,
 			}
 	}
+	vmCtx := alloc.vmCtx
 	// operate on the VMContext based on the request operation
 	switch req.OP {
 	case STOP:
 		// stop the VM
-		err = bc.vmc.StopVM(vmCtx)
+		result, err = bc.vmc.StopVM(ctx, vmCtx)
 	case START:
 		// start the VM
-		err = bc.vmc.StartVM(vmCtx)
+		result, err = bc.vmc.StartVM(ctx, vmCtx)
 	case RESTORE:
 		// restore the VM from a snapshot
-		err = bc.vmc.RestoreSnapshot(vmCtx)
+		result, err = bc.vmc.RestoreSnapshot(ctx, vmCtx)
+	case RECOVER:
+		// hard-stop the VM and restore its snapshot
+		result, err = bc.vmc.RecoverVM(ctx, vmCtx)
+	case REFRESH:
+		// probe the actual state of the VM
+		var change vmcontroller.StateChange
+		change, err = bc.vmc.Refresh(ctx, vmCtx)
+		result = change.Result
+		if err == nil && change.Changed() {
+			bc.notifyStateChange(change)
+		}
+	default:
+		return BoxerResponse{
+				Code:    INVALID_REQUEST,
+				BoxInfo: req.BoxInfo,
+			},
+			berror.BoxerError{
+				Code:   berror.InvalidArgument,
+				Msg:    "error in Do",
+				Origin: fmt.Errorf("unknown operation %d", req.OP),
+			}
+	}
+	if req.OP != REFRESH {
+		bc.reportResult(ctx, vmCtx, err)
 	}
 	if err != nil {
+		if result == nil {
+			result = berror.ResultOf(err)
+		}
 		return BoxerResponse{
 				Code:    INTERNAL_ERROR,
-				BoxInfo: NewBox(vmCtx),
+				BoxInfo: bc.newBox(alloc),
+				Result:  result,
 			},
 			berror.BoxerError{
-				Code:   berror.InternalError,
+				Code:   errorCode(err),
 				Msg:    "error in Do",
 				Origin: fmt.Errorf("failed to perform operation %s on Box: %w", req.OP, err),
+				Result: result,
 			}
 	}
 	return BoxerResponse{
 		Code:    SUCCESS,
-		BoxInfo: NewBox(vmCtx),
+		BoxInfo: bc.newBox(alloc),
+		Result:  result,
 	}, nil
 }
+
+// reportResult records the result of an operation on the VM for its quarantine.
+// An operation rejected without touching the VM, e.g. for the state of the VM, is not recorded,
+// and neither is one cut short by the caller, which cancels ctx or gives it a short deadline.
+func (bc *boxerClient) reportResult(ctx context.Context, vmCtx *vmcontroller.VMContext, err error) {
+	switch {
+	case err == nil:
+		bc.vc.ReportResult(vmCtx, false)
+	case berror.Is(err, berror.InvalidState), berror.Is(err, berror.InvalidArgument):
+		// the VM is not touched
+	case berror.Is(err, berror.Canceled), berror.Is(err, berror.Timeout) && ctx.Err() != nil:
+		// the VM is not to blame
+	case vmCtx.State() == vmstate.ERROR:
+		bc.vc.ReportResult(vmCtx, true)
+	}
+}
+
+// Quarantined returns the quarantined Boxes, ordered by group and machine name.
+func (bc *boxerClient) Quarantined() []QuarantinedBox {
+	quarantined := bc.vc.Quarantined()
+	boxes := make([]QuarantinedBox, len(quarantined))
+	for i, entry := range quarantined {
+		boxes[i] = QuarantinedBox{
+			Box:      NewBox(entry.VM),
+			Failures: entry.Failures,
+			Since:    entry.Since,
+			Until:    entry.Until,
+		}
+	}
+	return boxes
+}
+
+// Unquarantine releases the quarantined Box, so it can be allocated again.
+// It returns berror.InvalidArgument if the Box is not quarantined.
+// It is an admin operation, the token and the owner of the Box are not checked.
+func (bc *boxerClient) Unquarantine(box Box) error {
+	if box == nil {
+		return berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in Unquarantine",
+			Origin: fmt.Errorf("box cannot be nil"),
+		}
+	}
+	if err := bc.vc.Unquarantine(box.Group(), box.Machine()); err != nil {
+		return berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in Unquarantine",
+			Origin: fmt.Errorf("failed to release Box: %w", err),
+		}
+	}
+	return nil
+}
+
+// Renew extends the lease of the allocated Box and returns the Box with the new expiry.
+// It returns berror.LeaseExpired if the lease has expired, and berror.InvalidToken if the Box is not allocated
+// with its token.
+func (bc *boxerClient) Renew(box Box) (Box, error) {
+	return bc.RenewContext(context.Background(), box)
+}
+
+// RenewContext works like Renew, but it checks the owner carried by ctx.
+func (bc *boxerClient) RenewContext(ctx context.Context, box Box) (Box, error) {
+	if box == nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in Renew",
+			Origin: fmt.Errorf("box cannot be nil"),
+		}
+	}
+	bc.ctxPoolMux.Lock()
+	_, alloc, err := bc.lookupLocked(ctx, box)
+	bc.ctxPoolMux.Unlock()
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidToken,
+			Msg:    "error in Renew",
+			Origin: err,
+		}
+	}
+	if _, err := bc.vc.Renew(alloc.vmCtx); err != nil {
+		return nil, berror.BoxerError{
+			Code:   errorCode(err),
+			Msg:    "error in Renew",
+			Origin: fmt.Errorf("failed to renew Box: %w", err),
+		}
+	}
+	return bc.newBox(alloc), nil
+}
+
+// reclaim frees the VM whose lease has expired like Bfree does, and notifies the LeaseExpiredHandler.
+// The VM is skipped if it has been freed by its holder meanwhile.
+func (bc *boxerClient) reclaim(ctx context.Context, vmCtx *vmcontroller.VMContext) {
+	key := bc.generateContextPoolKey(vmCtx.Group(), vmCtx.Machine())
+	bc.ctxPoolMux.Lock()
+	// a VM holding a lease has been freed and allocated again
+	if _, leased := bc.vc.Lease(vmCtx); leased || bc.ctxPool[key] == nil || bc.ctxPool[key].vmCtx != vmCtx {
+		bc.ctxPoolMux.Unlock()
+		return
+	}
+	delete(bc.ctxPool, key)
+	bc.ctxPoolMux.Unlock()
+
+	// a VM failing the reset is quarantined, like Bfree does
+	if _, err := bc.resetVM(ctx, vmCtx); err != nil {
+		if err := bc.vc.Quarantine(vmCtx); err != nil {
+			return
+		}
+	} else if err := bc.vc.FreeVMContext(vmCtx); err != nil {
+		return
+	}
+	bc.handlerMux.Lock()
+	handler := bc.leaseExpiredHandler
+	bc.handlerMux.Unlock()
+	if handler != nil {
+		handler(NewBox(vmCtx))
+	}
+}
+
+// SetLeaseExpiredHandler sets the handler called when a Box whose lease has expired is reclaimed.
+// A nil handler removes the handler.
+func (bc *boxerClient) SetLeaseExpiredHandler(handler LeaseExpiredHandler) {
+	bc.handlerMux.Lock()
+	defer bc.handlerMux.Unlock()
+	bc.leaseExpiredHandler = handler
+}
+
+// SetStateChangeHandler sets the handler called when the state of a VM is corrected by its status command.
+// A nil handler removes the handler.
+func (bc *boxerClient) SetStateChangeHandler(handler StateChangeHandler) {
+	bc.handlerMux.Lock()
+	defer bc.handlerMux.Unlock()
+	bc.stateChangeHandler = handler
+}
+
+// notifyStateChange calls the StateChangeHandler with the corrected state.
+func (bc *boxerClient) notifyStateChange(change vmcontroller.StateChange) {
+	bc.handlerMux.Lock()
+	handler := bc.stateChangeHandler
+	bc.handlerMux.Unlock()
+	if handler != nil {
+		handler(NewBox(change.VM), change.Old)
+	}
+}
+
+// Close stops the background reconciler and the reaper of the expired leases, and waits until they return.
+// It does not stop or free the VMs.
+func (bc *boxerClient) Close() error {
+	if bc.stopReconciler != nil {
+		bc.stopReconciler()
+		<-bc.reconcilerDone
+	}
+	if bc.stopReaper != nil {
+		bc.stopReaper()
+		<-bc.reaperDone
+	}
+	return nil
+}
+
+// errorCode returns the error code to report for an error of the internal packages.
+// Timeouts, cancellations, connection errors, expired leases and invalid tokens are kept so that the caller can distinguish them from failures,
+// every other error is reported as berror.InternalError.
+func errorCode(err error) berror.BoxerErrorCode {
+	if berror.Is(err, berror.Timeout) {
+		return berror.Timeout
+	}
+	if berror.Is(err, berror.Canceled) {
+		return berror.Canceled
+	}
+	if berror.Is(err, berror.ConnectionError) {
+		return berror.ConnectionError
+	}
+	if berror.Is(err, berror.LeaseExpired) {
+		return berror.LeaseExpired
+	}
+	if berror.Is(err, berror.InvalidToken) {
+		return berror.InvalidToken
+	}
+	return berror.InternalError
+}
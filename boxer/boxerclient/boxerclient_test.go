@@ -1,12 +1,18 @@
 package boxer_test
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	boxer "github.com/hongsam14/boxer/boxerclient"
 	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/vmstate"
 )
 
 var testConfig = &config.BoxerConfig{
@@ -119,3 +125,638 @@ func TestNewBoxerClient(t *testing.T) {
 	}
 	t.Logf("Box deallocated successfully: %s", box.Machine())
 }
+
+func TestDoContextCanceled(t *testing.T) {
+	conf := &config.BoxerConfig{
+		VMInfo: map[string]config.VMInfoConfig{
+			// the machine name is used as the sleep duration of the start command
+			"10": {
+				Name:     "10",
+				Snapshot: "snapshot0",
+				OS:       "linux",
+				Group:    "sleepGroup",
+				IP:       "127.0.0.1",
+			},
+		},
+		VMControl: config.VMControlConfig{
+			StartCmd:           "sleep $machine",
+			StopCmd:            "true $machine",
+			RestoreSnapshotCmd: "true $machine $snapshot",
+		},
+		VMControlPolicy: config.VMControlPolicyConfig{
+			IntervalSec:     1,
+			TimeoutSec:      30,
+			MaxVMOperations: 1,
+		},
+	}
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, os.Stdout)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.BallocContext(context.Background(), "sleepGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = client.DoContext(ctx, boxer.BoxerRequest{
+		BoxInfo: box,
+		OP:      boxer.START,
+	})
+	if !berror.Is(err, berror.Timeout) {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("DoContext should return right after the deadline, elapsed %v", elapsed)
+	}
+	// a done context does not allocate
+	if _, err := client.BallocContext(ctx, "sleepGroup"); !berror.Is(err, berror.Timeout) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+	if err := client.BfreeContext(context.Background(), box); err != nil {
+		t.Errorf("Failed to deallocate Box: %v", err)
+	}
+}
+
+func TestDoContextCanceledNotQuarantined(t *testing.T) {
+	conf := newStressConfig(0)
+	// the machine name is used as the sleep duration of the start command
+	conf.VMInfo["10"] = config.VMInfoConfig{Name: "10", Snapshot: "snapshot0", OS: "linux", Group: "sleepGroup", IP: "127.0.0.1"}
+	conf.VMControl.StartCmd = "sleep $machine"
+	conf.VMControlPolicy.MaxVMOperations = 1
+	conf.VMControlPolicy.QuarantineThreshold = 1
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.Balloc("sleepGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	// an unknown operation is rejected without being counted as a success
+	if resp, err := client.Do(boxer.BoxerRequest{OP: boxer.BoxerOp(99), BoxInfo: box}); resp.Code != boxer.INVALID_REQUEST || !berror.Is(err, berror.InvalidArgument) {
+		t.Errorf("Expected INVALID_REQUEST for an unknown operation, got %v %v", resp.Code, err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := client.DoContext(canceled, boxer.BoxerRequest{OP: boxer.START, BoxInfo: box}); !berror.Is(err, berror.Canceled) {
+		t.Fatalf("Expected canceled error, got %v", err)
+	}
+	if err := client.Bfree(box); err != nil {
+		t.Fatalf("Bfree failed: %v", err)
+	}
+	// the canceled command does not count as a failure of the VM
+	if quarantined := client.Quarantined(); len(quarantined) != 0 {
+		t.Fatalf("Expected no Box to be quarantined, got %+v", quarantined)
+	}
+}
+
+// newStressConfig returns a config whose control commands always succeed immediately.
+func newStressConfig(numVMs int) *config.BoxerConfig {
+	conf := &config.BoxerConfig{
+		VMInfo: map[string]config.VMInfoConfig{},
+		VMControl: config.VMControlConfig{
+			StartCmd:           "true $machine",
+			StopCmd:            "true $machine",
+			RestoreSnapshotCmd: "true $machine $snapshot",
+		},
+		VMControlPolicy: config.VMControlPolicyConfig{
+			// no padding between the commands to keep the test fast
+			IntervalSec:     0,
+			TimeoutSec:      30,
+			MaxVMOperations: uint(numVMs),
+		},
+	}
+	for i := 0; i < numVMs; i++ {
+		name := fmt.Sprintf("stress_vm_%d", i)
+		conf.VMInfo[name] = config.VMInfoConfig{
+			Name:     name,
+			Snapshot: "snapshot0",
+			OS:       "linux",
+			Group:    "stressGroup",
+			IP:       "127.0.0.1",
+		}
+	}
+	return conf
+}
+
+func TestConcurrentBallocBfreeDo(t *testing.T) {
+	client, err := boxer.NewBoxerClient(newStressConfig(4), os.Stdin, os.Stdout)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				box, err := client.Balloc("stressGroup")
+				if berror.Is(err, berror.Full) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("Failed to allocate Box: %v", err)
+					return
+				}
+				for _, op := range []boxer.BoxerOp{boxer.START, boxer.STOP, boxer.RESTORE} {
+					if _, err := client.Do(boxer.BoxerRequest{BoxInfo: box, OP: op}); err != nil {
+						t.Errorf("Failed to %s Box %s: %v", op, box.Machine(), err)
+					}
+				}
+				if err := client.Bfree(box); err != nil {
+					t.Errorf("Failed to deallocate Box: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentDoOnSameBox(t *testing.T) {
+	client, err := boxer.NewBoxerClient(newStressConfig(1), os.Stdin, os.Stdout)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	// only one of the concurrent starts can succeed, the others see the RUNNING state
+	var (
+		wg        sync.WaitGroup
+		succeeded int32
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Do(boxer.BoxerRequest{BoxInfo: box, OP: boxer.START})
+			if err == nil {
+				atomic.AddInt32(&succeeded, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if succeeded != 1 {
+		t.Errorf("Expected exactly one START to succeed, got %d", succeeded)
+	}
+	if err := client.Bfree(box); err != nil {
+		t.Errorf("Failed to deallocate Box: %v", err)
+	}
+}
+
+func TestBallocWait(t *testing.T) {
+	client, err := boxer.NewBoxerClient(newStressConfig(1), os.Stdin, os.Stdout)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.BallocWait(context.Background(), "stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	waited := make(chan boxer.Box, 1)
+	go func() {
+		next, err := client.BallocWait(context.Background(), "stressGroup")
+		if err != nil {
+			t.Errorf("BallocWait failed: %v", err)
+		}
+		waited <- next
+	}()
+	select {
+	case <-waited:
+		t.Fatal("BallocWait returned while the group is full")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := client.Bfree(box); err != nil {
+		t.Fatalf("Failed to deallocate Box: %v", err)
+	}
+	select {
+	case next := <-waited:
+		if next == nil || next.Machine() != box.Machine() {
+			t.Fatalf("Expected the freed Box to be handed over, got %v", next)
+		}
+		if err := client.Bfree(next); err != nil {
+			t.Errorf("Failed to deallocate Box: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("BallocWait is not served after Bfree")
+	}
+}
+
+func TestDoRefresh(t *testing.T) {
+	conf := newStressConfig(1)
+	// the VM reports that it is running, although boxer has never started it
+	conf.VMControl.StatusCmd = "echo running $machine"
+	conf.VMControl.StatusRules = []config.VMStatusRuleConfig{{State: "running", Regex: "^running"}}
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, os.Stdout)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	defer client.Close()
+	changed := make(chan vmstate.VMState, 1)
+	client.SetStateChangeHandler(func(box boxer.Box, old vmstate.VMState) {
+		changed <- old
+	})
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	defer client.Bfree(box)
+	resp, err := client.Do(boxer.BoxerRequest{OP: boxer.REFRESH, BoxInfo: box})
+	if err != nil {
+		t.Fatalf("Do REFRESH failed: %v", err)
+	}
+	if resp.BoxInfo.State() != vmstate.RUNNING {
+		t.Errorf("Expected state RUNNING, got %s", resp.BoxInfo.State())
+	}
+	select {
+	case old := <-changed:
+		if old != vmstate.STOPPED {
+			t.Errorf("Expected the old state STOPPED, got %s", old)
+		}
+	default:
+		t.Error("StateChangeHandler is not called")
+	}
+	// the state is right now, so starting it again is rejected
+	if _, err := client.Do(boxer.BoxerRequest{OP: boxer.START, BoxInfo: box}); err == nil {
+		t.Error("Expected START on a running Box to fail")
+	}
+}
+
+func TestDoCommandResult(t *testing.T) {
+	conf := newStressConfig(1)
+	conf.VMControl.StartCmd = "sh -c 'echo no such VM >&2; exit 2' $machine"
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	defer client.Bfree(box)
+	resp, err := client.Do(boxer.BoxerRequest{OP: boxer.START, BoxInfo: box})
+	if err == nil {
+		t.Fatal("Expected START to fail")
+	}
+	if resp.Result == nil || resp.Result.ExitCode != 2 || resp.Result.Message() != "no such VM" {
+		t.Fatalf("Unexpected result %+v", resp.Result)
+	}
+	if berror.ResultOf(err) != resp.Result {
+		t.Errorf("Expected the result to be attached to the error")
+	}
+}
+
+func TestDoRecover(t *testing.T) {
+	conf := newStressConfig(1)
+	conf.VMControl.StartCmd = "false $machine"
+	// the VM is not running, so the hard stop fails, which does not stop the recovery
+	conf.VMControl.ForceStopCmd = "false $machine"
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	defer client.Bfree(box)
+	resp, err := client.Do(boxer.BoxerRequest{OP: boxer.START, BoxInfo: box})
+	if err == nil || resp.BoxInfo.State() != vmstate.ERROR {
+		t.Fatalf("Expected START to fail into ERROR, got %v %v", resp.BoxInfo.State(), err)
+	}
+	if _, err := client.Do(boxer.BoxerRequest{OP: boxer.RESTORE, BoxInfo: box}); !berror.Is(err, berror.InternalError) {
+		t.Fatalf("Expected RESTORE to reject the VM in ERROR, got %v", err)
+	}
+	resp, err = client.Do(boxer.BoxerRequest{OP: boxer.RECOVER, BoxInfo: box})
+	if err != nil {
+		t.Fatalf("RECOVER failed: %v", err)
+	}
+	if resp.BoxInfo.State() != vmstate.STOPPED {
+		t.Errorf("Expected state STOPPED after RECOVER, got %s", resp.BoxInfo.State())
+	}
+}
+
+func TestBfreeRecoverOnFree(t *testing.T) {
+	conf := newStressConfig(1)
+	conf.VMControl.StartCmd = "false $machine"
+	recoverOnFree := true
+	conf.VMControlPolicy.RecoverOnFree = &recoverOnFree
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	if _, err := client.Do(boxer.BoxerRequest{OP: boxer.START, BoxInfo: box}); err == nil {
+		t.Fatal("Expected START to fail")
+	}
+	if err := client.Bfree(box); err != nil {
+		t.Fatalf("Bfree failed: %v", err)
+	}
+	box, err = client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	defer client.Bfree(box)
+	if box.State() != vmstate.STOPPED {
+		t.Errorf("Expected the freed Box to be recovered, got %s", box.State())
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	conf := newStressConfig(1)
+	conf.VMControl.StartCmd = "false $machine"
+	conf.VMControl.RestoreSnapshotCmd = "false $machine $snapshot"
+	conf.VMControlPolicy.QuarantineThreshold = 2
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	for _, op := range []boxer.BoxerOp{boxer.START, boxer.RESTORE, boxer.RECOVER} {
+		client.Do(boxer.BoxerRequest{OP: op, BoxInfo: box})
+	}
+	// the rejected RESTORE does not count, the START and the RECOVER fail
+	if err := client.Bfree(box); err != nil {
+		t.Fatalf("Bfree failed: %v", err)
+	}
+	quarantined := client.Quarantined()
+	if len(quarantined) != 1 || quarantined[0].Box.Machine() != box.Machine() || quarantined[0].Failures != 2 {
+		t.Fatalf("Expected %s to be quarantined after 2 failures, got %+v", box.Machine(), quarantined)
+	}
+	if _, err := client.Balloc("stressGroup"); !berror.Is(err, berror.Full) {
+		t.Fatalf("Expected Full error while the only Box is quarantined, got %v", err)
+	}
+	if err := client.Unquarantine(quarantined[0].Box); err != nil {
+		t.Fatalf("Unquarantine failed: %v", err)
+	}
+	box, err = client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate the released Box: %v", err)
+	}
+	client.Bfree(box)
+}
+
+func TestBfreeFreePolicyRestore(t *testing.T) {
+	conf := newStressConfig(1)
+	conf.Groups = map[string]config.GroupConfig{
+		"stressGroup": {FreePolicy: config.FREE_POLICY_RESTORE},
+	}
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	if _, err := client.Do(boxer.BoxerRequest{OP: boxer.START, BoxInfo: box}); err != nil {
+		t.Fatalf("START failed: %v", err)
+	}
+	// the running Box is stopped and restored before it is handed out again
+	if err := client.Bfree(box); err != nil {
+		t.Fatalf("Bfree failed: %v", err)
+	}
+	box, err = client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	if box.State() != vmstate.STOPPED {
+		t.Errorf("Expected the freed Box to be stopped, got %s", box.State())
+	}
+	client.Bfree(box)
+}
+
+func TestBfreeFreePolicyFailure(t *testing.T) {
+	conf := newStressConfig(1)
+	conf.VMControl.RestoreSnapshotCmd = "false $machine $snapshot"
+	conf.Groups = map[string]config.GroupConfig{
+		"stressGroup": {FreePolicy: config.FREE_POLICY_RESTORE},
+	}
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	err = client.Bfree(box)
+	if err == nil || berror.ResultOf(err) == nil {
+		t.Fatalf("Expected the error of the failed restore with its result, got %v", err)
+	}
+	// the Box which is not clean is quarantined instead of being handed out again
+	if quarantined := client.Quarantined(); len(quarantined) != 1 || quarantined[0].Box.Machine() != box.Machine() {
+		t.Fatalf("Expected %s to be quarantined, got %+v", box.Machine(), quarantined)
+	}
+	if _, err := client.Balloc("stressGroup"); !berror.Is(err, berror.Full) {
+		t.Errorf("Expected Full error while the only Box is quarantined, got %v", err)
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	conf := newStressConfig(1)
+	conf.VMControlPolicy.LeaseSec = 1
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	defer client.Close()
+	reclaimed := make(chan boxer.Box, 1)
+	client.SetLeaseExpiredHandler(func(box boxer.Box) {
+		reclaimed <- box
+	})
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	if box.Expires().IsZero() {
+		t.Fatal("Expected the Box to hold a lease")
+	}
+	renewed, err := client.Renew(box)
+	if err != nil {
+		t.Fatalf("Renew failed: %v", err)
+	}
+	if renewed.Expires().Before(box.Expires()) {
+		t.Errorf("Expected the lease to be extended, got %v before %v", renewed.Expires(), box.Expires())
+	}
+	// the holder stops renewing, e.g. it has crashed
+	select {
+	case expired := <-reclaimed:
+		if expired.Machine() != box.Machine() {
+			t.Errorf("Expected %s to be reclaimed, got %s", box.Machine(), expired.Machine())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the expired Box to be reclaimed")
+	}
+	if _, err := client.Renew(box); err == nil {
+		t.Error("Expected Renew of the reclaimed Box to fail")
+	}
+	box, err = client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate the reclaimed Box: %v", err)
+	}
+	client.Bfree(box)
+}
+
+// forgedBox is a Box built by a caller for a VM it does not hold.
+type forgedBox struct {
+	boxer.Box
+	token string
+}
+
+func (b forgedBox) Token() string {
+	return b.token
+}
+
+func TestAllocationToken(t *testing.T) {
+	client, err := boxer.NewBoxerClient(newStressConfig(1), os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	if box.Token() == "" {
+		t.Fatal("Expected the Box to carry an allocation token")
+	}
+	for _, forged := range []boxer.Box{forgedBox{Box: box}, forgedBox{Box: box, token: "0123456789abcdef"}} {
+		if _, err := client.Do(boxer.BoxerRequest{OP: boxer.START, BoxInfo: forged}); !berror.Is(err, berror.InvalidToken) {
+			t.Errorf("Expected InvalidToken error for Do with a forged Box, got %v", err)
+		}
+		if err := client.Bfree(forged); !berror.Is(err, berror.InvalidToken) {
+			t.Errorf("Expected InvalidToken error for Bfree with a forged Box, got %v", err)
+		}
+	}
+	resp, err := client.Do(boxer.BoxerRequest{OP: boxer.START, BoxInfo: box})
+	if err != nil {
+		t.Fatalf("START failed: %v", err)
+	}
+	if resp.BoxInfo.Token() != box.Token() {
+		t.Errorf("Expected the Box of the response to carry the token")
+	}
+	if err := client.Bfree(box); err != nil {
+		t.Fatalf("Bfree failed: %v", err)
+	}
+	// the Box is stale once it is freed, even if its VM is allocated again
+	next, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	if next.Token() == box.Token() {
+		t.Error("Expected a new token for the new allocation")
+	}
+	if err := client.Bfree(box); !berror.Is(err, berror.InvalidToken) {
+		t.Errorf("Expected InvalidToken error for a stale Box, got %v", err)
+	}
+	if err := client.Bfree(next); err != nil {
+		t.Fatalf("Bfree failed: %v", err)
+	}
+}
+
+func TestAllocationOwner(t *testing.T) {
+	client, err := boxer.NewBoxerClient(newStressConfig(1), os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	alice := boxer.WithOwner(context.Background(), "alice")
+	box, err := client.BallocContext(alice, "stressGroup")
+	if err != nil {
+		t.Fatalf("Failed to allocate Box: %v", err)
+	}
+	// the Box with its token is still refused to another owner, or to a caller without an owner
+	for _, ctx := range []context.Context{boxer.WithOwner(context.Background(), "bob"), context.Background()} {
+		if _, err := client.DoContext(ctx, boxer.BoxerRequest{OP: boxer.START, BoxInfo: box}); !berror.Is(err, berror.InvalidToken) {
+			t.Errorf("Expected InvalidToken error for Do of %q, got %v", boxer.OwnerFrom(ctx), err)
+		}
+		if _, err := client.RenewContext(ctx, box); !berror.Is(err, berror.InvalidToken) {
+			t.Errorf("Expected InvalidToken error for Renew of %q, got %v", boxer.OwnerFrom(ctx), err)
+		}
+		if err := client.BfreeContext(ctx, box); !berror.Is(err, berror.InvalidToken) {
+			t.Errorf("Expected InvalidToken error for Bfree of %q, got %v", boxer.OwnerFrom(ctx), err)
+		}
+	}
+	if _, err := client.DoContext(alice, boxer.BoxerRequest{OP: boxer.START, BoxInfo: box}); err != nil {
+		t.Fatalf("START failed: %v", err)
+	}
+	if err := client.BfreeContext(alice, box); err != nil {
+		t.Fatalf("Bfree failed: %v", err)
+	}
+}
+
+func TestBallocSelector(t *testing.T) {
+	conf := newStressConfig(2)
+	vmInfo := conf.VMInfo["stress_vm_1"]
+	vmInfo.OS = "windows"
+	vmInfo.Labels = map[string]string{"office": "2019"}
+	conf.VMInfo["stress_vm_1"] = vmInfo
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	if _, err := client.BallocSelector(context.Background(), "os in (windows"); !berror.Is(err, berror.InvalidArgument) {
+		t.Fatalf("Expected InvalidArgument error for a malformed selector, got %v", err)
+	}
+	box, err := client.BallocSelector(context.Background(), "os=windows, office=2019")
+	if err != nil {
+		t.Fatalf("BallocSelector failed: %v", err)
+	}
+	if box.Machine() != "stress_vm_1" || box.Labels()["office"] != "2019" || box.Labels()[config.LABEL_GROUP] != "stressGroup" {
+		t.Errorf("Expected stress_vm_1 with its labels, got %s %v", box.Machine(), box.Labels())
+	}
+	if _, err := client.BallocSelector(context.Background(), "os=windows"); !berror.Is(err, berror.Full) {
+		t.Errorf("Expected Full error, got %v", err)
+	}
+	client.Bfree(box)
+}
+
+func TestBallocMany(t *testing.T) {
+	conf := newStressConfig(3)
+	vmInfo := conf.VMInfo["stress_vm_2"]
+	vmInfo.Group = "attackGroup"
+	conf.VMInfo["stress_vm_2"] = vmInfo
+	client, err := boxer.NewBoxerClient(conf, os.Stdin, nil)
+	if err != nil {
+		t.Fatalf("Failed to create BoxerClient: %v", err)
+	}
+	reqs := []boxer.BoxRequirement{{Group: "stressGroup", Count: 1}, {Group: "attackGroup", Count: 1}}
+	if _, err := client.BallocMany(context.Background(), []boxer.BoxRequirement{{Group: "stressGroup", Count: 3}}); !berror.Is(err, berror.InvalidArgument) {
+		t.Fatalf("Expected InvalidArgument error for a set larger than the group, got %v", err)
+	}
+	boxes, err := client.BallocMany(context.Background(), reqs)
+	if err != nil || len(boxes) != 2 {
+		t.Fatalf("BallocMany failed: %v %v", boxes, err)
+	}
+	if boxes[0].Group() != "stressGroup" || boxes[1].Group() != "attackGroup" || boxes[0].Token() == "" || boxes[1].Token() == "" {
+		t.Fatalf("Expected the Boxes in the order of the requirements with tokens, got %v", boxes)
+	}
+	// the attacker is held, so the second set is not allocated at all
+	if _, err := client.BallocMany(context.Background(), reqs); !berror.Is(err, berror.Full) {
+		t.Fatalf("Expected Full error, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.BallocManyWait(ctx, reqs); !berror.Is(err, berror.Timeout) {
+		t.Fatalf("Expected Timeout error, got %v", err)
+	}
+	box, err := client.Balloc("stressGroup")
+	if err != nil {
+		t.Fatalf("Expected the last stressGroup Box to be left free, got %v", err)
+	}
+	client.Bfree(box)
+	for _, box := range boxes {
+		if err := client.Bfree(box); err != nil {
+			t.Errorf("Failed to free %s: %v", box.Machine(), err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+const (
+	BACKEND_VIRTUALBOX = "virtualbox" // BACKEND_VIRTUALBOX controls the VMs with VBoxManage
+	BACKEND_LIBVIRT    = "libvirt"    // BACKEND_LIBVIRT controls the VMs with virsh
+	BACKEND_VMRUN      = "vmrun"      // BACKEND_VMRUN controls the VMs with VMware vmrun, $machine is the path of the .vmx file
+)
+
+const (
+	STOP_MODE_POWEROFF = "poweroff" // STOP_MODE_POWEROFF cuts the power of the VM, this is the default
+	STOP_MODE_SHUTDOWN = "shutdown" // STOP_MODE_SHUTDOWN asks the guest OS to shut down gracefully
+)
+
+// backendPreset is the set of the VM control commands of a backend.
+type backendPreset struct {
+	startCmd           string
+	poweroffCmd        string
+	shutdownCmd        string
+	restoreSnapshotCmd string
+	statusCmd          string
+	statusRules        []VMStatusRuleConfig
+}
+
+// backendPresets are the vetted commands of the supported backends.
+// The VMs are started headless, because boxer is meant to run on servers.
+var backendPresets = map[string]backendPreset{
+	BACKEND_VIRTUALBOX: {
+		startCmd:           "VBoxManage startvm $machine --type headless",
+		poweroffCmd:        "VBoxManage controlvm $machine poweroff",
+		shutdownCmd:        "VBoxManage controlvm $machine acpipowerbutton",
+		restoreSnapshotCmd: "VBoxManage snapshot $machine restore $snapshot",
+		statusCmd:          "VBoxManage showvminfo $machine --machinereadable",
+		statusRules: []VMStatusRuleConfig{
+			{State: "running", Regex: `(?m)^VMState="running"`},
+			{State: "stopped", Regex: `(?m)^VMState="(poweroff|aborted|saved)"`},
+			{State: "restoring", Regex: `(?m)^VMState="restoring"`},
+		},
+	},
+	BACKEND_LIBVIRT: {
+		startCmd:           "virsh start $machine",
+		poweroffCmd:        "virsh destroy $machine",
+		shutdownCmd:        "virsh shutdown $machine",
+		restoreSnapshotCmd: "virsh snapshot-revert $machine $snapshot",
+		statusCmd:          "virsh domstate $machine",
+		statusRules: []VMStatusRuleConfig{
+			{State: "running", Regex: `(?m)^running`},
+			{State: "stopped", Regex: `(?m)^shut off`},
+			{State: "error", Regex: `(?m)^crashed`},
+		},
+	},
+	BACKEND_VMRUN: {
+		startCmd:           "vmrun start $machine nogui",
+		poweroffCmd:        "vmrun stop $machine hard",
+		shutdownCmd:        "vmrun stop $machine soft",
+		restoreSnapshotCmd: "vmrun revertToSnapshot $machine $snapshot",
+		// vmrun has no command printing the state of a single VM, so it has no status preset
+	},
+}
+
+// Backends returns the names of the supported backends.
+func Backends() []string {
+	names := make([]string, 0, len(backendPresets))
+	for name := range backendPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Expand returns a copy of the VMControlConfig whose empty commands are filled by the preset of its Backend.
+// The commands set explicitly are kept, so they override the preset.
+// The StopMode selects the preset stop command. A VMControlConfig without a Backend is returned as it is.
+func (c *VMControlConfig) Expand() VMControlConfig {
+	expanded := *c
+	preset, exists := backendPresets[c.Backend]
+	if !exists {
+		return expanded
+	}
+	if expanded.StartCmd == "" {
+		expanded.StartCmd = preset.startCmd
+	}
+	if expanded.StopCmd == "" {
+		if c.StopMode == STOP_MODE_SHUTDOWN {
+			expanded.StopCmd = preset.shutdownCmd
+		} else {
+			expanded.StopCmd = preset.poweroffCmd
+		}
+	}
+	if expanded.RestoreSnapshotCmd == "" {
+		expanded.RestoreSnapshotCmd = preset.restoreSnapshotCmd
+	}
+	// the VM is always hard-stopped for a recovery, whatever the StopMode is
+	if expanded.ForceStopCmd == "" {
+		expanded.ForceStopCmd = preset.poweroffCmd
+	}
+	// the preset rules only fit the preset status command
+	if expanded.StatusCmd == "" && len(expanded.StatusRules) == 0 {
+		expanded.StatusCmd = preset.statusCmd
+		expanded.StatusRules = preset.statusRules
+	}
+	return expanded
+}
+
+// validateBackend checks the Backend and the StopMode of the VMControlConfig.
+func (c *VMControlConfig) validateBackend() error {
+	if _, exists := backendPresets[c.Backend]; c.Backend != "" && !exists {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlConfig Validate",
+			Origin: fmt.Errorf("unknown backend %q, supported backends: %v", c.Backend, Backends()),
+		}
+	}
+	switch c.StopMode {
+	case "", STOP_MODE_POWEROFF, STOP_MODE_SHUTDOWN:
+	default:
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlConfig Validate",
+			Origin: fmt.Errorf("unknown stop mode %q, expected %s or %s", c.StopMode, STOP_MODE_POWEROFF, STOP_MODE_SHUTDOWN),
+		}
+	}
+	if c.StopMode != "" && c.Backend == "" {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlConfig Validate",
+			Origin: fmt.Errorf("stop mode %q is set without a backend", c.StopMode),
+		}
+	}
+	return nil
+}
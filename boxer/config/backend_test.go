@@ -0,0 +1,109 @@
+package config_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
+)
+
+func TestBackendExpand(t *testing.T) {
+	for _, backend := range config.Backends() {
+		control := config.VMControlConfig{Backend: backend}
+		if !control.CheckReservedKeyword() {
+			t.Errorf("Preset of backend %s does not contain the reserved keywords", backend)
+		}
+		if err := control.Validate(); err != nil {
+			t.Errorf("Preset of backend %s is invalid: %v", backend, err)
+		}
+	}
+	control := config.VMControlConfig{Backend: config.BACKEND_VIRTUALBOX}
+	expanded := control.Expand()
+	if expanded.StartCmd != "VBoxManage startvm $machine --type headless" {
+		t.Errorf("Unexpected start command %q", expanded.StartCmd)
+	}
+	if expanded.StopCmd != "VBoxManage controlvm $machine poweroff" {
+		t.Errorf("Expected the poweroff stop command by default, got %q", expanded.StopCmd)
+	}
+}
+
+func TestBackendStopMode(t *testing.T) {
+	control := config.VMControlConfig{
+		Backend:  config.BACKEND_LIBVIRT,
+		StopMode: config.STOP_MODE_SHUTDOWN,
+	}
+	if stop := control.Expand().StopCmd; stop != "virsh shutdown $machine" {
+		t.Errorf("Expected the graceful stop command, got %q", stop)
+	}
+	control.StopMode = config.STOP_MODE_POWEROFF
+	if stop := control.Expand().StopCmd; stop != "virsh destroy $machine" {
+		t.Errorf("Expected the poweroff stop command, got %q", stop)
+	}
+}
+
+func TestBackendExplicitOverride(t *testing.T) {
+	control := config.VMControlConfig{
+		Backend:  config.BACKEND_VIRTUALBOX,
+		StartCmd: "VBoxManage startvm $machine --type gui",
+	}
+	expanded := control.Expand()
+	if expanded.StartCmd != "VBoxManage startvm $machine --type gui" {
+		t.Errorf("Explicit start command is not kept, got %q", expanded.StartCmd)
+	}
+	if expanded.RestoreSnapshotCmd != "VBoxManage snapshot $machine restore $snapshot" {
+		t.Errorf("Preset restore command is not used, got %q", expanded.RestoreSnapshotCmd)
+	}
+}
+
+func TestBackendGroupOverride(t *testing.T) {
+	conf := newOverrideTestConfig()
+	// the group backend replaces every global command, even the explicit ones
+	conf.Groups["kvmGroup"] = config.GroupConfig{
+		VMControl: config.VMControlConfig{Backend: config.BACKEND_LIBVIRT},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	kvm := conf.ResolvedVMInfo()["kvm"]
+	if kvm.VMControl.StartCmd != "virsh start $machine" {
+		t.Errorf("Expected the libvirt start command, got %q", kvm.VMControl.StartCmd)
+	}
+	if kvm.VMControl.StopCmd != "virsh destroy $machine" {
+		t.Errorf("Expected the VM stop command, got %q", kvm.VMControl.StopCmd)
+	}
+}
+
+func TestBackendInvalid(t *testing.T) {
+	for _, control := range []config.VMControlConfig{
+		{Backend: "hyperv"},
+		{Backend: config.BACKEND_VMRUN, StopMode: "suspend"},
+		{StopMode: config.STOP_MODE_SHUTDOWN, StartCmd: "a $machine", StopCmd: "b $machine", RestoreSnapshotCmd: "c $machine $snapshot"},
+	} {
+		if err := control.Validate(); !berror.Is(err, berror.InvalidConfig) {
+			t.Errorf("Expected InvalidConfig error for %+v, got %v", control, err)
+		}
+	}
+}
+
+func TestLoadBackend(t *testing.T) {
+	conf, err := config.LoadReader(strings.NewReader(`
+vm_info:
+  openssh:
+    name: openssh
+    snapshot: Snapshot 1
+    ip: 127.0.0.3
+    os: linux
+    group: testGroup2
+vm_control:
+  backend: virtualbox
+  stop_mode: shutdown
+`))
+	if err != nil {
+		t.Fatalf("LoadReader failed: %v", err)
+	}
+	resolved := conf.ResolvedVMInfo()["openssh"]
+	if resolved.VMControl.StopCmd != "VBoxManage controlvm $machine acpipowerbutton" {
+		t.Errorf("Unexpected stop command %q", resolved.VMControl.StopCmd)
+	}
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+// commandPart is a piece of a command argument.
+// It is either a literal text or the name of a placeholder.
+type commandPart struct {
+	text        string
+	placeholder bool
+}
+
+// Command is a VM control command line split into arguments.
+//
+// The command line is split like a POSIX shell does:
+//   - arguments are separated by unquoted spaces, tabs and newlines
+//   - text in single quotes is taken literally
+//   - text in double quotes keeps its spaces, and a backslash escapes $, ", \ and newline
+//   - outside quotes, a backslash escapes the next character
+//
+// Placeholders ($name or ${name}) are recognized outside single quotes and
+// outside escapes, and are substituted after the command is split.
+// So a substituted value always stays inside its argument, even if it contains spaces or quotes.
+type Command struct {
+	args [][]commandPart
+}
+
+// ParseCommand splits the command line into arguments.
+// It returns an error if a quote or a ${ is not closed, or if the command line ends with a backslash.
+func ParseCommand(line string) (Command, error) {
+	var (
+		cmd     Command
+		arg     []commandPart
+		literal strings.Builder
+		inArg   bool
+	)
+	flushLiteral := func() {
+		if literal.Len() > 0 {
+			arg = append(arg, commandPart{text: literal.String()})
+			literal.Reset()
+		}
+	}
+	endArg := func() {
+		flushLiteral()
+		if inArg {
+			cmd.args = append(cmd.args, arg)
+		}
+		arg = nil
+		inArg = false
+	}
+	parseError := func(format string, a ...any) (Command, error) {
+		return Command{}, berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in config.ParseCommand",
+			Origin: fmt.Errorf("command %q: "+format, append([]any{line}, a...)...),
+		}
+	}
+	// readPlaceholder reads the placeholder starting at line[i] == '$'.
+	// It returns the name and the index after the placeholder,
+	// or an empty name if the '$' does not start a placeholder.
+	readPlaceholder := func(i int) (string, int, error) {
+		if i+1 < len(line) && line[i+1] == '{' {
+			end := strings.IndexByte(line[i+2:], '}')
+			if end < 0 {
+				return "", i, fmt.Errorf("unterminated ${ at offset %d", i)
+			}
+			name := line[i+2 : i+2+end]
+			if !isPlaceholderName(name) {
+				return "", i, fmt.Errorf("invalid placeholder ${%s} at offset %d", name, i)
+			}
+			return name, i + 3 + end, nil
+		}
+		end := i + 1
+		for end < len(line) && isPlaceholderChar(line[end], end == i+1) {
+			end++
+		}
+		return line[i+1 : end], end, nil
+	}
+
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			endArg()
+			i++
+		case c == '\\':
+			if i+1 >= len(line) {
+				return parseError("trailing backslash")
+			}
+			if line[i+1] != '\n' {
+				// backslash-newline is a line continuation
+				literal.WriteByte(line[i+1])
+				inArg = true
+			}
+			i += 2
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return parseError("unterminated single quote at offset %d", i)
+			}
+			literal.WriteString(line[i+1 : i+1+end])
+			inArg = true
+			i += end + 2
+		case c == '"':
+			inArg = true
+			i++
+			closed := false
+			for i < len(line) && !closed {
+				switch line[i] {
+				case '"':
+					closed = true
+					i++
+				case '\\':
+					if i+1 < len(line) && strings.IndexByte("$\"\\\n", line[i+1]) >= 0 {
+						if line[i+1] != '\n' {
+							literal.WriteByte(line[i+1])
+						}
+						i += 2
+					} else {
+						literal.WriteByte('\\')
+						i++
+					}
+				case '$':
+					name, next, err := readPlaceholder(i)
+					if err != nil {
+						return parseError("%v", err)
+					}
+					if name == "" {
+						literal.WriteByte('$')
+						i++
+						continue
+					}
+					flushLiteral()
+					arg = append(arg, commandPart{text: name, placeholder: true})
+					i = next
+				default:
+					literal.WriteByte(line[i])
+					i++
+				}
+			}
+			if !closed {
+				return parseError("unterminated double quote")
+			}
+		case c == '$':
+			name, next, err := readPlaceholder(i)
+			if err != nil {
+				return parseError("%v", err)
+			}
+			inArg = true
+			if name == "" {
+				literal.WriteByte('$')
+				i++
+				continue
+			}
+			flushLiteral()
+			arg = append(arg, commandPart{text: name, placeholder: true})
+			i = next
+		default:
+			literal.WriteByte(c)
+			inArg = true
+			i++
+		}
+	}
+	endArg()
+	return cmd, nil
+}
+
+// isPlaceholderName reports whether name is a valid placeholder name.
+func isPlaceholderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isPlaceholderChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// isPlaceholderChar reports whether c can be used in a placeholder name.
+// The first character cannot be a digit.
+func isPlaceholderChar(c byte, first bool) bool {
+	switch {
+	case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		return true
+	case '0' <= c && c <= '9':
+		return !first
+	default:
+		return false
+	}
+}
+
+// Len returns the number of arguments of the command.
+func (c Command) Len() int {
+	return len(c.args)
+}
+
+// Placeholders returns the names of the placeholders used in the command, without the leading '$'.
+// Each name is returned once, in the order of its first appearance.
+func (c Command) Placeholders() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, arg := range c.args {
+		for _, part := range arg {
+			if part.placeholder && !seen[part.text] {
+				seen[part.text] = true
+				names = append(names, part.text)
+			}
+		}
+	}
+	return names
+}
+
+// HasPlaceholder reports whether the command uses the given placeholder.
+// The name can be given with or without the leading '$'.
+func (c Command) HasPlaceholder(name string) bool {
+	name = strings.TrimPrefix(name, "$")
+	for _, placeholder := range c.Placeholders() {
+		if placeholder == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand returns the argv of the command with the placeholders substituted by values.
+// The keys of values are placeholder names without the leading '$'.
+// A placeholder without a value is kept as it is written in the command.
+func (c Command) Expand(values map[string]string) []string {
+	argv := make([]string, len(c.args))
+	for i, arg := range c.args {
+		var sb strings.Builder
+		for _, part := range arg {
+			if !part.placeholder {
+				sb.WriteString(part.text)
+				continue
+			}
+			if value, exists := values[part.text]; exists {
+				sb.WriteString(value)
+			} else {
+				sb.WriteString("$" + part.text)
+			}
+		}
+		argv[i] = sb.String()
+	}
+	return argv
+}
@@ -0,0 +1,79 @@
+package config_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hongsam14/boxer/config"
+)
+
+func TestParseCommand(t *testing.T) {
+	values := map[string]string{
+		"machine":  "my vm",
+		"snapshot": "Snapshot 1",
+	}
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"VBoxManage startvm $machine", []string{"VBoxManage", "startvm", "my vm"}},
+		{"VBoxManage  snapshot\t$machine restore $snapshot", []string{"VBoxManage", "snapshot", "my vm", "restore", "Snapshot 1"}},
+		{`echo "Snapshot 1" 'a b' c\ d`, []string{"echo", "Snapshot 1", "a b", "c d"}},
+		{`echo "$machine.vbox" ${machine}_clone`, []string{"echo", "my vm.vbox", "my vm_clone"}},
+		{`echo '$machine' \$machine "\$machine"`, []string{"echo", "$machine", "$machine", "$machine"}},
+		{`echo "" '' "a\"b" "a\b"`, []string{"echo", "", "", `a"b`, `a\b`}},
+		{"echo $ $1 $HOME", []string{"echo", "$", "$1", "$HOME"}},
+		{"echo a\\\nb", []string{"echo", "ab"}},
+		{"  ", []string{}},
+	}
+	for _, test := range tests {
+		cmd, err := config.ParseCommand(test.command)
+		if err != nil {
+			t.Errorf("ParseCommand(%q) failed: %v", test.command, err)
+			continue
+		}
+		if got := cmd.Expand(values); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseCommand(%q).Expand() = %q, want %q", test.command, got, test.want)
+		}
+	}
+}
+
+func TestParseCommandInjection(t *testing.T) {
+	cmd, err := config.ParseCommand("VBoxManage startvm $machine")
+	if err != nil {
+		t.Fatalf("ParseCommand failed: %v", err)
+	}
+	// a value can never break out of its argument
+	argv := cmd.Expand(map[string]string{"machine": `vm" --type headless '; rm -rf /`})
+	if len(argv) != 3 || argv[2] != `vm" --type headless '; rm -rf /` {
+		t.Errorf("Value is not kept as a single argument: %q", argv)
+	}
+}
+
+func TestParseCommandError(t *testing.T) {
+	for _, command := range []string{
+		`echo "unterminated`,
+		`echo 'unterminated`,
+		`echo trailing\`,
+		`echo ${machine`,
+		`echo ${1machine}`,
+	} {
+		if _, err := config.ParseCommand(command); err == nil {
+			t.Errorf("ParseCommand(%q) should fail", command)
+		}
+	}
+}
+
+func TestCommandPlaceholders(t *testing.T) {
+	cmd, err := config.ParseCommand(`virsh snapshot-revert $machine "$snapshot" '$ignored' ${machine}`)
+	if err != nil {
+		t.Fatalf("ParseCommand failed: %v", err)
+	}
+	want := []string{"machine", "snapshot"}
+	if got := cmd.Placeholders(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Placeholders() = %q, want %q", got, want)
+	}
+	if !cmd.HasPlaceholder(config.SNAPSHOT_KEYWORD) || cmd.HasPlaceholder("ignored") {
+		t.Errorf("HasPlaceholder returned a wrong result")
+	}
+}
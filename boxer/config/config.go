@@ -11,40 +11,323 @@ import (
 const (
 	MACHINE_KEYWORD  = "$machine"
 	SNAPSHOT_KEYWORD = "$snapshot"
+	IP_KEYWORD       = "$ip"
+	OS_KEYWORD       = "$os"
+	GROUP_KEYWORD    = "$group"
 )
 
 // VMControlConfig is a struct that holds the Commandline for the VM control
+// The commands are split into arguments like a shell does, see Command.
 // reserved keyword:
 // - $machine
 // - $snapshot
+// - $ip
+// - $os
+// - $group
+// and the user-defined variables in the vars of each VMInfoConfig.
+//
+// Instead of writing the commands, a Backend can be chosen to use its preset commands.
+// The commands set explicitly override the commands of the preset.
+//
+// The StatusCmd is optional. It probes the actual state of the VM,
+// and its result is mapped to a VM state by the StatusRules.
 type VMControlConfig struct {
+	// Backend is the name of the preset commands: virtualbox, libvirt or vmrun
+	Backend string `mapstructure:"backend" yaml:"backend"`
+	// StopMode selects the preset stop command: poweroff (default) or shutdown
+	StopMode           string `mapstructure:"stop_mode" yaml:"stop_mode"`
 	StartCmd           string `mapstructure:"start_cmd" yaml:"start_cmd"`
 	StopCmd            string `mapstructure:"stop_cmd" yaml:"stop_cmd"`
 	RestoreSnapshotCmd string `mapstructure:"restore_snapshot_cmd" yaml:"restore_snapshot_cmd"`
+	StatusCmd          string `mapstructure:"status_cmd" yaml:"status_cmd"`
+	// ForceStopCmd hard-stops the VM to recover it from the error state. The StopCmd is used if it is empty.
+	ForceStopCmd string `mapstructure:"force_stop_cmd" yaml:"force_stop_cmd"`
+	// StatusRules map the output and the exit code of the StatusCmd to a VM state. The first matching rule wins.
+	StatusRules []VMStatusRuleConfig `mapstructure:"status_rules" yaml:"status_rules"`
 }
 
 func (c *VMControlConfig) CheckReservedKeyword() bool {
+	expanded := c.Expand()
+	start, errStart := ParseCommand(expanded.StartCmd)
+	stop, errStop := ParseCommand(expanded.StopCmd)
+	restore, errRestore := ParseCommand(expanded.RestoreSnapshotCmd)
+	if errStart != nil || errStop != nil || errRestore != nil {
+		return false
+	}
 	// check if the reserved keyword '$machine' is in the command
-	if !strings.Contains(c.StartCmd, MACHINE_KEYWORD) {
+	if !start.HasPlaceholder(MACHINE_KEYWORD) {
 		return false
 	}
 	// check if the reserved keyword "$machine" is in the command
-	if !strings.Contains(c.StopCmd, MACHINE_KEYWORD) {
+	if !stop.HasPlaceholder(MACHINE_KEYWORD) {
 		return false
 	}
 	// check if the reserved keyword "$snapshot" is in the command
-	if !strings.Contains(c.RestoreSnapshotCmd, SNAPSHOT_KEYWORD) ||
-		!strings.Contains(c.RestoreSnapshotCmd, MACHINE_KEYWORD) {
+	if !restore.HasPlaceholder(SNAPSHOT_KEYWORD) ||
+		!restore.HasPlaceholder(MACHINE_KEYWORD) {
 		return false
 	}
 	return true
 }
 
+// Merge returns a copy of the VMControlConfig with the commands overridden by the non-empty commands of override.
+// Both configs are expanded by their own Backend before merging,
+// so a Backend of override replaces all the preset commands of c.
+func (c *VMControlConfig) Merge(override *VMControlConfig) VMControlConfig {
+	merged := c.Expand()
+	if override == nil {
+		return merged
+	}
+	expanded := override.Expand()
+	override = &expanded
+	if override.Backend != "" {
+		merged.Backend = override.Backend
+		merged.StopMode = override.StopMode
+		// the status of the other backend cannot be probed by the preset of c
+		merged.StatusCmd = override.StatusCmd
+		merged.StatusRules = override.StatusRules
+	}
+	if override.StartCmd != "" {
+		merged.StartCmd = override.StartCmd
+	}
+	if override.StopCmd != "" {
+		merged.StopCmd = override.StopCmd
+	}
+	if override.RestoreSnapshotCmd != "" {
+		merged.RestoreSnapshotCmd = override.RestoreSnapshotCmd
+	}
+	if override.StatusCmd != "" {
+		merged.StatusCmd = override.StatusCmd
+	}
+	if override.ForceStopCmd != "" {
+		merged.ForceStopCmd = override.ForceStopCmd
+	}
+	if len(override.StatusRules) > 0 {
+		merged.StatusRules = override.StatusRules
+	}
+	return merged
+}
+
+// validateSyntax checks that the non-empty commands can be parsed.
+// It does not require the commands to be complete, so it can be used for overrides.
+func (c *VMControlConfig) validateSyntax() error {
+	if err := c.validateBackend(); err != nil {
+		return err
+	}
+	for _, command := range []string{c.StartCmd, c.StopCmd, c.RestoreSnapshotCmd, c.StatusCmd, c.ForceStopCmd} {
+		if _, err := ParseCommand(command); err != nil {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in VMControlConfig Validate",
+				Origin: err,
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks that the commands can be parsed and contain the reserved keywords.
+func (c *VMControlConfig) Validate() error {
+	if err := c.validateSyntax(); err != nil {
+		return err
+	}
+	expanded := c.Expand()
+	if err := expanded.validateStatus(); err != nil {
+		return err
+	}
+	if !c.CheckReservedKeyword() {
+		return berror.BoxerError{
+			Code: berror.InvalidConfig,
+			Msg:  "error in VMControlConfig Validate",
+			Origin: fmt.Errorf("VM control commands must contain reserved keywords: " +
+				"$machine and $snapshot"),
+		}
+	}
+	return nil
+}
+
+// CheckPlaceholders checks that every placeholder in the commands has a value for the given VM.
+// A placeholder must be a reserved keyword or a variable in the vars of the VM.
+func (c *VMControlConfig) CheckPlaceholders(vmInfo *VMInfoConfig) error {
+	values := vmInfo.PlaceholderValues()
+	expanded := c.Expand()
+	for _, command := range []string{expanded.StartCmd, expanded.StopCmd, expanded.RestoreSnapshotCmd, expanded.StatusCmd, expanded.ForceStopCmd} {
+		parsed, err := ParseCommand(command)
+		if err != nil {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in VMControlConfig CheckPlaceholders",
+				Origin: err,
+			}
+		}
+		for _, name := range parsed.Placeholders() {
+			if _, exists := values[name]; !exists {
+				return berror.BoxerError{
+					Code:   berror.InvalidConfig,
+					Msg:    "error in VMControlConfig CheckPlaceholders",
+					Origin: fmt.Errorf("unknown placeholder $%s in command %q for VM %s", name, command, vmInfo.Name),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	PADDING_HOST    = "host"    // PADDING_HOST pads the slot of the host with the interval, this is the default
+	PADDING_MACHINE = "machine" // PADDING_MACHINE pads the VM with the interval, the host slot is released at once
+)
+
 // VMPolicyConfig is a struct that holds the policy configuration for the VMControl
 type VMControlPolicyConfig struct {
 	IntervalSec     uint `mapstructure:"interval" yaml:"interval"`                   // Interval is the interval in seconds for the VM control commands
 	TimeoutSec      uint `mapstructure:"timeout" yaml:"timeout"`                     // Timeout is the timeout in seconds for the VM control commands
 	MaxVMOperations uint `mapstructure:"max_vm_operations" yaml:"max_vm_operations"` // MaxVMOperations is the maximum number of VM operations that can be performed in parallel
+	// ReconcileIntervalSec is the interval in seconds for probing the state of every VM with the status command.
+	// Zero disables the background reconciler.
+	ReconcileIntervalSec uint `mapstructure:"reconcile_interval" yaml:"reconcile_interval"`
+	// MaxCommands is the maximum number of VM control commands run in parallel on all the hosts.
+	// Zero means no limit other than the max_operations of each host.
+	// It is also the limit of the boxer host running the VMs without a host, which runs one command at a time if it is zero.
+	MaxCommands uint `mapstructure:"max_commands" yaml:"max_commands"`
+	// Padding selects what the interval pads after a control command: the slot of the host (host, the default)
+	// or the VM itself (machine), which lets the other VMs of the host run their commands meanwhile.
+	Padding string `mapstructure:"padding" yaml:"padding"`
+	// RateLimit limits how often the start, stop and restore snapshot commands are run on all the hosts.
+	RateLimit RateLimitsConfig `mapstructure:"rate_limit" yaml:"rate_limit"`
+	// Retry is the retry policy of the start, stop and restore snapshot commands.
+	// An override replaces it as a whole.
+	Retry RetryConfig `mapstructure:"retry" yaml:"retry"`
+	// RecoverOnFree recovers a VM in the error state when its Box is freed,
+	// by hard-stopping it and restoring its snapshot.
+	// It is a pointer so that an override can turn off the recovery enabled by the policy it overrides.
+	RecoverOnFree *bool `mapstructure:"recover_on_free" yaml:"recover_on_free"`
+	// QuarantineThreshold is the number of consecutive failed operations after which a VM is quarantined,
+	// so it is not allocated until it is released. Zero disables the quarantine.
+	QuarantineThreshold uint `mapstructure:"quarantine_threshold" yaml:"quarantine_threshold"`
+	// QuarantineSec is the time in seconds after which a quarantined VM is released.
+	// Zero keeps the VM quarantined until it is released manually.
+	QuarantineSec uint `mapstructure:"quarantine_duration" yaml:"quarantine_duration"`
+	// LeaseSec is the time in seconds an allocation is held without being renewed.
+	// An expired allocation is reclaimed, so a crashed user does not hold its VM forever. Zero disables the leases.
+	LeaseSec uint `mapstructure:"lease_duration" yaml:"lease_duration"`
+}
+
+// Merge returns a copy of the VMControlPolicyConfig with the fields overridden by the non-zero fields of override.
+func (c *VMControlPolicyConfig) Merge(override *VMControlPolicyConfig) VMControlPolicyConfig {
+	merged := *c
+	if override == nil {
+		return merged
+	}
+	if override.IntervalSec != 0 {
+		merged.IntervalSec = override.IntervalSec
+	}
+	if override.TimeoutSec != 0 {
+		merged.TimeoutSec = override.TimeoutSec
+	}
+	if override.MaxVMOperations != 0 {
+		merged.MaxVMOperations = override.MaxVMOperations
+	}
+	if override.ReconcileIntervalSec != 0 {
+		merged.ReconcileIntervalSec = override.ReconcileIntervalSec
+	}
+	if override.MaxCommands != 0 {
+		merged.MaxCommands = override.MaxCommands
+	}
+	if override.Padding != "" {
+		merged.Padding = override.Padding
+	}
+	if override.RateLimit != (RateLimitsConfig{}) {
+		merged.RateLimit = override.RateLimit
+	}
+	if !override.Retry.IsZero() {
+		merged.Retry = override.Retry
+	}
+	if override.RecoverOnFree != nil {
+		merged.RecoverOnFree = override.RecoverOnFree
+	}
+	if override.QuarantineThreshold != 0 {
+		merged.QuarantineThreshold = override.QuarantineThreshold
+	}
+	if override.QuarantineSec != 0 {
+		merged.QuarantineSec = override.QuarantineSec
+	}
+	if override.LeaseSec != 0 {
+		merged.LeaseSec = override.LeaseSec
+	}
+	return merged
+}
+
+// RecoversOnFree reports whether a VM in the error state is recovered when its Box is freed.
+// It is false if RecoverOnFree is not set.
+func (c *VMControlPolicyConfig) RecoversOnFree() bool {
+	return c.RecoverOnFree != nil && *c.RecoverOnFree
+}
+
+// validateOverride checks the VMControlPolicyConfig used as a group or VM override.
+// MaxVMOperations, ReconcileIntervalSec, MaxCommands, RateLimit, the quarantine and the leases apply to the whole boxer,
+// so they cannot be overridden.
+func (c *VMControlPolicyConfig) validateOverride() error {
+	if c.MaxVMOperations != 0 {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlPolicyConfig Validate",
+			Origin: fmt.Errorf("VM control policy max VM operations cannot be overridden per group or VM"),
+		}
+	}
+	if c.ReconcileIntervalSec != 0 {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlPolicyConfig Validate",
+			Origin: fmt.Errorf("VM control policy reconcile interval cannot be overridden per group or VM"),
+		}
+	}
+	if c.MaxCommands != 0 {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlPolicyConfig Validate",
+			Origin: fmt.Errorf("VM control policy max commands cannot be overridden per group or VM"),
+		}
+	}
+	if c.RateLimit != (RateLimitsConfig{}) {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlPolicyConfig Validate",
+			Origin: fmt.Errorf("VM control policy rate limit cannot be overridden per group or VM"),
+		}
+	}
+	if c.QuarantineThreshold != 0 || c.QuarantineSec != 0 {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlPolicyConfig Validate",
+			Origin: fmt.Errorf("VM control policy quarantine cannot be overridden per group or VM"),
+		}
+	}
+	if c.LeaseSec != 0 {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlPolicyConfig Validate",
+			Origin: fmt.Errorf("VM control policy lease duration cannot be overridden per group or VM"),
+		}
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return err
+	}
+	return c.validatePadding()
+}
+
+// validatePadding checks the Padding of the VMControlPolicyConfig.
+func (c *VMControlPolicyConfig) validatePadding() error {
+	switch c.Padding {
+	case "", PADDING_HOST, PADDING_MACHINE:
+		return nil
+	default:
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlPolicyConfig Validate",
+			Origin: fmt.Errorf("unknown padding %q, expected %s or %s", c.Padding, PADDING_HOST, PADDING_MACHINE),
+		}
+	}
 }
 
 func (c *VMControlPolicyConfig) Validate() error {
@@ -69,7 +352,13 @@ func (c *VMControlPolicyConfig) Validate() error {
 			Origin: fmt.Errorf("VM control policy max VM operations cannot be zero"),
 		}
 	}
-	return nil
+	if err := c.RateLimit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return err
+	}
+	return c.validatePadding()
 }
 
 // VMInfoConfig is a struct that holds the information of the VM
@@ -83,6 +372,46 @@ type VMInfoConfig struct {
 	IP       string `mapstructure:"ip" yaml:"ip"`       // IP is the IP address of the VM
 	OS       string `mapstructure:"os" yaml:"os"`       // OS is the operating system of the VM
 	Group    string `mapstructure:"group" yaml:"group"` // Group is the group of the VM, used for grouping VMs in the UI
+	// Host is the name of the hypervisor host of the VM in the hosts of the BoxerConfig.
+	// An empty Host means the VM runs on the boxer host.
+	Host string `mapstructure:"host" yaml:"host"`
+	// Vars are the user-defined variables of the VM.
+	// Each variable can be used as a $name placeholder in the VM control commands.
+	Vars map[string]string `mapstructure:"vars" yaml:"vars"`
+	// Labels are the user-defined labels of the VM, matched by the selectors of the allocation.
+	// The OS and the Group are the standard labels os and group, so they cannot be set here.
+	Labels map[string]string `mapstructure:"labels" yaml:"labels"`
+	// VMControl overrides the non-empty commands of the group and the global VMControlConfig for this VM.
+	VMControl VMControlConfig `mapstructure:"vm_control" yaml:"vm_control"`
+	// VMControlPolicy overrides the non-zero fields of the group and the global VMControlPolicyConfig for this VM.
+	// MaxVMOperations cannot be overridden.
+	VMControlPolicy VMControlPolicyConfig `mapstructure:"vm_control_policy" yaml:"vm_control_policy"`
+}
+
+// PlaceholderValues returns the values of the placeholders for the VM control commands,
+// keyed by the placeholder name without the leading '$'.
+// It contains the reserved keywords and the user-defined variables.
+func (v *VMInfoConfig) PlaceholderValues() map[string]string {
+	values := make(map[string]string, len(v.Vars)+5)
+	for name, value := range v.Vars {
+		values[name] = value
+	}
+	values[strings.TrimPrefix(MACHINE_KEYWORD, "$")] = v.Name
+	values[strings.TrimPrefix(SNAPSHOT_KEYWORD, "$")] = v.Snapshot
+	values[strings.TrimPrefix(IP_KEYWORD, "$")] = v.IP
+	values[strings.TrimPrefix(OS_KEYWORD, "$")] = v.OS
+	values[strings.TrimPrefix(GROUP_KEYWORD, "$")] = v.Group
+	return values
+}
+
+// isReservedKeyword reports whether name is a reserved keyword, given without the leading '$'.
+func isReservedKeyword(name string) bool {
+	for _, keyword := range []string{MACHINE_KEYWORD, SNAPSHOT_KEYWORD, IP_KEYWORD, OS_KEYWORD, GROUP_KEYWORD} {
+		if name == strings.TrimPrefix(keyword, "$") {
+			return true
+		}
+	}
+	return false
 }
 
 func (v *VMInfoConfig) Validate() error {
@@ -128,25 +457,125 @@ func (v *VMInfoConfig) Validate() error {
 			Origin: fmt.Errorf("VM IP is not a valid IP address"),
 		}
 	}
+	for name := range v.Vars {
+		if !isPlaceholderName(name) {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in VMInfoConfig Validate",
+				Origin: fmt.Errorf("VM variable name %q is not a valid placeholder name", name),
+			}
+		}
+		if isReservedKeyword(name) {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in VMInfoConfig Validate",
+				Origin: fmt.Errorf("VM variable name %q is a reserved keyword", name),
+			}
+		}
+	}
+	if err := v.validateLabels(); err != nil {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMInfoConfig Validate",
+			Origin: err,
+		}
+	}
 	return nil
 }
 
+const (
+	FREE_POLICY_NONE    = "none"    // FREE_POLICY_NONE gives a freed VM back as it is, this is the default
+	FREE_POLICY_STOP    = "stop"    // FREE_POLICY_STOP stops a freed VM before it can be allocated again
+	FREE_POLICY_RESTORE = "restore" // FREE_POLICY_RESTORE stops a freed VM and restores its snapshot
+)
+
+const (
+	ALLOCATION_SPREAD      = "spread"      // ALLOCATION_SPREAD allocates the VM on the least loaded host, this is the default
+	ALLOCATION_FIFO        = "fifo"        // ALLOCATION_FIFO allocates the VM freed longest ago
+	ALLOCATION_LRU         = "lru"         // ALLOCATION_LRU allocates the VM allocated least recently
+	ALLOCATION_MRU         = "mru"         // ALLOCATION_MRU allocates the VM allocated most recently
+	ALLOCATION_ROUND_ROBIN = "round_robin" // ALLOCATION_ROUND_ROBIN allocates the VMs on the hosts in turn
+	ALLOCATION_RANDOM      = "random"      // ALLOCATION_RANDOM allocates a VM at random
+)
+
+// GroupConfig is a struct that holds the configuration shared by the VMs of a group.
+type GroupConfig struct {
+	// FreePolicy is what is done to a VM of the group when its Box is freed: none, stop or restore.
+	// The VM can be allocated again only after it succeeds, and a VM failing it is quarantined.
+	FreePolicy string `mapstructure:"free_policy" yaml:"free_policy"`
+	// AllocationStrategy picks the VM allocated from the free VMs of the group:
+	// spread, fifo, lru, mru, round_robin or random.
+	AllocationStrategy string `mapstructure:"allocation_strategy" yaml:"allocation_strategy"`
+	// VMControl overrides the non-empty commands of the global VMControlConfig for the VMs of the group.
+	VMControl VMControlConfig `mapstructure:"vm_control" yaml:"vm_control"`
+	// VMControlPolicy overrides the non-zero fields of the global VMControlPolicyConfig for the VMs of the group.
+	// MaxVMOperations cannot be overridden.
+	VMControlPolicy VMControlPolicyConfig `mapstructure:"vm_control_policy" yaml:"vm_control_policy"`
+}
+
 type BoxerConfig struct {
 	// VMInfo is the configuration for the VM
 	VMInfo map[string]VMInfoConfig `mapstructure:"vm_info" yaml:"vm_info"`
+	// Groups is the configuration for the groups of VMs, keyed by the group name
+	Groups map[string]GroupConfig `mapstructure:"groups" yaml:"groups"`
+	// Hosts is the configuration for the hypervisor hosts, keyed by the host name
+	Hosts map[string]HostConfig `mapstructure:"hosts" yaml:"hosts"`
 	// VMControl is the configuration for the VM control commands
 	VMControl VMControlConfig `mapstructure:"vm_control" yaml:"vm_control"`
 	// VMControlPolicy is the configuration for the VM control policy
 	VMControlPolicy VMControlPolicyConfig `mapstructure:"vm_control_policy" yaml:"vm_control_policy"`
 }
 
+// ResolveVMInfo returns a copy of the VMInfoConfig whose VMControl and VMControlPolicy
+// are the effective configurations of the VM.
+// The global configuration is overridden by the group configuration, which is overridden by the VM configuration.
+// The policy of the host of the VM is applied between the global and the group policy.
+func (bc *BoxerConfig) ResolveVMInfo(vmInfo VMInfoConfig) VMInfoConfig {
+	group := bc.Groups[vmInfo.Group]
+	host := bc.Hosts[vmInfo.Host]
+	control := bc.VMControl.Merge(&group.VMControl)
+	policy := bc.VMControlPolicy.Merge(&host.VMControlPolicy)
+	policy = policy.Merge(&group.VMControlPolicy)
+	vmInfo.VMControl = control.Merge(&vmInfo.VMControl)
+	vmInfo.VMControlPolicy = policy.Merge(&vmInfo.VMControlPolicy)
+	return vmInfo
+}
+
+// ResolvedVMInfo returns the VMInfo map with every VMInfoConfig resolved by ResolveVMInfo.
+func (bc *BoxerConfig) ResolvedVMInfo() map[string]VMInfoConfig {
+	resolved := make(map[string]VMInfoConfig, len(bc.VMInfo))
+	for key, vmInfo := range bc.VMInfo {
+		resolved[key] = bc.ResolveVMInfo(vmInfo)
+	}
+	return resolved
+}
+
 func (bc *BoxerConfig) Validate() error {
-	if !bc.VMControl.CheckReservedKeyword() {
+	// the global commands may be incomplete if every VM completes them by overrides,
+	// so only the syntax is checked here and the resolved commands are checked per VM.
+	if err := bc.VMControl.validateSyntax(); err != nil {
 		return berror.BoxerError{
-			Code: berror.InvalidConfig,
-			Msg:  "error in boxer config.Validate",
-			Origin: fmt.Errorf("VM control commands must contain reserved keywords: " +
-				"$machine and $snapshot"),
+			Code:   berror.InvalidConfig,
+			Msg:    "error in boxer config.Validate",
+			Origin: err,
+		}
+	}
+	for groupName, group := range bc.Groups {
+		if err := bc.validateGroup(groupName, &group); err != nil {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in boxer config.Validate",
+				Origin: fmt.Errorf("invalid group config for group %s: %w", groupName, err),
+			}
+		}
+	}
+	for hostName, host := range bc.Hosts {
+		if err := host.Validate(); err != nil {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in boxer config.Validate",
+				Origin: fmt.Errorf("invalid host config for host %s: %w", hostName, err),
+			}
 		}
 	}
 	for _, vmInfo := range bc.VMInfo {
@@ -157,6 +586,73 @@ func (bc *BoxerConfig) Validate() error {
 				Origin: fmt.Errorf("invalid VM info config for VM %s: %w", vmInfo.Name, err),
 			}
 		}
+		if _, exists := bc.Hosts[vmInfo.Host]; vmInfo.Host != "" && !exists {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in boxer config.Validate",
+				Origin: fmt.Errorf("VM %s references an unknown host %s", vmInfo.Name, vmInfo.Host),
+			}
+		}
+		if err := vmInfo.VMControlPolicy.validateOverride(); err != nil {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in boxer config.Validate",
+				Origin: fmt.Errorf("invalid VM info config for VM %s: %w", vmInfo.Name, err),
+			}
+		}
+		resolved := bc.ResolveVMInfo(vmInfo)
+		if err := resolved.VMControl.Validate(); err != nil {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in boxer config.Validate",
+				Origin: fmt.Errorf("invalid VM control config for VM %s: %w", vmInfo.Name, err),
+			}
+		}
+		if err := resolved.VMControl.CheckPlaceholders(&resolved); err != nil {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in boxer config.Validate",
+				Origin: err,
+			}
+		}
+		if err := resolved.VMControlPolicy.Validate(); err != nil {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in boxer config.Validate",
+				Origin: fmt.Errorf("invalid VM control policy config for VM %s: %w", vmInfo.Name, err),
+			}
+		}
 	}
 	return bc.VMControlPolicy.Validate()
 }
+
+// validateGroup checks the GroupConfig of the given group.
+func (bc *BoxerConfig) validateGroup(groupName string, group *GroupConfig) error {
+	used := false
+	for _, vmInfo := range bc.VMInfo {
+		if vmInfo.Group == groupName {
+			used = true
+			break
+		}
+	}
+	if !used {
+		return fmt.Errorf("no VM belongs to the group")
+	}
+	if err := group.VMControl.validateSyntax(); err != nil {
+		return err
+	}
+	switch group.FreePolicy {
+	case "", FREE_POLICY_NONE, FREE_POLICY_STOP, FREE_POLICY_RESTORE:
+	default:
+		return fmt.Errorf("unknown free policy %q, expected %s, %s or %s",
+			group.FreePolicy, FREE_POLICY_NONE, FREE_POLICY_STOP, FREE_POLICY_RESTORE)
+	}
+	switch group.AllocationStrategy {
+	case "", ALLOCATION_SPREAD, ALLOCATION_FIFO, ALLOCATION_LRU, ALLOCATION_MRU, ALLOCATION_ROUND_ROBIN, ALLOCATION_RANDOM:
+	default:
+		return fmt.Errorf("unknown allocation strategy %q, expected %s, %s, %s, %s, %s or %s",
+			group.AllocationStrategy, ALLOCATION_SPREAD, ALLOCATION_FIFO, ALLOCATION_LRU,
+			ALLOCATION_MRU, ALLOCATION_ROUND_ROBIN, ALLOCATION_RANDOM)
+	}
+	return group.VMControlPolicy.validateOverride()
+}
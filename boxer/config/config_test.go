@@ -1,9 +1,11 @@
 package config_test
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
 )
 
 func TestCommandChecker(t *testing.T) {
@@ -27,3 +29,367 @@ func TestCommandCheckerFail(t *testing.T) {
 		t.Errorf("CheckReservedKeyword failed")
 	}
 }
+
+func newPlaceholderTestConfig() config.BoxerConfig {
+	return config.BoxerConfig{
+		VMInfo: map[string]config.VMInfoConfig{
+			"vm1": {
+				Name:     "vm1",
+				Snapshot: "snapshot0",
+				IP:       "127.0.0.1",
+				OS:       "linux",
+				Group:    "group1",
+				Vars:     map[string]string{"type": "headless"},
+			},
+		},
+		VMControl: config.VMControlConfig{
+			StartCmd:           "VBoxManage startvm $machine --type $type",
+			StopCmd:            "echo $machine $ip $os $group",
+			RestoreSnapshotCmd: "VBoxManage snapshot $machine restore $snapshot",
+		},
+		VMControlPolicy: config.VMControlPolicyConfig{
+			IntervalSec:     1,
+			TimeoutSec:      30,
+			MaxVMOperations: 1,
+		},
+	}
+}
+
+func TestValidatePlaceholders(t *testing.T) {
+	conf := newPlaceholderTestConfig()
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
+
+func TestValidateUnknownPlaceholder(t *testing.T) {
+	conf := newPlaceholderTestConfig()
+	conf.VMControl.StartCmd = "VBoxManage startvm $machine --type $mode"
+	err := conf.Validate()
+	if !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for unknown placeholder, got %v", err)
+	}
+}
+
+func TestValidateReservedVariable(t *testing.T) {
+	conf := newPlaceholderTestConfig()
+	vmInfo := conf.VMInfo["vm1"]
+	vmInfo.Vars = map[string]string{"type": "headless", "ip": "10.0.0.1"}
+	conf.VMInfo["vm1"] = vmInfo
+	err := conf.Validate()
+	if !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for reserved variable name, got %v", err)
+	}
+}
+
+func newOverrideTestConfig() config.BoxerConfig {
+	return config.BoxerConfig{
+		VMInfo: map[string]config.VMInfoConfig{
+			"vbox": {
+				Name:     "vbox",
+				Snapshot: "snapshot0",
+				IP:       "127.0.0.1",
+				OS:       "windows",
+				Group:    "vboxGroup",
+			},
+			"kvm": {
+				Name:     "kvm",
+				Snapshot: "snapshot0",
+				IP:       "127.0.0.2",
+				OS:       "linux",
+				Group:    "kvmGroup",
+				VMControl: config.VMControlConfig{
+					StopCmd: "virsh destroy $machine",
+				},
+				VMControlPolicy: config.VMControlPolicyConfig{
+					TimeoutSec: 600,
+				},
+			},
+		},
+		Groups: map[string]config.GroupConfig{
+			"kvmGroup": {
+				VMControl: config.VMControlConfig{
+					StartCmd:           "virsh start $machine",
+					StopCmd:            "virsh shutdown $machine",
+					RestoreSnapshotCmd: "virsh snapshot-revert $machine $snapshot",
+				},
+				VMControlPolicy: config.VMControlPolicyConfig{
+					IntervalSec: 5,
+				},
+			},
+		},
+		VMControl: config.VMControlConfig{
+			StartCmd:           "VBoxManage startvm $machine",
+			StopCmd:            "VBoxManage controlvm $machine poweroff",
+			RestoreSnapshotCmd: "VBoxManage snapshot $machine restore $snapshot",
+		},
+		VMControlPolicy: config.VMControlPolicyConfig{
+			IntervalSec:     1,
+			TimeoutSec:      30,
+			MaxVMOperations: 2,
+		},
+	}
+}
+
+func TestResolveVMInfo(t *testing.T) {
+	conf := newOverrideTestConfig()
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	resolved := conf.ResolvedVMInfo()
+	vbox := resolved["vbox"]
+	if !reflect.DeepEqual(vbox.VMControl, conf.VMControl) || !reflect.DeepEqual(vbox.VMControlPolicy, conf.VMControlPolicy) {
+		t.Errorf("VM without overrides should use the global config, got %+v %+v", vbox.VMControl, vbox.VMControlPolicy)
+	}
+	kvm := resolved["kvm"]
+	wantControl := config.VMControlConfig{
+		StartCmd:           "virsh start $machine",
+		StopCmd:            "virsh destroy $machine",
+		RestoreSnapshotCmd: "virsh snapshot-revert $machine $snapshot",
+	}
+	if !reflect.DeepEqual(kvm.VMControl, wantControl) {
+		t.Errorf("Expected control %+v, got %+v", wantControl, kvm.VMControl)
+	}
+	wantPolicy := config.VMControlPolicyConfig{
+		IntervalSec:     5,
+		TimeoutSec:      600,
+		MaxVMOperations: 2,
+	}
+	if !reflect.DeepEqual(kvm.VMControlPolicy, wantPolicy) {
+		t.Errorf("Expected policy %+v, got %+v", wantPolicy, kvm.VMControlPolicy)
+	}
+}
+
+func TestValidateKeepsConfig(t *testing.T) {
+	conf := newOverrideTestConfig()
+	group := conf.Groups["kvmGroup"]
+	group.VMControlPolicy.Retry = config.RetryConfig{MaxAttempts: 3, StderrRegex: []string{`(?i)session is locked`}}
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	expected := newOverrideTestConfig()
+	expected.Groups["kvmGroup"] = group
+	if !reflect.DeepEqual(conf, expected) {
+		t.Errorf("Expected Validate not to modify the config, got %+v", conf)
+	}
+}
+
+func TestResolveVMInfoRecoverOnFree(t *testing.T) {
+	enabled, disabled := true, false
+	conf := newOverrideTestConfig()
+	conf.VMControlPolicy.RecoverOnFree = &enabled
+	group := conf.Groups["kvmGroup"]
+	group.VMControlPolicy.RecoverOnFree = &disabled
+	conf.Groups["kvmGroup"] = group
+	resolved := conf.ResolvedVMInfo()
+	vbox, kvm := resolved["vbox"], resolved["kvm"]
+	if !vbox.VMControlPolicy.RecoversOnFree() {
+		t.Error("Expected the VM without overrides to recover on free")
+	}
+	// the group turns off the recovery enabled globally
+	if kvm.VMControlPolicy.RecoversOnFree() {
+		t.Error("Expected the group override to turn off recover on free")
+	}
+}
+
+func TestValidateIncompleteResolvedCommand(t *testing.T) {
+	conf := newOverrideTestConfig()
+	// the global commands are only completed by the kvm group
+	conf.VMControl = config.VMControlConfig{}
+	err := conf.Validate()
+	if !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for the vbox VM without commands, got %v", err)
+	}
+	delete(conf.VMInfo, "vbox")
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
+
+func TestValidateOverrideMaxVMOperations(t *testing.T) {
+	conf := newOverrideTestConfig()
+	group := conf.Groups["kvmGroup"]
+	group.VMControlPolicy.MaxVMOperations = 1
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for overridden max VM operations, got %v", err)
+	}
+}
+
+func TestValidateUnknownGroup(t *testing.T) {
+	conf := newOverrideTestConfig()
+	conf.Groups["typoGroup"] = config.GroupConfig{}
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for a group without VMs, got %v", err)
+	}
+}
+
+func TestHostValidate(t *testing.T) {
+	for _, host := range []config.HostConfig{
+		{Transport: "telnet", Address: "hv1"},
+		{Transport: config.TRANSPORT_SSH},
+		{Transport: config.TRANSPORT_LOCAL, Address: "hv1"},
+	} {
+		if err := host.Validate(); !berror.Is(err, berror.InvalidConfig) {
+			t.Errorf("Expected InvalidConfig error for %+v, got %v", host, err)
+		}
+	}
+	for _, host := range []config.HostConfig{
+		{},
+		{Transport: config.TRANSPORT_SSH, Address: "10.0.0.2", User: "boxer", KeyPath: "/etc/boxer/id_ed25519"},
+	} {
+		if err := host.Validate(); err != nil {
+			t.Errorf("Validate failed for %+v: %v", host, err)
+		}
+	}
+}
+
+func TestUnknownHost(t *testing.T) {
+	conf := newOverrideTestConfig()
+	kvm := conf.VMInfo["kvm"]
+	kvm.Host = "hv1"
+	conf.VMInfo["kvm"] = kvm
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for an unknown host, got %v", err)
+	}
+	conf.Hosts = map[string]config.HostConfig{
+		"hv1": {Transport: config.TRANSPORT_SSH, Address: "hv1.example.com"},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
+
+func TestResolveVMInfoHostPolicy(t *testing.T) {
+	conf := newOverrideTestConfig()
+	conf.Hosts = map[string]config.HostConfig{
+		"hv1": {
+			MaxOperations:   2,
+			VMControlPolicy: config.VMControlPolicyConfig{IntervalSec: 3, TimeoutSec: 60},
+		},
+	}
+	for _, name := range []string{"vbox", "kvm"} {
+		vmInfo := conf.VMInfo[name]
+		vmInfo.Host = "hv1"
+		conf.VMInfo[name] = vmInfo
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	resolved := conf.ResolvedVMInfo()
+	// the host policy overrides the global policy
+	wantVbox := config.VMControlPolicyConfig{IntervalSec: 3, TimeoutSec: 60, MaxVMOperations: 2}
+	if got := resolved["vbox"].VMControlPolicy; !reflect.DeepEqual(got, wantVbox) {
+		t.Errorf("Expected policy %+v, got %+v", wantVbox, got)
+	}
+	// the group and the VM policies override the host policy
+	wantKvm := config.VMControlPolicyConfig{IntervalSec: 5, TimeoutSec: 600, MaxVMOperations: 2}
+	if got := resolved["kvm"].VMControlPolicy; !reflect.DeepEqual(got, wantKvm) {
+		t.Errorf("Expected policy %+v, got %+v", wantKvm, got)
+	}
+
+	conf.Hosts["hv1"] = config.HostConfig{
+		VMControlPolicy: config.VMControlPolicyConfig{MaxVMOperations: 1},
+	}
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for max VM operations overridden by a host, got %v", err)
+	}
+}
+
+func TestValidatePaddingAndMaxCommands(t *testing.T) {
+	conf := newOverrideTestConfig()
+	conf.VMControlPolicy.MaxCommands = 4
+	conf.VMControlPolicy.Padding = config.PADDING_MACHINE
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	conf.VMControlPolicy.Padding = "vm"
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for an unknown padding, got %v", err)
+	}
+	conf.VMControlPolicy.Padding = ""
+
+	// the padding can be overridden, but the global limit cannot
+	group := conf.Groups["kvmGroup"]
+	group.VMControlPolicy.Padding = config.PADDING_HOST
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	group.VMControlPolicy.MaxCommands = 1
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for overridden max commands, got %v", err)
+	}
+}
+
+func TestValidateRateLimit(t *testing.T) {
+	conf := newOverrideTestConfig()
+	conf.VMControlPolicy.RateLimit = config.RateLimitsConfig{
+		Start:   config.RateLimitConfig{PerMinute: 6, Burst: 2},
+		Restore: config.RateLimitConfig{PerMinute: 0.5},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	for _, limit := range []config.RateLimitConfig{{PerMinute: -1}, {Burst: 2}} {
+		conf.VMControlPolicy.RateLimit.Stop = limit
+		if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+			t.Errorf("Expected InvalidConfig error for %+v, got %v", limit, err)
+		}
+	}
+	conf.VMControlPolicy.RateLimit.Stop = config.RateLimitConfig{}
+
+	vmInfo := conf.VMInfo["kvm"]
+	vmInfo.VMControlPolicy.RateLimit.Start.PerMinute = 1
+	conf.VMInfo["kvm"] = vmInfo
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for an overridden rate limit, got %v", err)
+	}
+}
+
+func TestValidateOverrideQuarantine(t *testing.T) {
+	conf := newOverrideTestConfig()
+	conf.VMControlPolicy.QuarantineThreshold = 3
+	conf.VMControlPolicy.QuarantineSec = 600
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	group := conf.Groups["kvmGroup"]
+	group.VMControlPolicy.QuarantineThreshold = 1
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for an overridden quarantine, got %v", err)
+	}
+}
+
+func TestValidateFreePolicy(t *testing.T) {
+	conf := newOverrideTestConfig()
+	group := conf.Groups["kvmGroup"]
+	group.FreePolicy = config.FREE_POLICY_RESTORE
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	group.FreePolicy = "reboot"
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for an unknown free policy, got %v", err)
+	}
+}
+
+func TestValidateAllocationStrategy(t *testing.T) {
+	conf := newOverrideTestConfig()
+	group := conf.Groups["kvmGroup"]
+	group.AllocationStrategy = config.ALLOCATION_ROUND_ROBIN
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	group.AllocationStrategy = "busiest"
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for an unknown allocation strategy, got %v", err)
+	}
+}
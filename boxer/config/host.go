@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+const (
+	TRANSPORT_LOCAL = "local" // TRANSPORT_LOCAL runs the VM control commands on the boxer host, this is the default
+	TRANSPORT_SSH   = "ssh"   // TRANSPORT_SSH runs the VM control commands on a remote host with the system ssh client
+)
+
+// DEFAULT_SSH_CONNECT_TIMEOUT_SEC is the default timeout in seconds for connecting to a remote host.
+const DEFAULT_SSH_CONNECT_TIMEOUT_SEC = 10
+
+// HostConfig is a struct that holds the configuration of a hypervisor host.
+// The VMs reference their host by its name in the hosts of the BoxerConfig.
+type HostConfig struct {
+	// Transport is how the VM control commands reach the host: local (default) or ssh
+	Transport string `mapstructure:"transport" yaml:"transport"`
+	// Address is the host name or the IP address of the host, required for ssh
+	Address string `mapstructure:"address" yaml:"address"`
+	Port    uint   `mapstructure:"port" yaml:"port"` // Port is the ssh port, zero means the default of the ssh client
+	User    string `mapstructure:"user" yaml:"user"` // User is the ssh login user
+	// KeyPath is the private key file for ssh
+	KeyPath string `mapstructure:"key_path" yaml:"key_path"`
+	// KnownHosts is the known_hosts file for ssh. If it is set, an unknown host key is rejected.
+	KnownHosts string `mapstructure:"known_hosts" yaml:"known_hosts"`
+	// ConnectTimeoutSec is the timeout in seconds for connecting to the host with ssh
+	ConnectTimeoutSec uint `mapstructure:"connect_timeout" yaml:"connect_timeout"`
+	// MaxOperations is the maximum number of VM control commands run in parallel on the host.
+	// Zero means one, so the commands on the host are serialized.
+	MaxOperations uint `mapstructure:"max_operations" yaml:"max_operations"`
+	// VMControlPolicy overrides the non-zero fields of the global VMControlPolicyConfig for the VMs on the host.
+	// The groups and the VMs override it in turn. MaxVMOperations cannot be overridden.
+	VMControlPolicy VMControlPolicyConfig `mapstructure:"vm_control_policy" yaml:"vm_control_policy"`
+}
+
+// IsRemote reports whether the VM control commands are run on a remote host.
+func (h *HostConfig) IsRemote() bool {
+	return h.Transport == TRANSPORT_SSH
+}
+
+// Validate checks the transport of the HostConfig and its ssh settings.
+func (h *HostConfig) Validate() error {
+	switch h.Transport {
+	case "", TRANSPORT_LOCAL:
+		if h.Address != "" || h.User != "" || h.KeyPath != "" || h.KnownHosts != "" || h.Port != 0 {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in HostConfig Validate",
+				Origin: fmt.Errorf("ssh settings are set for a %s host", TRANSPORT_LOCAL),
+			}
+		}
+	case TRANSPORT_SSH:
+		if h.Address == "" {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in HostConfig Validate",
+				Origin: fmt.Errorf("host address cannot be empty for the %s transport", TRANSPORT_SSH),
+			}
+		}
+	default:
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in HostConfig Validate",
+			Origin: fmt.Errorf("unknown transport %q, expected %s or %s", h.Transport, TRANSPORT_LOCAL, TRANSPORT_SSH),
+		}
+	}
+	return h.VMControlPolicy.validateOverride()
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	berror "github.com/hongsam14/boxer/error"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DEFAULT_INTERVAL_SEC = 1   // DEFAULT_INTERVAL_SEC is the default interval in seconds between VM control commands
+	DEFAULT_TIMEOUT_SEC  = 300 // DEFAULT_TIMEOUT_SEC is the default timeout in seconds for VM control commands
+)
+
+// Format is the encoding of a boxer config file.
+type Format int
+
+const (
+	FormatAuto Format = iota // FormatAuto detects the format from the content
+	FormatYAML               // FormatYAML is a YAML encoded config
+	FormatJSON               // FormatJSON is a JSON encoded config
+)
+
+// String returns the string representation of the Format.
+func (f Format) String() string {
+	switch f {
+	case FormatAuto:
+		return "auto"
+	case FormatYAML:
+		return "yaml"
+	case FormatJSON:
+		return "json"
+	default:
+		return "unknown"
+	}
+}
+
+// SetDefaults fills the zero fields of the VMControlPolicyConfig with the default values.
+// MaxVMOperations defaults to the given number of VMs.
+func (c *VMControlPolicyConfig) SetDefaults(numVMs int) {
+	if c.IntervalSec == 0 {
+		c.IntervalSec = DEFAULT_INTERVAL_SEC
+	}
+	if c.TimeoutSec == 0 {
+		c.TimeoutSec = DEFAULT_TIMEOUT_SEC
+	}
+	if c.MaxVMOperations == 0 {
+		c.MaxVMOperations = uint(numVMs)
+	}
+}
+
+// Load reads the boxer config file at the given path.
+// The format is detected by the file extension (.yaml, .yml, .json),
+// or by the content if the extension is unknown.
+// Defaults are applied to the VMControlPolicyConfig and the config is validated before it is returned.
+func Load(path string) (*BoxerConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in config.Load",
+			Origin: fmt.Errorf("failed to open config file %s: %w", path, err),
+		}
+	}
+	defer f.Close()
+
+	format := FormatAuto
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = FormatYAML
+	case ".json":
+		format = FormatJSON
+	}
+	return load(f, path, format)
+}
+
+// LoadReader reads a boxer config from the given reader.
+// It works the same as Load, but the format is always detected by the content.
+func LoadReader(r io.Reader) (*BoxerConfig, error) {
+	return load(r, "<reader>", FormatAuto)
+}
+
+// load decodes the config from r and reports the errors with the given name.
+func load(r io.Reader, name string, format Format) (*BoxerConfig, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in config.Load",
+			Origin: fmt.Errorf("failed to read config %s: %w", name, err),
+		}
+	}
+	if format == FormatAuto {
+		format = detectFormat(data)
+	}
+	// JSON is a subset of YAML, so the YAML decoder handles both formats.
+	// This keeps the yaml tags as the single source of the key names
+	// and reports every error with its line number.
+	conf := new(BoxerConfig)
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(conf); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("config is empty")
+		}
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in config.Load",
+			Origin: fmt.Errorf("failed to decode %s config %s: %w", format, name, err),
+		}
+	}
+	conf.VMControlPolicy.SetDefaults(len(conf.VMInfo))
+	if err := conf.Validate(); err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in config.Load",
+			Origin: fmt.Errorf("invalid config %s: %w", name, err),
+		}
+	}
+	return conf, nil
+}
+
+// detectFormat guesses the format of the data.
+// A document starting with '{' is treated as JSON, everything else as YAML.
+func detectFormat(data []byte) Format {
+	trimmed := bytes.TrimLeft(data, " \t\r\n\ufeff")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return FormatJSON
+	}
+	return FormatYAML
+}
@@ -0,0 +1,136 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
+)
+
+const testYAMLConfig = `
+vm_info:
+  openssh:
+    name: openssh
+    snapshot: Snapshot 1
+    ip: 127.0.0.3
+    os: linux
+    group: testGroup2
+vm_control:
+  start_cmd: VBoxManage startvm $machine
+  stop_cmd: VBoxManage controlvm $machine poweroff
+  restore_snapshot_cmd: VBoxManage snapshot $machine restore $snapshot
+vm_control_policy:
+  interval: 2
+`
+
+const testJSONConfig = `{
+  "vm_info": {
+    "openssh": {
+      "name": "openssh",
+      "snapshot": "Snapshot 1",
+      "ip": "127.0.0.3",
+      "os": "linux",
+      "group": "testGroup2"
+    }
+  },
+  "vm_control": {
+    "start_cmd": "virsh start $machine",
+    "stop_cmd": "virsh shutdown $machine",
+    "restore_snapshot_cmd": "virsh snapshot-revert $machine $snapshot"
+  },
+  "vm_control_policy": {
+    "interval": 1,
+    "timeout": 30,
+    "max_vm_operations": 2
+  }
+}`
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadYAML(t *testing.T) {
+	conf, err := config.Load(writeConfigFile(t, "boxer.yaml", testYAMLConfig))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	vmInfo, exists := conf.VMInfo["openssh"]
+	if !exists {
+		t.Fatal("VM openssh is not loaded")
+	}
+	if vmInfo.Snapshot != "Snapshot 1" {
+		t.Errorf("Expected snapshot 'Snapshot 1', got %q", vmInfo.Snapshot)
+	}
+	// interval is set in the file, the others are defaults
+	if conf.VMControlPolicy.IntervalSec != 2 {
+		t.Errorf("Expected interval 2, got %d", conf.VMControlPolicy.IntervalSec)
+	}
+	if conf.VMControlPolicy.TimeoutSec != config.DEFAULT_TIMEOUT_SEC {
+		t.Errorf("Expected default timeout, got %d", conf.VMControlPolicy.TimeoutSec)
+	}
+	if conf.VMControlPolicy.MaxVMOperations != 1 {
+		t.Errorf("Expected max VM operations to default to the number of VMs, got %d", conf.VMControlPolicy.MaxVMOperations)
+	}
+}
+
+func TestLoadJSON(t *testing.T) {
+	conf, err := config.Load(writeConfigFile(t, "boxer.json", testJSONConfig))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if conf.VMControl.StartCmd != "virsh start $machine" {
+		t.Errorf("Unexpected start command %q", conf.VMControl.StartCmd)
+	}
+	if conf.VMControlPolicy.MaxVMOperations != 2 {
+		t.Errorf("Expected max VM operations 2, got %d", conf.VMControlPolicy.MaxVMOperations)
+	}
+}
+
+func TestLoadReaderDetectsFormat(t *testing.T) {
+	for _, content := range []string{testYAMLConfig, testJSONConfig} {
+		if _, err := config.LoadReader(strings.NewReader(content)); err != nil {
+			t.Errorf("LoadReader failed: %v", err)
+		}
+	}
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	content := strings.Replace(testYAMLConfig, "    group: testGroup2", "    groop: testGroup2", 1)
+	path := writeConfigFile(t, "boxer.yml", content)
+	_, err := config.Load(path)
+	if err == nil {
+		t.Fatal("Expected error for unknown field, but got none")
+	}
+	if !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), path) || !strings.Contains(err.Error(), "line 8") {
+		t.Errorf("Expected error to contain the file and line, got %v", err)
+	}
+}
+
+func TestLoadInvalidConfig(t *testing.T) {
+	content := strings.Replace(testYAMLConfig, "$snapshot", "snapshot", 1)
+	_, err := config.Load(writeConfigFile(t, "boxer.yaml", content))
+	if err == nil {
+		t.Fatal("Expected validation error, but got none")
+	}
+	if !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error, got %v", err)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	_, err := config.Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	if !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error, got %v", err)
+	}
+}
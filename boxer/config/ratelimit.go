@@ -0,0 +1,45 @@
+package config
+
+import (
+	"fmt"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+// RateLimitConfig limits how often a kind of VM control command is run, with a token bucket.
+// Up to Burst commands run at once after a quiet period, and PerMinute commands per minute in the long run.
+// A zero PerMinute means no limit.
+type RateLimitConfig struct {
+	// PerMinute is the number of commands allowed per minute
+	PerMinute float64 `mapstructure:"per_minute" yaml:"per_minute"`
+	// Burst is the number of commands allowed at once, zero means one
+	Burst uint `mapstructure:"burst" yaml:"burst"`
+}
+
+// RateLimitsConfig holds the RateLimitConfig of each kind of VM control command.
+type RateLimitsConfig struct {
+	Start   RateLimitConfig `mapstructure:"start" yaml:"start"`
+	Stop    RateLimitConfig `mapstructure:"stop" yaml:"stop"`
+	Restore RateLimitConfig `mapstructure:"restore" yaml:"restore"`
+}
+
+// Validate checks the rate limits of the RateLimitsConfig.
+func (c *RateLimitsConfig) Validate() error {
+	for name, limit := range map[string]RateLimitConfig{"start": c.Start, "stop": c.Stop, "restore": c.Restore} {
+		if limit.PerMinute < 0 {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in RateLimitsConfig Validate",
+				Origin: fmt.Errorf("%s rate limit cannot be negative: %v", name, limit.PerMinute),
+			}
+		}
+		if limit.PerMinute == 0 && limit.Burst != 0 {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in RateLimitsConfig Validate",
+				Origin: fmt.Errorf("%s rate limit has a burst without per_minute", name),
+			}
+		}
+	}
+	return nil
+}
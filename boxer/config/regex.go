@@ -0,0 +1,28 @@
+package config
+
+import (
+	"regexp"
+	"sync"
+)
+
+// compiledRegex is the result of compiling a regex of the config, kept with its error.
+type compiledRegex struct {
+	re  *regexp.Regexp
+	err error
+}
+
+// regexCache keeps the compiled regexes of the configs keyed by their pattern, so a regex matched
+// on every command or every reconcile round is compiled once without modifying the config holding it.
+var regexCache sync.Map
+
+// compileRegex returns the compiled regex of the pattern, compiling it on the first call.
+// An invalid pattern returns the same error on every call.
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	if cached, ok := regexCache.Load(expr); ok {
+		compiled := cached.(compiledRegex)
+		return compiled.re, compiled.err
+	}
+	re, err := regexp.Compile(expr)
+	regexCache.Store(expr, compiledRegex{re: re, err: err})
+	return re, err
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+const (
+	DEFAULT_RETRY_BACKOFF_MS = 1000 // DEFAULT_RETRY_BACKOFF_MS is the default wait in milliseconds before the first retry
+	DEFAULT_RETRY_MULTIPLIER = 2    // DEFAULT_RETRY_MULTIPLIER is the default factor growing the wait after each retry
+)
+
+// RetryConfig is the retry policy of the VM control commands.
+// A command failing with a retryable exit code or stderr is run again, up to MaxAttempts times in total,
+// so transient failures of a backend, e.g. a locked VirtualBox session, heal without the caller.
+// The wait before the n-th retry is BackoffMs * Multiplier^(n-1) milliseconds, capped by MaxBackoffMs,
+// and shortened by a random fraction of up to Jitter of it.
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts of a command including the first one, zero or one disables retrying
+	MaxAttempts uint `mapstructure:"max_attempts" yaml:"max_attempts"`
+	// BackoffMs is the wait in milliseconds before the first retry
+	BackoffMs uint `mapstructure:"backoff_ms" yaml:"backoff_ms"`
+	// MaxBackoffMs caps the wait in milliseconds before a retry, zero means no cap
+	MaxBackoffMs uint `mapstructure:"max_backoff_ms" yaml:"max_backoff_ms"`
+	// Multiplier grows the wait after each retry
+	Multiplier float64 `mapstructure:"multiplier" yaml:"multiplier"`
+	// Jitter is the fraction of the wait, between 0 and 1, that is randomly cut so retries of many VMs spread out
+	Jitter float64 `mapstructure:"jitter" yaml:"jitter"`
+	// ExitCodes are the retryable exit codes
+	ExitCodes []int `mapstructure:"exit_codes" yaml:"exit_codes"`
+	// StderrRegex are matched against the stderr of a failed command, the command is retryable if one matches
+	StderrRegex []string `mapstructure:"stderr_regex" yaml:"stderr_regex"`
+}
+
+// IsZero reports whether the RetryConfig is not set.
+func (c *RetryConfig) IsZero() bool {
+	return c.MaxAttempts == 0 && c.BackoffMs == 0 && c.MaxBackoffMs == 0 && c.Multiplier == 0 && c.Jitter == 0 &&
+		len(c.ExitCodes) == 0 && len(c.StderrRegex) == 0
+}
+
+// Validate checks the RetryConfig.
+// A RetryConfig retrying the commands must have a retryable exit code or stderr regex.
+func (c *RetryConfig) Validate() error {
+	if c.Multiplier != 0 && c.Multiplier < 1 {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in RetryConfig Validate",
+			Origin: fmt.Errorf("retry multiplier must be at least 1, got %v", c.Multiplier),
+		}
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in RetryConfig Validate",
+			Origin: fmt.Errorf("retry jitter must be between 0 and 1, got %v", c.Jitter),
+		}
+	}
+	for _, expr := range c.StderrRegex {
+		if _, err := compileRegex(expr); err != nil {
+			return berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in RetryConfig Validate",
+				Origin: fmt.Errorf("invalid retry stderr regex %q: %w", expr, err),
+			}
+		}
+	}
+	if c.MaxAttempts > 1 && len(c.ExitCodes) == 0 && len(c.StderrRegex) == 0 {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in RetryConfig Validate",
+			Origin: fmt.Errorf("retry policy with %d attempts has no retryable exit code or stderr regex", c.MaxAttempts),
+		}
+	}
+	return nil
+}
+
+// Retryable reports whether a command failed with the given exit code and stderr can be retried.
+// A zero exit code is never retryable. The StderrRegex are compiled once and reused by every call,
+// and an invalid one returns berror.InvalidConfig, e.g. if the RetryConfig has not been validated.
+func (c *RetryConfig) Retryable(exitCode int, stderr string) (bool, error) {
+	if exitCode == 0 {
+		return false, nil
+	}
+	if slices.Contains(c.ExitCodes, exitCode) {
+		return true, nil
+	}
+	for _, expr := range c.StderrRegex {
+		re, err := compileRegex(expr)
+		if err != nil {
+			return false, berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in RetryConfig Retryable",
+				Origin: fmt.Errorf("invalid retry stderr regex %q: %w", expr, err),
+			}
+		}
+		if re.MatchString(stderr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Backoff returns the wait before the given retry, counted from 1.
+// random is a number in [0, 1) choosing the jitter, so the result is deterministic for a given random.
+func (c *RetryConfig) Backoff(retry uint, random float64) time.Duration {
+	backoff := float64(c.BackoffMs)
+	if c.BackoffMs == 0 {
+		backoff = DEFAULT_RETRY_BACKOFF_MS
+	}
+	multiplier := c.Multiplier
+	if multiplier == 0 {
+		multiplier = DEFAULT_RETRY_MULTIPLIER
+	}
+	if retry > 1 {
+		backoff *= math.Pow(multiplier, float64(retry-1))
+	}
+	if c.MaxBackoffMs != 0 && backoff > float64(c.MaxBackoffMs) {
+		backoff = float64(c.MaxBackoffMs)
+	}
+	backoff -= backoff * c.Jitter * random
+	return time.Duration(backoff * float64(time.Millisecond))
+}
@@ -0,0 +1,97 @@
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	retry := config.RetryConfig{MaxAttempts: 5, BackoffMs: 100, MaxBackoffMs: 300, Jitter: 0.5}
+	for _, tc := range []struct {
+		retry  uint
+		random float64
+		want   time.Duration
+	}{
+		{1, 0, 100 * time.Millisecond},
+		{2, 0, 200 * time.Millisecond},
+		{3, 0, 300 * time.Millisecond}, // capped
+		{1, 0.5, 75 * time.Millisecond},
+		{2, 0.99, 101 * time.Millisecond},
+	} {
+		if got := retry.Backoff(tc.retry, tc.random); got != tc.want {
+			t.Errorf("Backoff(%d, %v) = %v, want %v", tc.retry, tc.random, got, tc.want)
+		}
+	}
+	// the defaults are a second doubled at each retry
+	if got := (&config.RetryConfig{}).Backoff(3, 0); got != 4*time.Second {
+		t.Errorf("Expected the default backoff of the third retry to be 4s, got %v", got)
+	}
+}
+
+func TestRetryRetryable(t *testing.T) {
+	retry := config.RetryConfig{
+		MaxAttempts: 3,
+		ExitCodes:   []int{75},
+		StderrRegex: []string{`(?i)session is locked`},
+	}
+	if err := retry.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	for _, tc := range []struct {
+		exitCode int
+		stderr   string
+		want     bool
+	}{
+		{75, "", true},
+		{1, "VBoxManage: error: The machine 'vm1' is already locked for a session (or being unlocked)\nSession is locked", true},
+		{1, "VBoxManage: error: Could not find a registered machine named 'vm1'", false},
+		{0, "session is locked", false},
+	} {
+		if got, err := retry.Retryable(tc.exitCode, tc.stderr); err != nil || got != tc.want {
+			t.Errorf("Retryable(%d, %q) = %v %v, want %v", tc.exitCode, tc.stderr, got, err, tc.want)
+		}
+	}
+}
+
+func TestRetryRetryableWithoutValidate(t *testing.T) {
+	// a RetryConfig built in code matches without Validate, and its invalid regex is reported
+	retry := config.RetryConfig{MaxAttempts: 2, StderrRegex: []string{`(?i)session is locked`, `(`}}
+	if retryable, err := retry.Retryable(1, "Session is locked"); !retryable || err != nil {
+		t.Errorf("Expected the stderr to be retryable, got %v %v", retryable, err)
+	}
+	if retryable, err := retry.Retryable(1, "("); retryable || !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for an invalid regex, got %v %v", retryable, err)
+	}
+}
+
+func TestRetryValidate(t *testing.T) {
+	for _, retry := range []config.RetryConfig{
+		{MaxAttempts: 3},
+		{MaxAttempts: 3, ExitCodes: []int{1}, Multiplier: 0.5},
+		{MaxAttempts: 3, ExitCodes: []int{1}, Jitter: 1.5},
+		{MaxAttempts: 3, StderrRegex: []string{"("}},
+	} {
+		if err := retry.Validate(); !berror.Is(err, berror.InvalidConfig) {
+			t.Errorf("Expected InvalidConfig error for %+v, got %v", retry, err)
+		}
+	}
+	// the retry policy can be overridden per group
+	conf := newOverrideTestConfig()
+	group := conf.Groups["kvmGroup"]
+	group.VMControlPolicy.Retry = config.RetryConfig{MaxAttempts: 3, StderrRegex: []string{"("}}
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for an invalid group retry policy, got %v", err)
+	}
+	group.VMControlPolicy.Retry.StderrRegex = []string{"domain is locked"}
+	conf.Groups["kvmGroup"] = group
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if got := conf.ResolvedVMInfo()["kvm"].VMControlPolicy.Retry.MaxAttempts; got != 3 {
+		t.Errorf("Expected the group retry policy to be resolved, got %d attempts", got)
+	}
+}
@@ -0,0 +1,225 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+const (
+	LABEL_OS    = "os"    // LABEL_OS is the standard label holding the OS of the VM
+	LABEL_GROUP = "group" // LABEL_GROUP is the standard label holding the group of the VM
+)
+
+// labelPattern matches the valid label keys and values.
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+// setPattern matches a set membership requirement: key in (v1, v2) or key notin (v1, v2).
+var setPattern = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+// LabelSet returns the labels of the VM, including the standard labels os and group.
+func (v *VMInfoConfig) LabelSet() map[string]string {
+	labels := make(map[string]string, len(v.Labels)+2)
+	for key, value := range v.Labels {
+		labels[key] = value
+	}
+	labels[LABEL_OS] = v.OS
+	labels[LABEL_GROUP] = v.Group
+	return labels
+}
+
+// validateLabels checks the keys and the values of the labels of the VM.
+// The standard labels are set by the fields of the VM, so they cannot be set as labels.
+func (v *VMInfoConfig) validateLabels() error {
+	for key, value := range v.Labels {
+		if key == LABEL_OS || key == LABEL_GROUP {
+			return fmt.Errorf("VM label %q is a standard label", key)
+		}
+		if !labelPattern.MatchString(key) {
+			return fmt.Errorf("VM label key %q is not valid", key)
+		}
+		if !labelPattern.MatchString(value) {
+			return fmt.Errorf("VM label value %q of key %q is not valid", value, key)
+		}
+	}
+	return nil
+}
+
+// selector operators
+const (
+	selectorEquals    = "="
+	selectorNotEquals = "!="
+	selectorIn        = "in"
+	selectorNotIn     = "notin"
+	selectorExists    = "exists"
+	selectorNotExists = "!"
+)
+
+// requirement is a single condition of a Selector on one label.
+type requirement struct {
+	key    string
+	op     string
+	values []string
+}
+
+// matches reports whether the labels satisfy the requirement.
+func (r *requirement) matches(labels map[string]string) bool {
+	value, exists := labels[r.key]
+	switch r.op {
+	case selectorEquals, selectorIn:
+		return exists && containsString(r.values, value)
+	case selectorNotEquals, selectorNotIn:
+		return !exists || !containsString(r.values, value)
+	case selectorExists:
+		return exists
+	case selectorNotExists:
+		return !exists
+	}
+	return false
+}
+
+// containsString reports whether values contains value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Selector selects VMs by their labels.
+//
+// A selector is a comma-separated list of requirements, and a VM matches if it satisfies all of them:
+//   - key=value or key==value: the label is set to the value
+//   - key!=value: the label is not set to the value, or not set at all
+//   - key in (v1, v2): the label is set to one of the values
+//   - key notin (v1, v2): the label is not set to any of the values, or not set at all
+//   - key: the label is set
+//   - !key: the label is not set
+//
+// The empty selector matches every VM.
+type Selector struct {
+	expr         string
+	requirements []requirement
+}
+
+// ParseSelector parses the selector expression.
+// It returns berror.InvalidArgument if the expression is malformed.
+func ParseSelector(expr string) (Selector, error) {
+	selector := Selector{expr: strings.TrimSpace(expr)}
+	if selector.expr == "" {
+		return selector, nil
+	}
+	for _, part := range splitSelector(selector.expr) {
+		req, err := parseRequirement(strings.TrimSpace(part))
+		if err != nil {
+			return Selector{}, berror.BoxerError{
+				Code:   berror.InvalidArgument,
+				Msg:    "error in config.ParseSelector",
+				Origin: fmt.Errorf("selector %q: %w", expr, err),
+			}
+		}
+		selector.requirements = append(selector.requirements, req)
+	}
+	return selector, nil
+}
+
+// splitSelector splits the selector expression by the commas outside the parentheses.
+func splitSelector(expr string) []string {
+	var (
+		parts []string
+		depth int
+		start int
+	)
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, expr[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, expr[start:])
+}
+
+// parseRequirement parses a single requirement of a selector.
+func parseRequirement(part string) (requirement, error) {
+	var req requirement
+	switch {
+	case part == "":
+		return req, fmt.Errorf("empty requirement")
+	case strings.HasPrefix(part, "!") && !strings.Contains(part, "="):
+		req = requirement{key: strings.TrimSpace(part[1:]), op: selectorNotExists}
+	case strings.Contains(part, "!="):
+		key, value, _ := strings.Cut(part, "!=")
+		req = requirement{key: strings.TrimSpace(key), op: selectorNotEquals, values: []string{strings.TrimSpace(value)}}
+	case strings.Contains(part, "="):
+		key, value, _ := strings.Cut(part, "=")
+		value = strings.TrimPrefix(value, "=")
+		req = requirement{key: strings.TrimSpace(key), op: selectorEquals, values: []string{strings.TrimSpace(value)}}
+	case setPattern.MatchString(part):
+		match := setPattern.FindStringSubmatch(part)
+		req = requirement{key: match[1], op: match[2]}
+		for _, value := range strings.Split(match[3], ",") {
+			req.values = append(req.values, strings.TrimSpace(value))
+		}
+	default:
+		req = requirement{key: part, op: selectorExists}
+	}
+	if !labelPattern.MatchString(req.key) {
+		return req, fmt.Errorf("invalid label key %q in %q", req.key, part)
+	}
+	for _, value := range req.values {
+		if !labelPattern.MatchString(value) {
+			return req, fmt.Errorf("invalid label value %q in %q", value, part)
+		}
+	}
+	return req, nil
+}
+
+// String returns the selector expression.
+func (s Selector) String() string {
+	return s.expr
+}
+
+// Matches reports whether the labels satisfy every requirement of the selector.
+func (s Selector) Matches(labels map[string]string) bool {
+	for i := range s.requirements {
+		if !s.requirements[i].matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Required returns a label key and the values one of which the key must be set to for a match,
+// so the VMs can be looked up by an index of the labels instead of being matched one by one.
+// The equality or set membership requirement with the fewest values is returned.
+// It returns false if the selector has no such requirement.
+func (s Selector) Required() (string, []string, bool) {
+	var best *requirement
+	for i := range s.requirements {
+		req := &s.requirements[i]
+		if req.op != selectorEquals && req.op != selectorIn {
+			continue
+		}
+		if best == nil || len(req.values) < len(best.values) {
+			best = req
+		}
+	}
+	if best == nil {
+		return "", nil, false
+	}
+	values := append([]string(nil), best.values...)
+	sort.Strings(values)
+	return best.key, values, true
+}
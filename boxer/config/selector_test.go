@@ -0,0 +1,87 @@
+package config_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
+)
+
+func TestSelectorMatches(t *testing.T) {
+	vmInfo := config.VMInfoConfig{
+		OS:     "windows",
+		Group:  "sandbox",
+		Labels: map[string]string{"version": "10", "arch": "x64", "office": "2019"},
+	}
+	labels := vmInfo.LabelSet()
+	for _, tc := range []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"os=windows", true},
+		{"os==windows, group=sandbox", true},
+		{"os=linux", false},
+		{"os!=linux", true},
+		{"version in (10, 11), arch=x64", true},
+		{"version notin (10, 11)", false},
+		{"office", true},
+		{"!office", false},
+		{"!gpu, os=windows", true},
+		{"gpu!=nvidia", true},
+		{"gpu notin (nvidia)", true},
+		{"gpu in (nvidia)", false},
+	} {
+		selector, err := config.ParseSelector(tc.selector)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q) failed: %v", tc.selector, err)
+		}
+		if got := selector.Matches(labels); got != tc.want {
+			t.Errorf("Selector %q matches = %v, want %v", tc.selector, got, tc.want)
+		}
+	}
+}
+
+func TestParseSelectorInvalid(t *testing.T) {
+	for _, expr := range []string{"os=windows,", "=windows", "os=", "os in ()", "os in (a,)", "!", "os=win dows"} {
+		if _, err := config.ParseSelector(expr); !berror.Is(err, berror.InvalidArgument) {
+			t.Errorf("Expected InvalidArgument error for selector %q, got %v", expr, err)
+		}
+	}
+}
+
+func TestSelectorRequired(t *testing.T) {
+	selector, err := config.ParseSelector("office, os in (windows, linux), version=10, arch!=x86")
+	if err != nil {
+		t.Fatalf("ParseSelector failed: %v", err)
+	}
+	key, values, ok := selector.Required()
+	if !ok || key != "version" || !reflect.DeepEqual(values, []string{"10"}) {
+		t.Errorf("Expected the version=10 requirement, got %s %v %v", key, values, ok)
+	}
+	selector, _ = config.ParseSelector("!office, arch!=x86")
+	if _, _, ok := selector.Required(); ok {
+		t.Error("Expected no required label for negations")
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	vmInfo := config.VMInfoConfig{
+		Name:     "vm",
+		Snapshot: "snapshot0",
+		IP:       "127.0.0.1",
+		OS:       "windows",
+		Group:    "sandbox",
+		Labels:   map[string]string{"office": "2019"},
+	}
+	if err := vmInfo.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	for _, labels := range []map[string]string{{"os": "linux"}, {"bad key": "1"}, {"office": ""}} {
+		vmInfo.Labels = labels
+		if err := vmInfo.Validate(); !berror.Is(err, berror.InvalidConfig) {
+			t.Errorf("Expected InvalidConfig error for labels %v, got %v", labels, err)
+		}
+	}
+}
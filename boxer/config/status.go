@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+
+	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/vmstate"
+)
+
+// VMStatusRuleConfig maps the result of the status command to a VM state.
+// A rule matches if the output of the status command matches the Regex
+// and the exit code of the status command is the ExitCode.
+// An empty Regex or a nil ExitCode matches anything, but a rule must set at least one of them.
+type VMStatusRuleConfig struct {
+	// State is the VM state of the rule: stopped, running, restoring or error
+	State string `mapstructure:"state" yaml:"state"`
+	// Regex is matched against the stdout of the status command
+	Regex string `mapstructure:"regex" yaml:"regex"`
+	// ExitCode is compared with the exit code of the status command
+	ExitCode *int `mapstructure:"exit_code" yaml:"exit_code"`
+}
+
+// Validate checks the state and the regex of the VMStatusRuleConfig.
+func (r *VMStatusRuleConfig) Validate() error {
+	if _, err := vmstate.Parse(r.State); err != nil {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMStatusRuleConfig Validate",
+			Origin: err,
+		}
+	}
+	if r.Regex == "" && r.ExitCode == nil {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMStatusRuleConfig Validate",
+			Origin: fmt.Errorf("status rule for state %s must have a regex or an exit code", r.State),
+		}
+	}
+	if _, err := compileRegex(r.Regex); err != nil {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMStatusRuleConfig Validate",
+			Origin: fmt.Errorf("invalid status regex %q: %w", r.Regex, err),
+		}
+	}
+	return nil
+}
+
+// Match reports whether the rule matches the given output and exit code of the status command.
+// The regex is compiled once and reused by every match.
+func (r *VMStatusRuleConfig) Match(output string, exitCode int) (bool, error) {
+	if r.ExitCode != nil && *r.ExitCode != exitCode {
+		return false, nil
+	}
+	if r.Regex == "" {
+		return true, nil
+	}
+	re, err := compileRegex(r.Regex)
+	if err != nil {
+		return false, berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMStatusRuleConfig Match",
+			Origin: fmt.Errorf("invalid status regex %q: %w", r.Regex, err),
+		}
+	}
+	return re.MatchString(output), nil
+}
+
+// MatchStatus returns the VM state of the first status rule matching the given output and exit code.
+// It returns false if no rule matches.
+func (c *VMControlConfig) MatchStatus(output string, exitCode int) (vmstate.VMState, bool, error) {
+	for i := range c.StatusRules {
+		rule := &c.StatusRules[i]
+		matched, err := rule.Match(output, exitCode)
+		if err != nil {
+			return vmstate.ERROR, false, err
+		}
+		if !matched {
+			continue
+		}
+		state, err := vmstate.Parse(rule.State)
+		if err != nil {
+			return vmstate.ERROR, false, berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error in VMControlConfig MatchStatus",
+				Origin: err,
+			}
+		}
+		return state, true, nil
+	}
+	return vmstate.ERROR, false, nil
+}
+
+// validateStatus checks the status command and its rules.
+// The rules are required if the status command is set.
+func (c *VMControlConfig) validateStatus() error {
+	for i := range c.StatusRules {
+		if err := c.StatusRules[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if c.StatusCmd != "" && len(c.StatusRules) == 0 {
+		return berror.BoxerError{
+			Code:   berror.InvalidConfig,
+			Msg:    "error in VMControlConfig Validate",
+			Origin: fmt.Errorf("status command %q has no status rules", c.StatusCmd),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package config_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/vmstate"
+)
+
+func TestMatchStatus(t *testing.T) {
+	exitCode := 1
+	control := config.VMControlConfig{
+		StatusRules: []config.VMStatusRuleConfig{
+			{State: "error", ExitCode: &exitCode},
+			{State: "running", Regex: `(?m)^VMState="running"`},
+			{State: "STOPPED", Regex: `(?m)^VMState="(poweroff|aborted)"`, ExitCode: new(int)},
+		},
+	}
+	tests := []struct {
+		output   string
+		exitCode int
+		want     vmstate.VMState
+		matched  bool
+	}{
+		{"name=\"vm1\"\nVMState=\"running\"\n", 0, vmstate.RUNNING, true},
+		{"VMState=\"aborted\"", 0, vmstate.STOPPED, true},
+		// the first matching rule wins
+		{"VMState=\"running\"", 1, vmstate.ERROR, true},
+		{"VMState=\"poweroff\"", 2, 0, false},
+		{"VMState=\"paused\"", 0, 0, false},
+	}
+	for _, test := range tests {
+		state, matched, err := control.MatchStatus(test.output, test.exitCode)
+		if err != nil {
+			t.Fatalf("MatchStatus failed: %v", err)
+		}
+		if matched != test.matched || (matched && state != test.want) {
+			t.Errorf("MatchStatus(%q, %d) = %s, %v, expected %s, %v", test.output, test.exitCode, state, matched, test.want, test.matched)
+		}
+	}
+}
+
+func TestStatusValidate(t *testing.T) {
+	base := config.VMControlConfig{
+		StartCmd:           "a $machine",
+		StopCmd:            "b $machine",
+		RestoreSnapshotCmd: "c $machine $snapshot",
+	}
+	for _, status := range []config.VMControlConfig{
+		// status command without rules
+		{StatusCmd: "d $machine"},
+		{StatusCmd: "d $machine", StatusRules: []config.VMStatusRuleConfig{{State: "paused", Regex: "paused"}}},
+		{StatusCmd: "d $machine", StatusRules: []config.VMStatusRuleConfig{{State: "running", Regex: "("}}},
+		{StatusCmd: "d $machine", StatusRules: []config.VMStatusRuleConfig{{State: "running"}}},
+		{StatusCmd: "d 'machine"},
+	} {
+		control := base
+		control.StatusCmd = status.StatusCmd
+		control.StatusRules = status.StatusRules
+		if err := control.Validate(); !berror.Is(err, berror.InvalidConfig) {
+			t.Errorf("Expected InvalidConfig error for %+v, got %v", status, err)
+		}
+	}
+}
+
+func TestStatusMatchInvalidRegex(t *testing.T) {
+	rule := config.VMStatusRuleConfig{State: "running", Regex: "("}
+	// the compile error is kept, so every match of an unvalidated rule reports it
+	for i := 0; i < 2; i++ {
+		if matched, err := rule.Match("running", 0); matched || !berror.Is(err, berror.InvalidConfig) {
+			t.Errorf("Expected InvalidConfig error for an invalid regex, got %v %v", matched, err)
+		}
+	}
+}
+
+func TestStatusPreset(t *testing.T) {
+	control := config.VMControlConfig{Backend: config.BACKEND_LIBVIRT}
+	expanded := control.Expand()
+	if expanded.StatusCmd != "virsh domstate $machine" {
+		t.Errorf("Unexpected status command %q", expanded.StatusCmd)
+	}
+	if state, matched, _ := expanded.MatchStatus("shut off\n", 0); !matched || state != vmstate.STOPPED {
+		t.Errorf("Expected the preset to map 'shut off' to STOPPED, got %s, %v", state, matched)
+	}
+	// a backend without a status preset does not keep the status of the overridden backend
+	vmrun := config.VMControlConfig{Backend: config.BACKEND_VMRUN}
+	if merged := control.Merge(&vmrun); merged.StatusCmd != "" || len(merged.StatusRules) != 0 {
+		t.Errorf("Expected no status command for vmrun, got %q", merged.StatusCmd)
+	}
+}
+
+func TestLoadStatus(t *testing.T) {
+	conf, err := config.LoadReader(strings.NewReader(`
+vm_info:
+  openssh:
+    name: openssh
+    snapshot: Snapshot 1
+    ip: 127.0.0.3
+    os: linux
+    group: testGroup2
+vm_control:
+  start_cmd: prlctl start $machine
+  stop_cmd: prlctl stop $machine --kill
+  restore_snapshot_cmd: prlctl snapshot-switch $machine --id $snapshot
+  status_cmd: prlctl status $machine
+  status_rules:
+    - state: running
+      regex: "exists, running$"
+    - state: stopped
+      regex: "exists, stopped$"
+    - state: error
+      exit_code: 255
+vm_control_policy:
+  reconcile_interval: 30
+`))
+	if err != nil {
+		t.Fatalf("LoadReader failed: %v", err)
+	}
+	if len(conf.VMControl.StatusRules) != 3 || *conf.VMControl.StatusRules[2].ExitCode != 255 {
+		t.Errorf("Unexpected status rules %+v", conf.VMControl.StatusRules)
+	}
+	if conf.VMControlPolicy.ReconcileIntervalSec != 30 {
+		t.Errorf("Expected reconcile interval 30, got %d", conf.VMControlPolicy.ReconcileIntervalSec)
+	}
+}
+
+func TestReconcileIntervalOverride(t *testing.T) {
+	conf := newOverrideTestConfig()
+	kvm := conf.VMInfo["kvm"]
+	kvm.VMControlPolicy.ReconcileIntervalSec = 10
+	conf.VMInfo["kvm"] = kvm
+	if err := conf.Validate(); !berror.Is(err, berror.InvalidConfig) {
+		t.Errorf("Expected InvalidConfig error for a reconcile interval override, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package error
 
 import (
+	"context"
 	"errors"
 	"fmt"
 )
@@ -16,12 +17,18 @@ const (
 	InvalidOperation
 	Timeout
 	Full
+	Canceled
+	ConnectionError
+	LeaseExpired
+	InvalidToken
 )
 
 type BoxerError struct {
 	Code   BoxerErrorCode
 	Origin error
 	Msg    string
+	// Result is the result of the VM control command that failed, if any.
+	Result *CommandResult
 }
 
 func (e BoxerError) Error() string {
@@ -36,3 +43,12 @@ func Is(err error, code BoxerErrorCode) bool {
 	}
 	return false
 }
+
+// ContextErrorCode returns the error code for the error of a done context.
+// It returns Timeout if the deadline is exceeded, and Canceled otherwise.
+func ContextErrorCode(err error) BoxerErrorCode {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Timeout
+	}
+	return Canceled
+}
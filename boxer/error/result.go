@@ -0,0 +1,60 @@
+package error
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CommandResult is the result of a VM control command.
+// The outputs are bounded, so only the tail of a long output is kept.
+type CommandResult struct {
+	Argv     []string      // Argv is the command line after the placeholders are replaced
+	ExitCode int           // ExitCode is the exit code of the command, -1 if it is killed
+	Duration time.Duration // Duration is the time from the start to the end of the command
+	Stdout   string        // Stdout is the captured standard output
+	Stderr   string        // Stderr is the captured standard error
+	// Truncated reports whether the head of Stdout or Stderr is dropped because the output is too long.
+	Truncated bool
+	// Attempts are the failed attempts of the command retried before this one, oldest first.
+	Attempts []*CommandResult
+}
+
+// String returns a one-line summary of the CommandResult.
+func (r *CommandResult) String() string {
+	if len(r.Attempts) > 0 {
+		return fmt.Sprintf("%v exited with %d in %s at attempt %d", r.Argv, r.ExitCode, r.Duration, r.AttemptCount())
+	}
+	return fmt.Sprintf("%v exited with %d in %s", r.Argv, r.ExitCode, r.Duration)
+}
+
+// AttemptCount returns the number of attempts of the command, including this one.
+func (r *CommandResult) AttemptCount() int {
+	return len(r.Attempts) + 1
+}
+
+// Message returns the trimmed stderr of the command, or its stdout if stderr is empty.
+// It is the message to report when the command fails.
+func (r *CommandResult) Message() string {
+	if msg := strings.TrimSpace(r.Stderr); msg != "" {
+		return msg
+	}
+	return strings.TrimSpace(r.Stdout)
+}
+
+// ResultOf returns the CommandResult attached to err or to one of the errors it wraps.
+// It returns nil if no CommandResult is attached.
+func ResultOf(err error) *CommandResult {
+	for err != nil {
+		var be BoxerError
+		if !errors.As(err, &be) {
+			return nil
+		}
+		if be.Result != nil {
+			return be.Result
+		}
+		err = be.Origin
+	}
+	return nil
+}
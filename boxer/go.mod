@@ -2,4 +2,7 @@ module github.com/hongsam14/boxer
 
 go 1.23.3
 
-require golang.org/x/sync v0.15.0
+require (
+	golang.org/x/sync v0.15.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,58 @@
+package exec
+
+import "sync"
+
+// DEFAULT_OUTPUT_LIMIT is the default number of bytes kept by a LimitedBuffer.
+const DEFAULT_OUTPUT_LIMIT = 64 * 1024
+
+// LimitedBuffer is an io.Writer that keeps the last limit bytes written to it.
+// The tail of the output is kept, because the reason of a failure is usually printed last.
+// It is safe for concurrent use, so it can be read while the subprocess still writes to it.
+type LimitedBuffer struct {
+	mux       sync.Mutex
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+// NewLimitedBuffer creates a LimitedBuffer keeping the last limit bytes.
+// A limit less than or equal to zero means DEFAULT_OUTPUT_LIMIT.
+func NewLimitedBuffer(limit int) *LimitedBuffer {
+	if limit <= 0 {
+		limit = DEFAULT_OUTPUT_LIMIT
+	}
+	return &LimitedBuffer{limit: limit}
+}
+
+// Write appends p to the buffer and drops the head of the buffer beyond the limit.
+// It never fails, so the subprocess is not blocked by a long output.
+func (b *LimitedBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	n := len(p)
+	if len(p) >= b.limit {
+		b.truncated = b.truncated || len(p) > b.limit || len(b.buf) > 0
+		b.buf = append(b.buf[:0], p[len(p)-b.limit:]...)
+		return n, nil
+	}
+	if drop := len(b.buf) + len(p) - b.limit; drop > 0 {
+		b.buf = append(b.buf[:0], b.buf[drop:]...)
+		b.truncated = true
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+// String returns the kept bytes as a string.
+func (b *LimitedBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return string(b.buf)
+}
+
+// Truncated reports whether any byte has been dropped.
+func (b *LimitedBuffer) Truncated() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.truncated
+}
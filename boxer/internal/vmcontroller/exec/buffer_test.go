@@ -0,0 +1,46 @@
+package exec_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
+)
+
+func TestLimitedBuffer(t *testing.T) {
+	buf := exec.NewLimitedBuffer(8)
+	buf.Write([]byte("hello"))
+	if buf.String() != "hello" || buf.Truncated() {
+		t.Fatalf("Unexpected buffer %q, truncated %v", buf.String(), buf.Truncated())
+	}
+	// the tail is kept
+	buf.Write([]byte(" world"))
+	if buf.String() != "lo world" || !buf.Truncated() {
+		t.Errorf("Expected the tail 'lo world', got %q, truncated %v", buf.String(), buf.Truncated())
+	}
+	n, err := buf.Write([]byte(strings.Repeat("x", 20) + "error!"))
+	if n != 26 || err != nil {
+		t.Errorf("Write must consume the whole input, got %d, %v", n, err)
+	}
+	if buf.String() != "xxerror!" {
+		t.Errorf("Expected the tail 'xxerror!', got %q", buf.String())
+	}
+}
+
+func TestRunContextCapturesStderr(t *testing.T) {
+	stdout := exec.NewLimitedBuffer(0)
+	stderr := exec.NewLimitedBuffer(0)
+	promise, err := exec.RunContext(context.Background(), os.Stdin, stdout, stderr, "sh", "-c", "echo out; echo err >&2; exit 3")
+	if err != nil {
+		t.Fatalf("RunContext failed: %v", err)
+	}
+	exitCode, err := promise.Wait()
+	if err != nil || exitCode != 3 {
+		t.Fatalf("Expected exit code 3, got %d, %v", exitCode, err)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("Unexpected output %q, %q", stdout.String(), stderr.String())
+	}
+}
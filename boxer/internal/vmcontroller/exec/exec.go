@@ -2,7 +2,9 @@ package exec
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"sync/atomic"
@@ -22,10 +24,12 @@ type Promise interface {
 	Pid() int
 	IsExecuted() bool
 	Wait() (int, error)
+	WaitContext(ctx context.Context) (int, error)
 	Cancel() error
 }
 
 type promise struct {
+	ctx     context.Context
 	cmd     exec.Cmd
 	eg      *errgroup.Group
 	waitCnt int32
@@ -40,18 +44,46 @@ func (p *promise) IsExecuted() bool {
 	return atomic.LoadInt32(&p.waitCnt) >= 0
 }
 
+// outputWaitDelay bounds how long Wait waits for the output of the subprocess after it exits.
+// A daemon spawned by the subprocess may keep the output pipe open forever.
+const outputWaitDelay = 5 * time.Second
+
 // # Run
 //
 // Run starts a new subprocess with the given commandline and returns a Promise.
-func Run(inStream *os.File, outStream *os.File, arg0 string, args ...string) (Promise, error) {
+// The stdout of the subprocess is written to outStream, which can be any io.Writer,
+// and the stderr of the subprocess is written to os.Stderr.
+func Run(inStream *os.File, outStream io.Writer, arg0 string, args ...string) (Promise, error) {
+	return RunContext(context.Background(), inStream, outStream, os.Stderr, arg0, args...)
+}
+
+// # RunContext
+//
+// RunContext works like Run, but the subprocess is bound to the context
+// and its stderr is written to errStream.
+// The subprocess is not started if the context is already done,
+// and Wait kills the process group of the subprocess when the context is done.
+func RunContext(ctx context.Context, inStream *os.File, outStream io.Writer, errStream io.Writer, arg0 string, args ...string) (Promise, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.ContextErrorCode(err),
+			Origin: err,
+			Msg:    fmt.Sprintf("error while execute %s %v promise.Start()", arg0, args),
+		}
+	}
 	prom := new(promise)
+	prom.ctx = ctx
 	// set conditional variable to -1
 	atomic.StoreInt32(&prom.waitCnt, -1)
 	// set the commandline
 	prom.cmd = *exec.Command(arg0, args...)
-	prom.cmd.Stdin = inStream
+	if inStream != nil {
+		// a nil inStream reads from the null device
+		prom.cmd.Stdin = inStream
+	}
 	prom.cmd.Stdout = outStream
-	prom.cmd.Stderr = os.Stderr
+	prom.cmd.Stderr = errStream
+	prom.cmd.WaitDelay = outputWaitDelay
 
 	// generate process group
 	prom.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
@@ -80,6 +112,17 @@ func Run(inStream *os.File, outStream *os.File, arg0 string, args ...string) (Pr
 // So the caller should check the ExitCode and Error to determine if the subprocess is successful or not.
 // Because ExitCode -1 means the subprocess is killed by signal, and it is not an error.
 func (p *promise) Wait() (exitCode int, err error) {
+	return p.WaitContext(p.ctx)
+}
+
+// # WaitContext
+//
+// WaitContext works like Wait, but it stops waiting when the context is done.
+// When the context is done, the whole process group of the subprocess is killed by SIGKILL
+// and reaped, so no process is left behind.
+// In this case ExitCode is returned as -1 and the error code is berror.Timeout
+// if the deadline is exceeded, or berror.Canceled if the context is canceled.
+func (p *promise) WaitContext(ctx context.Context) (exitCode int, err error) {
 	// if conditional variable is not set to 0, return error
 	val := atomic.LoadInt32(&p.waitCnt)
 	if val != 0 {
@@ -92,7 +135,15 @@ func (p *promise) Wait() (exitCode int, err error) {
 	}
 	// set the conditional variable to 1
 	atomic.StoreInt32(&p.waitCnt, 1)
-	state, err := p.cmd.Process.Wait()
+	state, err := p.waitProcess(ctx)
+	if ctx.Err() != nil && err == nil && !state.Exited() {
+		// the process is killed because the context is done
+		return -1, berror.BoxerError{
+			Code:   berror.ContextErrorCode(ctx.Err()),
+			Msg:    fmt.Sprintf("error while execute %s %v promise.Wait()", p.cmd.Path, p.cmd.Args),
+			Origin: fmt.Errorf("process group is killed: %w", ctx.Err()),
+		}
+	}
 	if err != nil {
 		// errorcode 130 means fatal error
 		return 130, berror.BoxerError{
@@ -116,6 +167,48 @@ func (p *promise) Wait() (exitCode int, err error) {
 	return exitCode, nil
 }
 
+// waitProcess waits for the process to exit.
+// If the context is done before the process exits, the process group is killed
+// and the state of the killed process is returned.
+func (p *promise) waitProcess(ctx context.Context) (*os.ProcessState, error) {
+	if ctx.Done() == nil {
+		return p.waitCmd()
+	}
+	type waitResult struct {
+		state *os.ProcessState
+		err   error
+	}
+	done := make(chan waitResult, 1)
+	go func() {
+		state, err := p.waitCmd()
+		done <- waitResult{state: state, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.state, res.err
+	case <-ctx.Done():
+		// kill the whole process group, because the command may spawn children.
+		// the pgid is the same as the pid because the process is started with Setpgid.
+		if err := syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL); err != nil {
+			// fall back to the process itself if the group is already gone
+			_ = p.cmd.Process.Kill()
+		}
+		res := <-done
+		return res.state, res.err
+	}
+}
+
+// waitCmd waits for the process to exit and for its output to be copied.
+// A non-zero exit code or a signal is reported by the returned state, not as an error.
+func (p *promise) waitCmd() (*os.ProcessState, error) {
+	err := p.cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) || errors.Is(err, exec.ErrWaitDelay) {
+		err = nil
+	}
+	return p.cmd.ProcessState, err
+}
+
 // # Cancel
 //
 // Cancel sends a signal to the subprocess to kill it.
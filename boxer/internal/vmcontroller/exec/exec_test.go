@@ -1,10 +1,12 @@
 package exec_test
 
 import (
+	"context"
 	"os"
 	"testing"
 	"time"
 
+	berror "github.com/hongsam14/boxer/error"
 	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
 )
 
@@ -103,3 +105,71 @@ func TestWaitFuncCallDuplicated(t *testing.T) {
 	}
 	t.Logf("Error: %v", err)
 }
+
+func TestWaitContextTimeout(t *testing.T) {
+	// the shell spawns a child, so the whole process group must be killed
+	promise, err := exec.Run(os.Stdin, os.Stdout, "sh", "-c", "sleep 10; echo done")
+	if err != nil {
+		t.Errorf("Error while executing promise %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	exitCode, err := promise.WaitContext(ctx)
+	elapsed := time.Since(start)
+	if !berror.Is(err, berror.Timeout) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+	if exitCode != -1 {
+		t.Errorf("Expected exit code -1, got %d", exitCode)
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("WaitContext should return right after the timeout, elapsed %v", elapsed)
+	}
+}
+
+func TestWaitContextFinishBeforeTimeout(t *testing.T) {
+	promise, err := exec.Run(os.Stdin, os.Stdout, "echo", "hello")
+	if err != nil {
+		t.Errorf("Error while executing promise %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exitCode, err := promise.WaitContext(ctx)
+	if err != nil {
+		t.Errorf("Error while executing promise %v", err)
+	}
+	if exitCode != 0 {
+		t.Errorf("Expected exit code 0, got %d", exitCode)
+	}
+}
+
+func TestRunContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	promise, err := exec.RunContext(ctx, os.Stdin, os.Stdout, os.Stderr, "sleep", "10")
+	if err != nil {
+		t.Errorf("Error while executing promise %v", err)
+		return
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = promise.Wait()
+	if !berror.Is(err, berror.Canceled) {
+		t.Errorf("Expected canceled error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Wait should return right after the cancel, elapsed %v", elapsed)
+	}
+	// the subprocess must not be started with a done context
+	_, err = exec.RunContext(ctx, os.Stdin, os.Stdout, os.Stderr, "echo", "hello")
+	if !berror.Is(err, berror.Canceled) {
+		t.Errorf("Expected canceled error, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package exectest
+
+import (
+	"sync"
+	"time"
+)
+
+// timer is a pending After of the Clock.
+type timer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// Clock is an exec.Clock whose time only moves by Advance,
+// so the rate limiting can be tested deterministically without real sleeps.
+// It is safe for concurrent use by multiple goroutines.
+type Clock struct {
+	mux    sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []timer
+}
+
+// NewClock creates a Clock starting at the given time.
+func NewClock(start time.Time) *Clock {
+	c := &Clock{now: start}
+	c.cond = sync.NewCond(&c.mux)
+	return c
+}
+
+// Now returns the time of the Clock.
+func (c *Clock) Now() time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.now
+}
+
+// After returns a channel receiving the time once the Clock is advanced by d.
+// The channel receives at once if d is not positive.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, timer{at: c.now.Add(d), ch: ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the time of the Clock forward by d and fires the timers that are due.
+func (c *Clock) Advance(d time.Duration) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// BlockUntil waits until n timers are pending, e.g. until n goroutines wait for a RateLimiter.
+func (c *Clock) BlockUntil(n int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
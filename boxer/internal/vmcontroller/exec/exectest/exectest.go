@@ -0,0 +1,125 @@
+// Package exectest provides a scripted exec.Executor, so the VM control can be tested
+// without the hypervisor binaries.
+package exectest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
+)
+
+// Response is the programmed result of a command.
+type Response struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	// Delay is how long the command runs. The command is killed if the context is done first.
+	Delay time.Duration
+	// Err fakes a command that cannot be started, e.g. a missing program.
+	// If it is set, the other fields are ignored.
+	Err error
+}
+
+// Invocation is a command executed by the Executor.
+type Invocation struct {
+	Argv  []string
+	Start time.Time
+}
+
+// Executor is an exec.Executor returning programmed Responses and recording the Invocations.
+// It is safe for concurrent use by multiple goroutines.
+type Executor struct {
+	mux         sync.Mutex
+	scripts     map[string][]Response
+	fallback    Response
+	invocations []Invocation
+}
+
+// NewExecutor creates an Executor whose commands succeed without output until they are scripted.
+func NewExecutor() *Executor {
+	return &Executor{
+		scripts: make(map[string][]Response),
+	}
+}
+
+// Script appends the responses for the commands of the given program, which is matched with argv[0].
+// The responses are returned in order, and the last one is repeated.
+func (e *Executor) Script(program string, responses ...Response) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.scripts[program] = append(e.scripts[program], responses...)
+}
+
+// SetDefault sets the response of the programs that are not scripted.
+func (e *Executor) SetDefault(response Response) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.fallback = response
+}
+
+// Invocations returns the executed commands in the order of their start.
+func (e *Executor) Invocations() []Invocation {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	return append([]Invocation(nil), e.invocations...)
+}
+
+// next records the invocation and returns its response.
+func (e *Executor) next(argv []string) Response {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	e.invocations = append(e.invocations, Invocation{
+		Argv:  append([]string(nil), argv...),
+		Start: time.Now(),
+	})
+	responses, exists := e.scripts[argv[0]]
+	if !exists || len(responses) == 0 {
+		return e.fallback
+	}
+	if len(responses) > 1 {
+		e.scripts[argv[0]] = responses[1:]
+	}
+	return responses[0]
+}
+
+// Execute records argv and plays the next response of its program.
+// It behaves like the process executor: a done context kills the command
+// and the error code is berror.Timeout or berror.Canceled.
+func (e *Executor) Execute(ctx context.Context, argv []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, fmt.Errorf("%w: %w", exec.ErrNotStarted, berror.BoxerError{
+			Code:   berror.ContextErrorCode(err),
+			Msg:    fmt.Sprintf("error while execute %v in exectest.Executor", argv),
+			Origin: err,
+		})
+	}
+	response := e.next(argv)
+	if response.Err != nil {
+		return -1, fmt.Errorf("%w: %w", exec.ErrNotStarted, response.Err)
+	}
+	if response.Delay > 0 {
+		timer := time.NewTimer(response.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return -1, berror.BoxerError{
+				Code:   berror.ContextErrorCode(ctx.Err()),
+				Msg:    fmt.Sprintf("error while execute %v in exectest.Executor", argv),
+				Origin: fmt.Errorf("command is killed: %w", ctx.Err()),
+			}
+		}
+	}
+	if _, err := io.WriteString(stdout, response.Stdout); err != nil {
+		return -1, err
+	}
+	if _, err := io.WriteString(stderr, response.Stderr); err != nil {
+		return -1, err
+	}
+	return response.ExitCode, nil
+}
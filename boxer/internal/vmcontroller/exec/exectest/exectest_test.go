@@ -0,0 +1,62 @@
+package exectest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec/exectest"
+)
+
+func TestExecutorScript(t *testing.T) {
+	executor := exectest.NewExecutor()
+	executor.Script("VBoxManage",
+		exectest.Response{ExitCode: 1, Stderr: "VBOX_E_INVALID_OBJECT_STATE"},
+		exectest.Response{Stdout: "ok"},
+	)
+	var stdout, stderr bytes.Buffer
+	for i, want := range []int{1, 0, 0} {
+		stdout.Reset()
+		stderr.Reset()
+		exitCode, err := executor.Execute(context.Background(), []string{"VBoxManage", "startvm", "vm1"}, &stdout, &stderr)
+		if err != nil || exitCode != want {
+			t.Fatalf("Execute #%d = %d, %v, expected %d", i, exitCode, err, want)
+		}
+	}
+	// the last response is repeated
+	if stdout.String() != "ok" || stderr.Len() != 0 {
+		t.Errorf("Unexpected output %q, %q", stdout.String(), stderr.String())
+	}
+	// unscripted programs use the default response
+	if exitCode, _ := executor.Execute(context.Background(), []string{"virsh"}, &stdout, &stderr); exitCode != 0 {
+		t.Errorf("Expected the default exit code 0, got %d", exitCode)
+	}
+	invocations := executor.Invocations()
+	if len(invocations) != 4 || invocations[0].Argv[2] != "vm1" || invocations[3].Argv[0] != "virsh" {
+		t.Errorf("Unexpected invocations %+v", invocations)
+	}
+}
+
+func TestExecutorDelay(t *testing.T) {
+	executor := exectest.NewExecutor()
+	executor.SetDefault(exectest.Response{Delay: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	exitCode, err := executor.Execute(ctx, []string{"sleep"}, &bytes.Buffer{}, &bytes.Buffer{})
+	if exitCode != -1 || !berror.Is(err, berror.Timeout) {
+		t.Errorf("Expected the command to be killed by the timeout, got %d, %v", exitCode, err)
+	}
+}
+
+func TestExecutorNotStarted(t *testing.T) {
+	executor := exectest.NewExecutor()
+	executor.SetDefault(exectest.Response{Err: errors.New("executable file not found")})
+	_, err := executor.Execute(context.Background(), []string{"VBoxManage"}, &bytes.Buffer{}, &bytes.Buffer{})
+	if !errors.Is(err, exec.ErrNotStarted) {
+		t.Errorf("Expected ErrNotStarted, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrNotStarted is wrapped by the error of Executor.Execute if the command is not started at all,
+// for example because the program does not exist or the context is already done.
+var ErrNotStarted = errors.New("command is not started")
+
+// # Executor
+//
+// Executor executes a VM control command and waits for it to finish.
+// The VMController runs every control command through an Executor,
+// so the commands can be routed elsewhere or faked in tests.
+type Executor interface {
+	// Execute runs argv, writes its stdout and stderr to the given writers and returns its exit code.
+	// When ctx is done, the command is killed and the error code is berror.Timeout or berror.Canceled.
+	// A non-zero exit code is not an error.
+	// If the command cannot be started, the error wraps ErrNotStarted.
+	Execute(ctx context.Context, argv []string, stdout io.Writer, stderr io.Writer) (int, error)
+}
+
+type processExecutor struct {
+	stdin *os.File
+}
+
+// NewProcessExecutor creates an Executor running the commands as local subprocesses.
+// The subprocesses read their stdin from the given file.
+func NewProcessExecutor(stdin *os.File) Executor {
+	return &processExecutor{stdin: stdin}
+}
+
+// Execute runs argv as a subprocess with RunContext and waits for it with Wait.
+func (pe *processExecutor) Execute(ctx context.Context, argv []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	promise, err := RunContext(ctx, pe.stdin, stdout, stderr, argv[0], argv[1:]...)
+	if err != nil {
+		return -1, fmt.Errorf("%w: %w", ErrNotStarted, err)
+	}
+	return promise.Wait()
+}
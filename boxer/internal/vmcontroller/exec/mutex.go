@@ -1,16 +1,18 @@
 package exec
 
 import (
+	"context"
 	"fmt"
-	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/hongsam14/boxer/error"
+	berror "github.com/hongsam14/boxer/error"
 )
 
 type PaddedMutex struct {
-	releaseMux sync.Mutex
+	// releaseMux is a semaphore with a capacity of 1.
+	// it is a channel instead of sync.Mutex so that waiting for the lock can be canceled.
+	releaseMux chan struct{}
 	IsLocked   int32
 	IsWaiting  int32
 	// timer
@@ -20,7 +22,7 @@ type PaddedMutex struct {
 func InitPaddedMutex(period uint) *PaddedMutex {
 	newPaddedMux := new(PaddedMutex)
 	newPaddedMux.period = period
-	newPaddedMux.releaseMux = sync.Mutex{}
+	newPaddedMux.releaseMux = make(chan struct{}, 1)
 	atomic.StoreInt32(&newPaddedMux.IsLocked, 0)
 	atomic.StoreInt32(&newPaddedMux.IsWaiting, 0)
 	return newPaddedMux
@@ -28,36 +30,59 @@ func InitPaddedMutex(period uint) *PaddedMutex {
 
 func (pMux *PaddedMutex) Lock() {
 	// lock the releaseMux
-	pMux.releaseMux.Lock()
+	pMux.releaseMux <- struct{}{}
 	atomic.StoreInt32(&pMux.IsLocked, 1)
 }
 
+// LockContext locks the mutex like Lock, but it gives up when the context is done.
+// It returns berror.Canceled or berror.Timeout if the lock is not acquired.
+func (pMux *PaddedMutex) LockContext(ctx context.Context) error {
+	select {
+	case pMux.releaseMux <- struct{}{}:
+		atomic.StoreInt32(&pMux.IsLocked, 1)
+		return nil
+	case <-ctx.Done():
+		return berror.BoxerError{
+			Code:   berror.ContextErrorCode(ctx.Err()),
+			Msg:    "error while pMux.LockContext()",
+			Origin: ctx.Err(),
+		}
+	}
+}
+
 func (pMux *PaddedMutex) Release() {
+	pMux.ReleaseWithPeriod(pMux.period)
+}
+
+// ReleaseWithPeriod releases the mutex like Release, but pads it with the given period in seconds
+// instead of the period given to InitPaddedMutex.
+func (pMux *PaddedMutex) ReleaseWithPeriod(period uint) {
 	if atomic.LoadInt32(&pMux.IsLocked) == 0 {
-		panic(error.BoxerError{
-			Code:   error.InvalidOperation,
+		panic(berror.BoxerError{
+			Code:   berror.InvalidOperation,
 			Msg:    "error while pMux.release()",
 			Origin: fmt.Errorf("pMux is released before locked"),
 		})
 	}
 	if atomic.LoadInt32(&pMux.IsWaiting) == 1 {
-		panic(error.BoxerError{
-			Code:   error.InvalidOperation,
+		panic(berror.BoxerError{
+			Code:   berror.InvalidOperation,
 			Msg:    "error while pMux.release()",
 			Origin: fmt.Errorf("pMux is released while waiting"),
 		})
 	}
 	atomic.StoreInt32(&pMux.IsWaiting, 1)
-	go pMux.timerThread()
+	go pMux.timerThread(period)
 }
 
-func (cuchion *PaddedMutex) timerThread() {
+func (cuchion *PaddedMutex) timerThread(period uint) {
 	// wait for the period
-	time.Sleep(time.Duration(cuchion.period) * time.Second)
+	time.Sleep(time.Duration(period) * time.Second)
 
-	if atomic.LoadInt32(&cuchion.IsLocked) == 1 {
-		cuchion.releaseMux.Unlock()
-	}
+	// reset the flags before unlocking, so that the next owner's flags are not overwritten
+	wasLocked := atomic.SwapInt32(&cuchion.IsLocked, 0) == 1
 	atomic.StoreInt32(&cuchion.IsWaiting, 0)
-	atomic.StoreInt32(&cuchion.IsLocked, 0)
+	if wasLocked {
+		<-cuchion.releaseMux
+	}
 }
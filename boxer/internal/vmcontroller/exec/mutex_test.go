@@ -1,10 +1,12 @@
 package exec_test
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
 
+	berror "github.com/hongsam14/boxer/error"
 	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
 
 	"math/rand"
@@ -33,6 +35,8 @@ func TestPaddedMutexingMultiple(t *testing.T) {
 	rootStartTime := time.Now()
 
 	wait := sync.WaitGroup{}
+	// startMux guards start, which is shared by the goroutines
+	startMux := sync.Mutex{}
 	pMux.Lock()
 	start := time.Now()
 	pMux.Release()
@@ -43,10 +47,14 @@ func TestPaddedMutexingMultiple(t *testing.T) {
 
 			startTime := time.Since(rootStartTime)
 			pMux.Lock()
+			startMux.Lock()
 			elapsed := time.Since(start)
+			startMux.Unlock()
 			pMux.Release()
 			//next timer start
+			startMux.Lock()
 			start = time.Now()
+			startMux.Unlock()
 			t.Logf("Start time: %v Elapsed time: %v\n", startTime, elapsed)
 			if elapsed < time.Duration(wait_sec)*time.Second {
 				t.Errorf("PaddedMutex is not waiting for the period")
@@ -89,3 +97,21 @@ func TestReleaseWhileWaiting(t *testing.T) {
 	}()
 	pMux.Release()
 }
+
+func TestLockContextTimeout(t *testing.T) {
+	pMux := exec.InitPaddedMutex(1)
+	pMux.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := pMux.LockContext(ctx)
+	if !berror.Is(err, berror.Timeout) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+	// the mutex is still usable after the timeout
+	pMux.Release()
+	if err := pMux.LockContext(context.Background()); err != nil {
+		t.Errorf("LockContext failed: %v", err)
+		return
+	}
+	pMux.Release()
+}
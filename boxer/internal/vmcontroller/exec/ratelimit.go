@@ -0,0 +1,151 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+// Clock tells the time to a RateLimiter.
+// It is an interface so that the rate limiting can be tested without real sleeps.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel receiving the current time after the duration.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the real Clock.
+var SystemClock Clock = systemClock{}
+
+// RateLimiter is a token bucket limiting how often a kind of command is run.
+// The bucket holds up to burst tokens and gains perMinute tokens per minute,
+// so up to burst commands run at once after a quiet period, and perMinute commands per minute in the long run.
+// Unlike PaddedMutex, it does not wait when the commands are sparse.
+//
+// A nil RateLimiter does not limit anything. A RateLimiter is safe for concurrent use by multiple goroutines.
+type RateLimiter struct {
+	mux   sync.Mutex
+	clock Clock
+	// rate is the number of tokens gained per second
+	rate  float64
+	burst float64
+	// tokens is the number of tokens at last. it is negative while the waiters have reserved future tokens.
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter gaining perMinute tokens per minute, with a bucket of burst tokens.
+// The bucket starts full. A burst of zero is treated as one.
+// It returns nil, which does not limit anything, if perMinute is not positive.
+// A nil clock is treated as SystemClock.
+func NewRateLimiter(perMinute float64, burst uint, clock Clock) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = 1
+	}
+	if clock == nil {
+		clock = SystemClock
+	}
+	return &RateLimiter{
+		clock:  clock,
+		rate:   perMinute / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock.Now(),
+	}
+}
+
+// refillLocked adds the tokens gained since the last refill. l.mux must be held by the caller.
+func (l *RateLimiter) refillLocked(now time.Time) {
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+}
+
+// Allow takes a token if one is available now. It never waits.
+func (l *RateLimiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.refillLocked(l.clock.Now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Wait takes a token, waiting until one is gained if the bucket is empty.
+// The tokens are handed out in the order of the calls.
+// It returns berror.Canceled or berror.Timeout if ctx is done first, or if the deadline of ctx
+// comes before the token, in which case it returns without waiting. The token is given back on error.
+// The deadline of ctx is on the real time, so it is compared with the wait as a duration, not with the clock.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return rateLimitError(err)
+	}
+	l.mux.Lock()
+	now := l.clock.Now()
+	l.refillLocked(now)
+	// reserve a token, the tokens gained until the wait is over belong to this call
+	l.tokens--
+	if l.tokens >= 0 {
+		l.mux.Unlock()
+		return nil
+	}
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		l.tokens++
+		l.mux.Unlock()
+		return berror.BoxerError{
+			Code:   berror.Timeout,
+			Msg:    "error while RateLimiter.Wait()",
+			Origin: fmt.Errorf("the next token is %v away, after the deadline", wait),
+		}
+	}
+	l.mux.Unlock()
+
+	select {
+	case <-l.clock.After(wait):
+		return nil
+	case <-ctx.Done():
+		l.mux.Lock()
+		l.refillLocked(l.clock.Now())
+		l.tokens++
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.mux.Unlock()
+		return rateLimitError(ctx.Err())
+	}
+}
+
+// rateLimitError wraps the error of a done context.
+func rateLimitError(err error) error {
+	return berror.BoxerError{
+		Code:   berror.ContextErrorCode(err),
+		Msg:    "error while RateLimiter.Wait()",
+		Origin: err,
+	}
+}
@@ -0,0 +1,151 @@
+package exec_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec/exectest"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	clock := exectest.NewClock(time.Now())
+	limiter := exec.NewRateLimiter(60, 3, clock)
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow() {
+			t.Fatalf("Expected token %d of the burst to be allowed", i)
+		}
+	}
+	if limiter.Allow() {
+		t.Fatal("Expected the empty bucket to deny a token")
+	}
+	// 60 per minute is a token per second
+	clock.Advance(time.Second)
+	if !limiter.Allow() {
+		t.Error("Expected a token after a second")
+	}
+	// the bucket does not hold more than the burst
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		limiter.Allow()
+	}
+	if limiter.Allow() {
+		t.Error("Expected the bucket to hold the burst at most")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	clock := exectest.NewClock(time.Now())
+	limiter := exec.NewRateLimiter(60, 1, clock)
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- limiter.Wait(context.Background())
+		}()
+	}
+	clock.BlockUntil(2)
+	clock.Advance(999 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("Expected Wait to wait for the token, got %v", err)
+	default:
+	}
+	// the waiters get a token a second apart
+	clock.Advance(time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Expected the second waiter to wait for the next token, got %v", err)
+	default:
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	clock := exectest.NewClock(time.Now())
+	limiter := exec.NewRateLimiter(60, 1, clock)
+	limiter.Allow()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- limiter.Wait(ctx)
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	if err := <-done; !berror.Is(err, berror.Canceled) {
+		t.Fatalf("Expected Canceled error, got %v", err)
+	}
+	// the reserved token is given back
+	clock.Advance(time.Second)
+	if !limiter.Allow() {
+		t.Error("Expected the token of the canceled waiter to be given back")
+	}
+	if limiter.Allow() {
+		t.Error("Expected a single token")
+	}
+}
+
+func TestRateLimiterWaitDeadline(t *testing.T) {
+	clock := exectest.NewClock(time.Now())
+	limiter := exec.NewRateLimiter(1, 1, clock)
+	limiter.Allow()
+	// the next token is a minute away
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(time.Second))
+	defer cancel()
+	if err := limiter.Wait(ctx); !berror.Is(err, berror.Timeout) {
+		t.Fatalf("Expected Timeout error, got %v", err)
+	}
+	clock.Advance(time.Minute)
+	if !limiter.Allow() {
+		t.Error("Expected the token to be given back")
+	}
+}
+
+func TestRateLimiterWaitDeadlineOtherClock(t *testing.T) {
+	// the clock is a day ahead of the real time, the deadline is still an hour away
+	clock := exectest.NewClock(time.Now().Add(24 * time.Hour))
+	limiter := exec.NewRateLimiter(60, 1, clock)
+	limiter.Allow()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- limiter.Wait(ctx)
+	}()
+	blocked := make(chan struct{})
+	go func() {
+		clock.BlockUntil(1)
+		close(blocked)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected Wait to wait for the token, got %v", err)
+	case <-blocked:
+	}
+	clock.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the token before the deadline, got %v", err)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := exec.NewRateLimiter(0, 1, nil)
+	if limiter != nil {
+		t.Fatalf("Expected a nil RateLimiter, got %v", limiter)
+	}
+	for i := 0; i < 100; i++ {
+		if err := limiter.Wait(context.Background()); err != nil || !limiter.Allow() {
+			t.Fatalf("Expected the nil RateLimiter not to limit, got %v", err)
+		}
+	}
+}
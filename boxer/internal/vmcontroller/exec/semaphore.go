@@ -0,0 +1,64 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+// PaddedSemaphore is a PaddedMutex with a capacity.
+// Up to size owners hold it at the same time, and each slot is padded by a period after it is released,
+// so a hypervisor host can run a limited number of commands in parallel with a pause between them.
+type PaddedSemaphore struct {
+	slots chan struct{}
+}
+
+// InitPaddedSemaphore creates a PaddedSemaphore with the given number of slots.
+// A size of zero is treated as one.
+func InitPaddedSemaphore(size uint) *PaddedSemaphore {
+	if size == 0 {
+		size = 1
+	}
+	return &PaddedSemaphore{slots: make(chan struct{}, size)}
+}
+
+// Size returns the number of slots of the semaphore.
+func (s *PaddedSemaphore) Size() int {
+	return cap(s.slots)
+}
+
+// AcquireContext takes a slot of the semaphore, waiting until one is released.
+// It returns berror.Canceled or berror.Timeout if ctx is done before a slot is taken.
+func (s *PaddedSemaphore) AcquireContext(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return berror.BoxerError{
+			Code:   berror.ContextErrorCode(ctx.Err()),
+			Msg:    "error while PaddedSemaphore.AcquireContext()",
+			Origin: ctx.Err(),
+		}
+	}
+}
+
+// ReleaseWithPeriod gives the slot back after the period in seconds.
+// It does not block, the slot is given back in the background.
+func (s *PaddedSemaphore) ReleaseWithPeriod(period uint) {
+	if len(s.slots) == 0 {
+		panic(berror.BoxerError{
+			Code:   berror.InvalidOperation,
+			Msg:    "error while PaddedSemaphore.ReleaseWithPeriod()",
+			Origin: fmt.Errorf("semaphore is released before acquired"),
+		})
+	}
+	if period == 0 {
+		<-s.slots
+		return
+	}
+	time.AfterFunc(time.Duration(period)*time.Second, func() {
+		<-s.slots
+	})
+}
@@ -0,0 +1,64 @@
+package exec_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
+)
+
+func TestPaddedSemaphoreLimit(t *testing.T) {
+	sem := exec.InitPaddedSemaphore(2)
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sem.AcquireContext(context.Background()); err != nil {
+				t.Errorf("AcquireContext failed: %v", err)
+				return
+			}
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			sem.ReleaseWithPeriod(0)
+		}()
+	}
+	wg.Wait()
+	if maxRunning != 2 {
+		t.Errorf("Expected 2 owners at most, got %d", maxRunning)
+	}
+}
+
+func TestPaddedSemaphorePeriod(t *testing.T) {
+	sem := exec.InitPaddedSemaphore(1)
+	if err := sem.AcquireContext(context.Background()); err != nil {
+		t.Fatalf("AcquireContext failed: %v", err)
+	}
+	start := time.Now()
+	sem.ReleaseWithPeriod(1)
+	// the slot is padded, so the next owner waits for the period
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := sem.AcquireContext(ctx); !berror.Is(err, berror.Timeout) {
+		t.Fatalf("Expected Timeout error while the slot is padded, got %v", err)
+	}
+	if err := sem.AcquireContext(context.Background()); err != nil {
+		t.Fatalf("AcquireContext failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected the slot to be padded for 1 second, took %s", elapsed)
+	}
+	sem.ReleaseWithPeriod(0)
+}
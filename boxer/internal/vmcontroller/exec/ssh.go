@@ -0,0 +1,113 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+// SSH_PROGRAM is the ssh client used by the SSH executor. It is looked up in the PATH.
+const SSH_PROGRAM = "ssh"
+
+// sshConnectionExitCode is the exit code of the ssh client when the connection fails.
+const sshConnectionExitCode = 255
+
+// SSHTarget is the remote host where the SSH executor runs the commands.
+type SSHTarget struct {
+	Host           string        // Host is the host name or the IP address of the remote host
+	Port           uint          // Port is the ssh port, zero means the default of the ssh client
+	User           string        // User is the login user, empty means the default of the ssh client
+	KeyPath        string        // KeyPath is the private key file, empty means the default of the ssh client
+	KnownHosts     string        // KnownHosts is the known_hosts file; if it is set, unknown host keys are rejected
+	ConnectTimeout time.Duration // ConnectTimeout bounds the connection, zero means the default of the ssh client
+}
+
+// Argv returns the ssh command line running the remote argv on the target.
+// The ssh client never prompts, so a missing key fails instead of hanging.
+func (t SSHTarget) Argv(remote []string) []string {
+	argv := []string{SSH_PROGRAM, "-n", "-o", "BatchMode=yes"}
+	if t.ConnectTimeout > 0 {
+		seconds := int((t.ConnectTimeout + time.Second - 1) / time.Second)
+		argv = append(argv, "-o", "ConnectTimeout="+strconv.Itoa(seconds))
+	}
+	if t.Port != 0 {
+		argv = append(argv, "-p", strconv.FormatUint(uint64(t.Port), 10))
+	}
+	if t.User != "" {
+		argv = append(argv, "-l", t.User)
+	}
+	if t.KeyPath != "" {
+		argv = append(argv, "-i", t.KeyPath, "-o", "IdentitiesOnly=yes")
+	}
+	if t.KnownHosts != "" {
+		argv = append(argv, "-o", "UserKnownHostsFile="+t.KnownHosts, "-o", "StrictHostKeyChecking=yes")
+	}
+	// the remote shell splits the command line again, so every argument is quoted
+	return append(argv, "--", t.Host, QuoteCommand(remote))
+}
+
+// QuoteCommand joins argv into a command line that a POSIX shell splits back into the same argv.
+func QuoteCommand(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = quoteArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// quoteArg quotes arg for a POSIX shell. An argument of safe characters is kept as it is.
+func quoteArg(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	safe := true
+	for _, c := range arg {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./:=@,+%", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+type sshExecutor struct {
+	target SSHTarget
+}
+
+// NewSSHExecutor creates an Executor running the commands on the target with the system ssh client.
+// The remote commands do not read stdin.
+// The ssh client is a local subprocess, so the timeout and the cancellation work like NewProcessExecutor.
+// A connection failure is reported as berror.ConnectionError.
+func NewSSHExecutor(target SSHTarget) Executor {
+	return &sshExecutor{target: target}
+}
+
+// Execute runs argv on the target.
+// The ssh client exits with 255 if the connection fails, so this exit code is reported as berror.ConnectionError.
+// A remote command exiting with 255 itself cannot be told apart from it.
+func (se *sshExecutor) Execute(ctx context.Context, argv []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	sshArgv := se.target.Argv(argv)
+	// keep the tail of stderr, it has the reason of a connection failure
+	sshStderr := NewLimitedBuffer(1024)
+	promise, err := RunContext(ctx, nil, stdout, io.MultiWriter(stderr, sshStderr), sshArgv[0], sshArgv[1:]...)
+	if err != nil {
+		return -1, fmt.Errorf("%w: %w", ErrNotStarted, err)
+	}
+	exitCode, err := promise.Wait()
+	if err == nil && exitCode == sshConnectionExitCode {
+		return exitCode, berror.BoxerError{
+			Code:   berror.ConnectionError,
+			Msg:    fmt.Sprintf("error while execute %v on %s", argv, se.target.Host),
+			Origin: fmt.Errorf("ssh connection failed: %s", strings.TrimSpace(sshStderr.String())),
+		}
+	}
+	return exitCode, err
+}
@@ -0,0 +1,127 @@
+package exec_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
+)
+
+// fakeSSH is a fake ssh client. It skips the options, records its arguments into $FAKE_SSH_LOG
+// and runs the remote command with the local shell, like sshd runs it with the login shell.
+const fakeSSH = `#!/bin/sh
+printf '%s\n' "$@" > "$FAKE_SSH_LOG"
+while [ "$1" != "--" ]; do shift; done
+host=$2
+if [ "$host" = unreachable ]; then
+	echo "ssh: connect to host $host port 22: Connection refused" >&2
+	exit 255
+fi
+exec sh -c "$3"
+`
+
+// installFakeSSH puts the fake ssh client first in the PATH and returns its log file.
+func installFakeSSH(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, exec.SSH_PROGRAM), []byte(fakeSSH), 0o755); err != nil {
+		t.Fatalf("failed to write the fake ssh client: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	log := filepath.Join(dir, "ssh.log")
+	t.Setenv("FAKE_SSH_LOG", log)
+	return log
+}
+
+func TestQuoteCommand(t *testing.T) {
+	argv := []string{"printf", "%s|", "Snapshot 1", "it's", `"quoted" $HOME`, "", "a;b"}
+	var stdout bytes.Buffer
+	promise, err := exec.Run(os.Stdin, &stdout, "sh", "-c", exec.QuoteCommand(argv))
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if _, err := promise.Wait(); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	want := strings.Join(argv[2:], "|") + "|"
+	if stdout.String() != want {
+		t.Errorf("Expected %q, got %q", want, stdout.String())
+	}
+}
+
+func TestSSHExecutor(t *testing.T) {
+	log := installFakeSSH(t)
+	executor := exec.NewSSHExecutor(exec.SSHTarget{
+		Host:           "hv1.example.com",
+		Port:           2222,
+		User:           "boxer",
+		KeyPath:        "/etc/boxer/id_ed25519",
+		KnownHosts:     "/etc/boxer/known_hosts",
+		ConnectTimeout: 5 * time.Second,
+	})
+	var stdout bytes.Buffer
+	exitCode, err := executor.Execute(context.Background(), []string{"echo", "Snapshot 1", "it's"}, &stdout, os.Stderr)
+	if err != nil || exitCode != 0 {
+		t.Fatalf("Execute failed: %d, %v", exitCode, err)
+	}
+	if stdout.String() != "Snapshot 1 it's\n" {
+		t.Errorf("Unexpected output %q", stdout.String())
+	}
+	logged, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatalf("failed to read the fake ssh log: %v", err)
+	}
+	want := []string{
+		"-n", "-o", "BatchMode=yes", "-o", "ConnectTimeout=5", "-p", "2222", "-l", "boxer",
+		"-i", "/etc/boxer/id_ed25519", "-o", "IdentitiesOnly=yes",
+		"-o", "UserKnownHostsFile=/etc/boxer/known_hosts", "-o", "StrictHostKeyChecking=yes",
+		"--", "hv1.example.com", `echo 'Snapshot 1' 'it'\''s'`,
+	}
+	if got := strings.Split(strings.TrimSuffix(string(logged), "\n"), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected ssh arguments\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestSSHExecutorExitCode(t *testing.T) {
+	installFakeSSH(t)
+	executor := exec.NewSSHExecutor(exec.SSHTarget{Host: "hv1"})
+	exitCode, err := executor.Execute(context.Background(), []string{"sh", "-c", "exit 3"}, &bytes.Buffer{}, &bytes.Buffer{})
+	if err != nil || exitCode != 3 {
+		t.Errorf("Expected the remote exit code 3, got %d, %v", exitCode, err)
+	}
+}
+
+func TestSSHExecutorConnectionError(t *testing.T) {
+	installFakeSSH(t)
+	executor := exec.NewSSHExecutor(exec.SSHTarget{Host: "unreachable"})
+	var stderr bytes.Buffer
+	_, err := executor.Execute(context.Background(), []string{"true"}, &bytes.Buffer{}, &stderr)
+	if !berror.Is(err, berror.ConnectionError) {
+		t.Fatalf("Expected ConnectionError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "Connection refused") || !strings.Contains(stderr.String(), "Connection refused") {
+		t.Errorf("Expected the ssh message in the error and in stderr, got %v", err)
+	}
+}
+
+func TestSSHExecutorTimeout(t *testing.T) {
+	installFakeSSH(t)
+	executor := exec.NewSSHExecutor(exec.SSHTarget{Host: "hv1"})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := executor.Execute(ctx, []string{"sleep", "10"}, &bytes.Buffer{}, &bytes.Buffer{})
+	if !berror.Is(err, berror.Timeout) {
+		t.Errorf("Expected Timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the ssh client to be killed, took %s", elapsed)
+	}
+}
@@ -0,0 +1,276 @@
+package vmcontroller
+
+import (
+	"context"
+	"fmt"
+
+	berror "github.com/hongsam14/boxer/error"
+)
+
+// GroupCount is a number of VMContexts of a group allocated together by AllocateVMContexts.
+type GroupCount struct {
+	Group string
+	Count uint
+}
+
+// gangWaiter is a caller waiting for a set of VMContexts allocated all at once.
+type gangWaiter struct {
+	seq    uint64
+	counts map[string]uint
+	total  uint
+	order  []GroupCount
+	ready  chan gangResult // ready receives the allocated VMContexts or the error, it is buffered so that the sender never blocks
+}
+
+// gangResult is the set of VMContexts handed to a gangWaiter, or the error the gangWaiter is given up with.
+type gangResult struct {
+	vmContexts []*VMContext
+	err        error
+}
+
+// AllocateVMContexts allocates the VMContexts of every GroupCount all at once, or none of them.
+// The VMContexts are returned in the order of the GroupCounts.
+// It returns nil without an error if the whole set is not available now, or if other callers are waiting for it.
+// It returns berror.InvalidArgument if the set can never be allocated, e.g. it is larger than a group
+// or the maximum number of VM operations, and berror.InvalidState if it cannot be allocated until
+// the VMContexts quarantined without a duration or in the ERROR state are released.
+func (vc *vmCompose) AllocateVMContexts(ctx context.Context, counts []GroupCount) ([]*VMContext, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.ContextErrorCode(err),
+			Msg:    "error in boxCompose AllocateVMContexts",
+			Origin: err,
+		}
+	}
+	gang, err := vc.newGangWaiter(counts)
+	if err != nil {
+		return nil, err
+	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	if err := vc.gangStalledLocked(gang); err != nil {
+		return nil, err
+	}
+	if len(vc.gangWaiters) > 0 || !vc.gangAvailableLocked(gang, false) {
+		return nil, nil
+	}
+	return vc.allocateGangLocked(gang)
+}
+
+// AllocateVMContextsWait allocates the VMContexts of every GroupCount all at once.
+// Unlike AllocateVMContexts, it waits in the FIFO queue of the sets until the whole set is available
+// or ctx is done. While the set waits, the younger waiters do not take the VMContexts of its groups
+// or the VM operation slots it needs, so it is not starved by single allocations.
+// A waiting set is given up with berror.InvalidState once the VMContexts quarantined without a duration
+// or in the ERROR state leave too few in one of its groups, so it does not block the younger waiters forever.
+func (vc *vmCompose) AllocateVMContextsWait(ctx context.Context, counts []GroupCount) ([]*VMContext, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.ContextErrorCode(err),
+			Msg:    "error in boxCompose AllocateVMContextsWait",
+			Origin: err,
+		}
+	}
+	gang, err := vc.newGangWaiter(counts)
+	if err != nil {
+		return nil, err
+	}
+	vc.mux.Lock()
+	if err := vc.gangStalledLocked(gang); err != nil {
+		vc.mux.Unlock()
+		return nil, err
+	}
+	if len(vc.gangWaiters) == 0 && vc.gangAvailableLocked(gang, false) {
+		vmContexts, err := vc.allocateGangLocked(gang)
+		vc.mux.Unlock()
+		return vmContexts, err
+	}
+	// the set is not available, wait in the queue of the sets
+	gang.seq = vc.waiterSeq
+	vc.waiterSeq++
+	vc.gangWaiters = append(vc.gangWaiters, gang)
+	vc.mux.Unlock()
+
+	select {
+	case result := <-gang.ready:
+		return result.vmContexts, result.err
+	case <-ctx.Done():
+	}
+	vc.mux.Lock()
+	removed := vc.removeGangWaiterLocked(gang)
+	if removed {
+		// the younger waiters blocked by the set may be served now
+		vc.dispatchLocked()
+	}
+	vc.mux.Unlock()
+	if !removed {
+		// the set is handed to the waiter right before ctx is done.
+		// give it back so that the next waiters can take it.
+		for _, vmContext := range (<-gang.ready).vmContexts {
+			if err := vc.FreeVMContext(vmContext); err != nil {
+				return nil, berror.BoxerError{
+					Code:   berror.InternalError,
+					Msg:    "error in boxCompose AllocateVMContextsWait",
+					Origin: fmt.Errorf("failed to give back VMContext after %v: %w", ctx.Err(), err),
+				}
+			}
+		}
+	}
+	return nil, berror.BoxerError{
+		Code:   berror.ContextErrorCode(ctx.Err()),
+		Msg:    "error in boxCompose AllocateVMContextsWait",
+		Origin: ctx.Err(),
+	}
+}
+
+// newGangWaiter checks the GroupCounts and returns a gangWaiter for them.
+// The counts of the same group are summed up.
+func (vc *vmCompose) newGangWaiter(counts []GroupCount) (*gangWaiter, error) {
+	gang := &gangWaiter{
+		counts: make(map[string]uint),
+		order:  counts,
+		ready:  make(chan gangResult, 1),
+	}
+	for _, count := range counts {
+		if _, exists := vc.groupMap[count.Group]; !exists || count.Count == 0 {
+			return nil, berror.BoxerError{
+				Code:   berror.InvalidArgument,
+				Msg:    "error in boxCompose AllocateVMContexts",
+				Origin: fmt.Errorf("group %s does not exist or its count is zero", count.Group),
+			}
+		}
+		gang.counts[count.Group] += count.Count
+		gang.total += count.Count
+	}
+	if gang.total == 0 {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxCompose AllocateVMContexts",
+			Origin: fmt.Errorf("no VMContext is requested"),
+		}
+	}
+	for groupName, count := range gang.counts {
+		if count > uint(vc.groupMap[groupName].size) {
+			return nil, berror.BoxerError{
+				Code:   berror.InvalidArgument,
+				Msg:    "error in boxCompose AllocateVMContexts",
+				Origin: fmt.Errorf("%d VMContexts are requested from group %s of %d", count, groupName, vc.groupMap[groupName].size),
+			}
+		}
+	}
+	if gang.total > uint(vc.maxVMOperations) {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxCompose AllocateVMContexts",
+			Origin: fmt.Errorf("%d VMContexts are requested, but the maximum number of VM operations is %d", gang.total, vc.maxVMOperations),
+		}
+	}
+	return gang, nil
+}
+
+// gangAvailableLocked reports whether the whole set of the gangWaiter can be allocated now.
+// If queued is false, the groups with waiting callers are not available, so the waiters are not overtaken.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) gangAvailableLocked(gang *gangWaiter, queued bool) bool {
+	if uint(vc.maxVMOperations-vc.currentVMOperations) < gang.total {
+		return false
+	}
+	for groupName, count := range gang.counts {
+		group := vc.groupMap[groupName]
+		if uint(len(group.vmInfoPool)) < count {
+			return false
+		}
+		if !queued && len(group.waiters) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// gangStalledLocked returns berror.InvalidState if a group of the gangWaiter has too few VMContexts
+// which are not quarantined without a duration or in the ERROR state, so the set cannot be allocated
+// until they are released manually or their state is corrected.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) gangStalledLocked(gang *gangWaiter) error {
+	for groupName, count := range gang.counts {
+		group := vc.groupMap[groupName]
+		if usable := group.size - group.stuckQuarantined(); uint(usable) < count {
+			return berror.BoxerError{
+				Code:   berror.InvalidState,
+				Msg:    "error in boxCompose AllocateVMContexts",
+				Origin: fmt.Errorf("%d VMContexts are requested from group %s, but only %d are not quarantined until released or corrected", count, groupName, usable),
+			}
+		}
+	}
+	return nil
+}
+
+// allocateGangLocked allocates the whole set of the gangWaiter, which must be available.
+// The VMContexts are returned in the order of the GroupCounts.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) allocateGangLocked(gang *gangWaiter) ([]*VMContext, error) {
+	vmContexts := make([]*VMContext, 0, gang.total)
+	for _, count := range gang.order {
+		group := vc.groupMap[count.Group]
+		for i := uint(0); i < count.Count; i++ {
+			vmContext, err := vc.allocateLocked(group)
+			if err == nil && vmContext == nil {
+				err = fmt.Errorf("group %s has no free VMContext", group.GroupName())
+			}
+			if err != nil {
+				// give back the VMContexts allocated so far, so the set is allocated all or nothing
+				for _, allocated := range vmContexts {
+					vc.unallocateLocked(allocated)
+				}
+				return nil, berror.BoxerError{
+					Code:   berror.InternalError,
+					Msg:    "error in boxCompose AllocateVMContexts",
+					Origin: fmt.Errorf("failed to allocate the set of VMContexts: %w", err),
+				}
+			}
+			vmContexts = append(vmContexts, vmContext)
+		}
+	}
+	return vmContexts, nil
+}
+
+// gangBlocksLocked reports whether a waiter with the given sequence number must not take a VMContext of the group,
+// because an older set waiting for its whole set needs the group, or the VM operation slot it would take.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) gangBlocksLocked(group *vmContextGroup, seq uint64) bool {
+	if len(vc.gangWaiters) == 0 {
+		return false
+	}
+	gang := vc.gangWaiters[0]
+	if gang.seq > seq {
+		return false
+	}
+	// taking a VMContext of the group would leave too few for the set
+	if count, needed := gang.counts[group.GroupName()]; needed && uint(len(group.vmInfoPool)) <= count {
+		return true
+	}
+	return uint(vc.maxVMOperations-vc.currentVMOperations) <= gang.total
+}
+
+// unallocateLocked gives back the VMContext allocated by allocateLocked, without serving the waiters.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) unallocateLocked(vmContext *VMContext) {
+	if err := vc.groupMap[vmContext.Group()].FreeVMContext(vmContext); err != nil {
+		return
+	}
+	vc.currentVMOperations--
+	vc.hostLoad[vmContext.Host()]--
+}
+
+// removeGangWaiterLocked removes the gangWaiter from the queue of the sets.
+// It returns false if the gangWaiter is not in the queue, which means it has already been served.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) removeGangWaiterLocked(gang *gangWaiter) bool {
+	for idx, queued := range vc.gangWaiters {
+		if queued == gang {
+			vc.gangWaiters = append(vc.gangWaiters[:idx], vc.gangWaiters[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package vmcontroller_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/internal/vmcontroller"
+)
+
+func newGangTestCompose(t *testing.T, maxVMOperations uint) vmcontroller.VMCompose {
+	t.Helper()
+	vmInfoMap := map[string]config.VMInfoConfig{
+		"win1": {Name: "win1", Snapshot: "snapshot0", IP: "127.0.0.1", OS: "windows", Group: "victim"},
+		"win2": {Name: "win2", Snapshot: "snapshot0", IP: "127.0.0.2", OS: "windows", Group: "victim"},
+		"kali": {Name: "kali", Snapshot: "snapshot0", IP: "127.0.0.3", OS: "linux", Group: "attacker"},
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec:     10,
+		TimeoutSec:      30,
+		MaxVMOperations: maxVMOperations,
+	}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	return vmCompose
+}
+
+func TestVMComposeAllocateVMContexts(t *testing.T) {
+	vmCompose := newGangTestCompose(t, 2)
+	ctx := context.Background()
+	gang := []vmcontroller.GroupCount{{Group: "victim", Count: 1}, {Group: "attacker", Count: 1}}
+
+	for _, invalid := range [][]vmcontroller.GroupCount{
+		nil,
+		{{Group: "unknown", Count: 1}},
+		{{Group: "victim", Count: 0}},
+		{{Group: "victim", Count: 3}},
+		// larger than the maximum number of VM operations
+		{{Group: "victim", Count: 2}, {Group: "attacker", Count: 1}},
+	} {
+		if out, err := vmCompose.AllocateVMContexts(ctx, invalid); out != nil || !berror.Is(err, berror.InvalidArgument) {
+			t.Errorf("Expected InvalidArgument for %v, got %v %v", invalid, out, err)
+		}
+	}
+
+	kali, err := vmCompose.AllocateVMContext(ctx, "attacker")
+	if err != nil || kali == nil {
+		t.Fatalf("Failed to allocate kali: %v %v", kali, err)
+	}
+	// the attacker is short, so no victim is allocated either
+	if out, err := vmCompose.AllocateVMContexts(ctx, gang); out != nil || err != nil {
+		t.Fatalf("Expected no VM to be allocated, got %v %v", out, err)
+	}
+	win, err := vmCompose.AllocateVMContext(ctx, "victim")
+	if err != nil || win == nil {
+		t.Fatalf("Expected a victim to be left free, got %v %v", win, err)
+	}
+	for _, vm := range []*vmcontroller.VMContext{kali, win} {
+		if err := vmCompose.FreeVMContext(vm); err != nil {
+			t.Fatalf("Failed to free %s: %v", vm.Machine(), err)
+		}
+	}
+
+	out, err := vmCompose.AllocateVMContexts(ctx, gang)
+	if err != nil || len(out) != 2 {
+		t.Fatalf("Failed to allocate the gang: %v %v", out, err)
+	}
+	if out[0].Group() != "victim" || out[1].Group() != "attacker" {
+		t.Fatalf("Expected the VMs in the order of the counts, got %s %s", out[0].Group(), out[1].Group())
+	}
+	// the whole gang counts against the maximum number of VM operations
+	if vm, err := vmCompose.AllocateVMContext(ctx, "victim"); vm != nil || err != nil {
+		t.Fatalf("Expected the maximum number of VM operations to be reached, got %v %v", vm, err)
+	}
+}
+
+func TestVMComposeAllocateVMContextsWait(t *testing.T) {
+	vmCompose := newGangTestCompose(t, 3)
+	ctx := context.Background()
+	gang := []vmcontroller.GroupCount{{Group: "victim", Count: 2}, {Group: "attacker", Count: 1}}
+
+	kali, err := vmCompose.AllocateVMContext(ctx, "attacker")
+	if err != nil || kali == nil {
+		t.Fatalf("Failed to allocate kali: %v %v", kali, err)
+	}
+	win, err := vmCompose.AllocateVMContext(ctx, "victim")
+	if err != nil || win == nil {
+		t.Fatalf("Failed to allocate a victim: %v %v", win, err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if out, err := vmCompose.AllocateVMContextsWait(timeoutCtx, gang); out != nil || !berror.Is(err, berror.Timeout) {
+		t.Fatalf("Expected timeout error, got %v %v", out, err)
+	}
+
+	gangServed := make(chan []*vmcontroller.VMContext, 1)
+	go func() {
+		out, err := vmCompose.AllocateVMContextsWait(ctx, gang)
+		if err != nil {
+			t.Errorf("Gang waiter failed: %v", err)
+		}
+		gangServed <- out
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// a younger waiter does not take the victim the gang is waiting for
+	singleServed := make(chan *vmcontroller.VMContext, 1)
+	go func() {
+		vm, err := vmCompose.AllocateVMContextWait(ctx, "victim")
+		if err != nil {
+			t.Errorf("Single waiter failed: %v", err)
+		}
+		singleServed <- vm
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := vmCompose.FreeVMContext(win); err != nil {
+		t.Fatalf("Failed to free the victim: %v", err)
+	}
+	if vm, err := vmCompose.AllocateVMContext(ctx, "victim"); vm != nil || err != nil {
+		t.Fatalf("Expected the victims to be kept for the gang, got %v %v", vm, err)
+	}
+	select {
+	case vm := <-singleServed:
+		t.Fatalf("Single waiter took %v before the gang", vm)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := vmCompose.FreeVMContext(kali); err != nil {
+		t.Fatalf("Failed to free kali: %v", err)
+	}
+	var out []*vmcontroller.VMContext
+	select {
+	case out = <-gangServed:
+		if len(out) != 3 {
+			t.Fatalf("Expected the gang of 3 VMs, got %v", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Gang waiter is not served")
+	}
+	if err := vmCompose.FreeVMContext(out[0]); err != nil {
+		t.Fatalf("Failed to free %s: %v", out[0].Machine(), err)
+	}
+	select {
+	case vm := <-singleServed:
+		if vm == nil || vm.Machine() != out[0].Machine() {
+			t.Fatalf("Expected %s to be served, got %v", out[0].Machine(), vm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Single waiter is not served after the gang")
+	}
+}
+
+func TestVMComposeAllocateVMContextsQuarantined(t *testing.T) {
+	vmCompose := newGangTestCompose(t, 3)
+	ctx := context.Background()
+	victims := []vmcontroller.GroupCount{{Group: "victim", Count: 2}}
+
+	win, err := vmCompose.AllocateVMContext(ctx, "victim")
+	if err != nil || win == nil {
+		t.Fatalf("Failed to allocate a victim: %v %v", win, err)
+	}
+	gangFailed := make(chan error, 1)
+	go func() {
+		out, err := vmCompose.AllocateVMContextsWait(ctx, victims)
+		if out != nil {
+			t.Errorf("Expected no VM for the stalled set, got %v", out)
+		}
+		gangFailed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// the victim quarantined until it is released leaves too few for the set
+	if err := vmCompose.Quarantine(win); err != nil {
+		t.Fatalf("Quarantine failed: %v", err)
+	}
+	select {
+	case err := <-gangFailed:
+		if !berror.Is(err, berror.InvalidState) {
+			t.Fatalf("Expected InvalidState error for the stalled set, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stalled set is not given up")
+	}
+	if out, err := vmCompose.AllocateVMContextsWait(ctx, victims); out != nil || !berror.Is(err, berror.InvalidState) {
+		t.Fatalf("Expected InvalidState error at once, got %v %v", out, err)
+	}
+	// the other victim is not kept for the stalled set
+	if vm, err := vmCompose.AllocateVMContext(ctx, "victim"); err != nil || vm == nil {
+		t.Fatalf("Expected the other victim to be allocated, got %v %v", vm, err)
+	}
+}
+
+func TestVMComposeAllocateVMContextsQuarantinedError(t *testing.T) {
+	vmController := newStatusTestController()
+	crashed := newStatusTestVMInfo("crashed")
+	healthy := newStatusTestVMInfo("running")
+	healthy.Name = "vm2"
+	vmPolicy := config.VMControlPolicyConfig{MaxVMOperations: 2, QuarantineThreshold: 1, QuarantineSec: 60}
+	vmCompose, err := vmcontroller.NewVMCompose(map[string]config.VMInfoConfig{"vm1": crashed, "vm2": healthy}, &vmPolicy)
+	if err != nil {
+		t.Fatalf("NewVMCompose failed: %v", err)
+	}
+	ctx := context.Background()
+	pair := []vmcontroller.GroupCount{{Group: "testGroup", Count: 2}}
+
+	vm, err := vmCompose.AllocateVMContext(ctx, "testGroup")
+	if err != nil || vm == nil || vm.Machine() != "vm1" {
+		t.Fatalf("Failed to allocate vm1: %v %v", vm, err)
+	}
+	gangFailed := make(chan error, 1)
+	go func() {
+		_, err := vmCompose.AllocateVMContextsWait(ctx, pair)
+		gangFailed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// the VM in error is quarantined for a duration, but it is not released while it stays in error
+	if _, err := vmController.Refresh(ctx, vm); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	vmCompose.ReportResult(vm, true)
+	if err := vmCompose.FreeVMContext(vm); err != nil {
+		t.Fatalf("Failed to free VM: %v", err)
+	}
+	select {
+	case err := <-gangFailed:
+		if !berror.Is(err, berror.InvalidState) {
+			t.Fatalf("Expected InvalidState error for the stalled set, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Set stalled by the VM in error is not given up")
+	}
+	if out, err := vmCompose.AllocateVMContextsWait(ctx, pair); out != nil || !berror.Is(err, berror.InvalidState) {
+		t.Fatalf("Expected InvalidState error at once, got %v %v", out, err)
+	}
+	// the healthy VM is not kept for the stalled set
+	if other, err := vmCompose.AllocateVMContext(ctx, "testGroup"); err != nil || other == nil || other.Machine() != "vm2" {
+		t.Fatalf("Expected vm2 to be allocated, got %v %v", other, err)
+	}
+}
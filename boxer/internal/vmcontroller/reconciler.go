@@ -0,0 +1,63 @@
+package vmcontroller
+
+import (
+	"context"
+	"time"
+
+	berror "github.com/hongsam14/boxer/error"
+
+	"github.com/hongsam14/boxer/vmstate"
+)
+
+// StateChange is the result of VMController.Refresh.
+// Old is the state boxer believed, and New is the state probed by the status command.
+type StateChange struct {
+	VM     *VMContext
+	Old    vmstate.VMState
+	New    vmstate.VMState
+	Result *berror.CommandResult // Result is the result of the status command
+}
+
+// Changed reports whether the state of the VM was corrected.
+func (sc StateChange) Changed() bool {
+	return sc.VM != nil && sc.Old != sc.New
+}
+
+// Reconcile refreshes the state of every VMContext of the VMCompose every interval until ctx is done.
+// It corrects the drift between the state boxer believes and the actual state of the VMs,
+// for example when a VM is powered off outside of boxer.
+// notify is called for every corrected state, it can be nil.
+// A VM found in the error state is reported as a failure to the VMCompose, so a VM that keeps failing
+// outside of boxer is quarantined like one whose operations fail.
+// The VMs without a status command are skipped, and a VM whose probe fails is kept as it is until the next round.
+func Reconcile(ctx context.Context, vc VMController, vcomp VMCompose, interval time.Duration, notify func(StateChange)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, vctx := range vcomp.VMContexts() {
+			change, err := vc.Refresh(ctx, vctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				// the VM has no status command or the probe failed,
+				// the other VMs are probed anyway
+				continue
+			}
+			if !change.Changed() {
+				continue
+			}
+			if change.New == vmstate.ERROR {
+				vcomp.ReportResult(change.VM, true)
+			}
+			if notify != nil {
+				notify(change)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package vmcontroller_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hongsam14/boxer/config"
+	"github.com/hongsam14/boxer/internal/vmcontroller"
+	"github.com/hongsam14/boxer/vmstate"
+)
+
+func TestReconcile(t *testing.T) {
+	vmController := newStatusTestController()
+	vmPolicy := config.VMControlPolicyConfig{MaxVMOperations: 2}
+	running := newStatusTestVMInfo("running")
+	stopped := newStatusTestVMInfo("poweroff")
+	stopped.Name = "vm2"
+	vmCompose, err := vmcontroller.NewVMCompose(map[string]config.VMInfoConfig{
+		"vm1": running,
+		"vm2": stopped,
+	}, &vmPolicy)
+	if err != nil {
+		t.Fatalf("NewVMCompose failed: %v", err)
+	}
+
+	changes := make(chan vmcontroller.StateChange, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vmcontroller.Reconcile(ctx, vmController, vmCompose, 10*time.Millisecond, func(change vmcontroller.StateChange) {
+			changes <- change
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// only vm1 drifts, it is running although boxer believes it is stopped
+	select {
+	case change := <-changes:
+		if change.VM.Machine() != "vm1" || change.Old != vmstate.STOPPED || change.New != vmstate.RUNNING {
+			t.Errorf("Unexpected change of %s from %s to %s", change.VM.Machine(), change.Old, change.New)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reconcile did not notify the change")
+	}
+	select {
+	case change := <-changes:
+		t.Errorf("Unexpected second change of %s from %s to %s", change.VM.Machine(), change.Old, change.New)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReconcileQuarantinesError(t *testing.T) {
+	vmController := newStatusTestController()
+	vmPolicy := config.VMControlPolicyConfig{MaxVMOperations: 1, QuarantineThreshold: 1}
+	vmCompose, err := vmcontroller.NewVMCompose(map[string]config.VMInfoConfig{
+		"vm1": newStatusTestVMInfo("crashed"),
+	}, &vmPolicy)
+	if err != nil {
+		t.Fatalf("NewVMCompose failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vmcontroller.Reconcile(ctx, vmController, vmCompose, 10*time.Millisecond, nil)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// the crashed VM is reported as a failure, so the free VM is quarantined at once
+	deadline := time.Now().Add(5 * time.Second)
+	for len(vmCompose.Quarantined()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the crashed VM to be quarantined")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
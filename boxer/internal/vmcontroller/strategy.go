@@ -0,0 +1,151 @@
+package vmcontroller
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
+)
+
+// AllocationCandidates are the free VMContexts of a group an AllocationStrategy picks from.
+type AllocationCandidates struct {
+	// Pool is the free VMContexts of the group, or the ones matching the selector of the allocation,
+	// the one freed longest ago first. It is never empty.
+	Pool []*VMContext
+	// LastUsed is the allocation sequence number of each VMContext of the Pool, zero if it is never allocated.
+	// A greater number is a more recent allocation in the group.
+	LastUsed []uint64
+	// HostLoad is the number of the allocated VMContexts on each host, keyed by the host name.
+	HostLoad map[string]int
+}
+
+// AllocationStrategy picks the VMContext allocated from the free VMContexts of a group.
+// A strategy is used by a single group, and it is called with the lock of the VMCompose held,
+// so it can keep its own state without a lock.
+type AllocationStrategy interface {
+	// Pick returns the index of the VMContext to allocate in the Pool of the candidates.
+	Pick(candidates AllocationCandidates) int
+}
+
+// NewAllocationStrategy returns the AllocationStrategy of the given name of the group config.
+// An empty name is the default spread strategy.
+func NewAllocationStrategy(name string) (AllocationStrategy, error) {
+	switch name {
+	case "", config.ALLOCATION_SPREAD:
+		return SpreadStrategy{}, nil
+	case config.ALLOCATION_FIFO:
+		return FIFOStrategy{}, nil
+	case config.ALLOCATION_LRU:
+		return LRUStrategy{}, nil
+	case config.ALLOCATION_MRU:
+		return MRUStrategy{}, nil
+	case config.ALLOCATION_ROUND_ROBIN:
+		return new(RoundRobinStrategy), nil
+	case config.ALLOCATION_RANDOM:
+		return NewRandomStrategy(rand.NewSource(time.Now().UnixNano())), nil
+	}
+	return nil, berror.BoxerError{
+		Code:   berror.InvalidArgument,
+		Msg:    "error in vmcontroller.NewAllocationStrategy",
+		Origin: fmt.Errorf("unknown allocation strategy %q", name),
+	}
+}
+
+// SpreadStrategy picks the free VMContext on the host with the fewest allocated VMContexts.
+// The one freed longest ago wins a tie. It is the default strategy.
+type SpreadStrategy struct{}
+
+// Pick returns the index of the free VMContext on the least loaded host.
+func (SpreadStrategy) Pick(candidates AllocationCandidates) int {
+	least := 0
+	for i, vmContext := range candidates.Pool {
+		if candidates.HostLoad[vmContext.Host()] < candidates.HostLoad[candidates.Pool[least].Host()] {
+			least = i
+		}
+	}
+	return least
+}
+
+// FIFOStrategy picks the VMContext freed longest ago, whatever its host is.
+type FIFOStrategy struct{}
+
+// Pick returns the index of the VMContext freed longest ago.
+func (FIFOStrategy) Pick(candidates AllocationCandidates) int {
+	return 0
+}
+
+// LRUStrategy picks the VMContext allocated least recently, a VMContext never allocated first.
+type LRUStrategy struct{}
+
+// Pick returns the index of the VMContext allocated least recently.
+func (LRUStrategy) Pick(candidates AllocationCandidates) int {
+	least := 0
+	for i, lastUsed := range candidates.LastUsed {
+		if lastUsed < candidates.LastUsed[least] {
+			least = i
+		}
+	}
+	return least
+}
+
+// MRUStrategy picks the VMContext allocated most recently, so the VMs in use are kept warm
+// and the others are left idle.
+type MRUStrategy struct{}
+
+// Pick returns the index of the VMContext allocated most recently.
+func (MRUStrategy) Pick(candidates AllocationCandidates) int {
+	most := 0
+	for i, lastUsed := range candidates.LastUsed {
+		if lastUsed > candidates.LastUsed[most] {
+			most = i
+		}
+	}
+	return most
+}
+
+// RoundRobinStrategy picks the free VMContexts on the hosts in turn, in the order of the host names.
+// A host without a free VMContext is skipped.
+type RoundRobinStrategy struct {
+	// lastHost is the host of the last picked VMContext
+	lastHost *string
+}
+
+// Pick returns the index of the free VMContext freed longest ago on the host next to the last picked one.
+func (s *RoundRobinStrategy) Pick(candidates AllocationCandidates) int {
+	first := make(map[string]int)
+	var hosts []string
+	for i, vmContext := range candidates.Pool {
+		if _, exists := first[vmContext.Host()]; !exists {
+			first[vmContext.Host()] = i
+			hosts = append(hosts, vmContext.Host())
+		}
+	}
+	sort.Strings(hosts)
+	next := hosts[0]
+	if s.lastHost != nil {
+		// the first host after the last one, or the first host when the turn wraps around
+		if idx := sort.SearchStrings(hosts, *s.lastHost+"\x00"); idx < len(hosts) {
+			next = hosts[idx]
+		}
+	}
+	s.lastHost = &next
+	return first[next]
+}
+
+// RandomStrategy picks a free VMContext at random.
+type RandomStrategy struct {
+	rand *rand.Rand
+}
+
+// NewRandomStrategy returns a RandomStrategy drawing from the given source.
+func NewRandomStrategy(source rand.Source) *RandomStrategy {
+	return &RandomStrategy{rand: rand.New(source)}
+}
+
+// Pick returns the index of a random free VMContext.
+func (s *RandomStrategy) Pick(candidates AllocationCandidates) int {
+	return s.rand.Intn(len(candidates.Pool))
+}
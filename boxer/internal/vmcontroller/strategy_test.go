@@ -0,0 +1,194 @@
+package vmcontroller_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hongsam14/boxer/config"
+	"github.com/hongsam14/boxer/internal/vmcontroller"
+)
+
+// newStrategyPool returns free VMContexts named vm0, vm1, ... on the given hosts.
+func newStrategyPool(hosts ...string) []*vmcontroller.VMContext {
+	pool := make([]*vmcontroller.VMContext, len(hosts))
+	for i, host := range hosts {
+		pool[i] = vmcontroller.NewVMContext(config.VMInfoConfig{
+			Name:  fmt.Sprintf("vm%d", i),
+			Group: "group1",
+			Host:  host,
+		})
+	}
+	return pool
+}
+
+func TestAllocationStrategies(t *testing.T) {
+	candidates := vmcontroller.AllocationCandidates{
+		Pool:     newStrategyPool("hostA", "hostA", "hostB", "hostB"),
+		LastUsed: []uint64{5, 0, 7, 3},
+		HostLoad: map[string]int{"hostA": 2, "hostB": 1},
+	}
+	for _, tc := range []struct {
+		name string
+		want int
+	}{
+		{config.ALLOCATION_SPREAD, 2}, // the first one on the least loaded host
+		{config.ALLOCATION_FIFO, 0},   // the head of the pool
+		{config.ALLOCATION_LRU, 1},    // never allocated
+		{config.ALLOCATION_MRU, 2},    // allocated last
+	} {
+		strategy, err := vmcontroller.NewAllocationStrategy(tc.name)
+		if err != nil {
+			t.Fatalf("NewAllocationStrategy(%s) failed: %v", tc.name, err)
+		}
+		if got := strategy.Pick(candidates); got != tc.want {
+			t.Errorf("Strategy %s picked %d, want %d", tc.name, got, tc.want)
+		}
+	}
+	if _, err := vmcontroller.NewAllocationStrategy("busiest"); err == nil {
+		t.Error("Expected error for an unknown strategy")
+	}
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	strategy := new(vmcontroller.RoundRobinStrategy)
+	pool := newStrategyPool("hostB", "hostA", "hostC", "hostA")
+	// the hosts are taken in the order of their names and wrap around
+	var hosts []string
+	for i := 0; i < 4; i++ {
+		idx := strategy.Pick(vmcontroller.AllocationCandidates{Pool: pool})
+		hosts = append(hosts, pool[idx].Host())
+	}
+	if want := []string{"hostA", "hostB", "hostC", "hostA"}; !slices.Equal(hosts, want) {
+		t.Errorf("Expected the hosts %v, got %v", want, hosts)
+	}
+	// a host without a free VM is skipped
+	idx := strategy.Pick(vmcontroller.AllocationCandidates{Pool: newStrategyPool("hostA", "hostC")})
+	if idx != 1 {
+		t.Errorf("Expected hostC after hostA without a free VM on hostB, got %d", idx)
+	}
+}
+
+func TestRandomStrategy(t *testing.T) {
+	strategy := vmcontroller.NewRandomStrategy(rand.NewSource(42))
+	expected := rand.New(rand.NewSource(42))
+	candidates := vmcontroller.AllocationCandidates{Pool: newStrategyPool("", "", "", "", "")}
+	for i := 0; i < 20; i++ {
+		if got, want := strategy.Pick(candidates), expected.Intn(5); got != want {
+			t.Fatalf("Pick %d = %d, want %d", i, got, want)
+		}
+	}
+}
+
+// newStrategyTestCompose returns a VMCompose with vm1 and vm2 on the same host in group1,
+// picked by the given strategy.
+func newStrategyTestCompose(t *testing.T, strategy vmcontroller.AllocationStrategy) vmcontroller.VMCompose {
+	t.Helper()
+	vmInfoMap := map[string]config.VMInfoConfig{
+		"vm1": {Name: "vm1", Snapshot: "snapshot1", IP: "127.0.0.1", OS: "linux", Group: "group1", Labels: map[string]string{"arch": "x64"}},
+		"vm2": {Name: "vm2", Snapshot: "snapshot2", IP: "127.0.0.2", OS: "linux", Group: "group1", Labels: map[string]string{"arch": "x64"}},
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec:     10,
+		TimeoutSec:      30,
+		MaxVMOperations: 2,
+	}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	if err := vmCompose.SetAllocationStrategy("group1", strategy); err != nil {
+		t.Fatalf("SetAllocationStrategy failed: %v", err)
+	}
+	return vmCompose
+}
+
+func TestVMComposeAllocationStrategy(t *testing.T) {
+	vmCompose := newStrategyTestCompose(t, vmcontroller.LRUStrategy{})
+	if err := vmCompose.SetAllocationStrategy("group2", vmcontroller.LRUStrategy{}); err == nil {
+		t.Error("Expected error for an unknown group")
+	}
+	first, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	second, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	// the second is freed first, so FIFO would pick it, but the first is used less recently
+	vmCompose.FreeVMContext(second)
+	vmCompose.FreeVMContext(first)
+	if vm, _ := vmCompose.AllocateVMContext(context.Background(), "group1"); vm != first {
+		t.Errorf("Expected the least recently used %s, got %v", first.Machine(), vm)
+	}
+}
+
+func TestVMComposeAllocationStrategyHandoff(t *testing.T) {
+	vmCompose := newStrategyTestCompose(t, vmcontroller.LRUStrategy{})
+	first, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	second, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	served := make(chan *vmcontroller.VMContext, 1)
+	go func() {
+		vm, _ := vmCompose.AllocateVMContextWait(context.Background(), "group1")
+		served <- vm
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// the first is handed to the waiter, so it is used more recently than the second
+	vmCompose.FreeVMContext(first)
+	if vm := <-served; vm != first {
+		t.Fatalf("Expected %s to be handed to the waiter, got %v", first.Machine(), vm)
+	}
+	vmCompose.FreeVMContext(first)
+	vmCompose.FreeVMContext(second)
+	if vm, _ := vmCompose.AllocateVMContext(context.Background(), "group1"); vm != second {
+		t.Errorf("Expected the least recently used %s, got %v", second.Machine(), vm)
+	}
+}
+
+func TestVMComposeAllocationStrategySelector(t *testing.T) {
+	vmCompose := newStrategyTestCompose(t, vmcontroller.MRUStrategy{})
+	first, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	second, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	vmCompose.FreeVMContext(first)
+	vmCompose.FreeVMContext(second)
+	selector, err := config.ParseSelector("arch=x64")
+	if err != nil {
+		t.Fatalf("ParseSelector failed: %v", err)
+	}
+	// the strategy of the group picks among the matching VMs
+	if vm, err := vmCompose.AllocateVMContextSelector(context.Background(), selector); err != nil || vm != second {
+		t.Errorf("Expected the most recently used %s, got %v %v", second.Machine(), vm, err)
+	}
+}
+
+func TestVMComposeAllocationStrategySelectorRoundRobin(t *testing.T) {
+	vmInfoMap := make(map[string]config.VMInfoConfig)
+	for _, group := range []string{"groupA", "groupB"} {
+		for _, host := range []string{"host1", "host2"} {
+			name := group + host
+			vmInfoMap[name] = config.VMInfoConfig{Name: name, Snapshot: "snapshot0", OS: "linux", Group: group, Host: host, Labels: map[string]string{"arch": "x64"}}
+		}
+	}
+	vmPolicy := config.VMControlPolicyConfig{IntervalSec: 10, TimeoutSec: 30, MaxVMOperations: 4}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	for _, group := range []string{"groupA", "groupB"} {
+		if err := vmCompose.SetAllocationStrategy(group, new(vmcontroller.RoundRobinStrategy)); err != nil {
+			t.Fatalf("SetAllocationStrategy failed: %v", err)
+		}
+	}
+	selector, err := config.ParseSelector("arch=x64")
+	if err != nil {
+		t.Fatalf("ParseSelector failed: %v", err)
+	}
+	if vm, err := vmCompose.AllocateVMContextSelector(context.Background(), selector); err != nil || vm == nil || vm.Machine() != "groupAhost1" {
+		t.Fatalf("Expected groupAhost1 to be allocated, got %v %v", vm, err)
+	}
+	// the round robin of groupB is not moved by the selector allocation from groupA
+	if vm, _ := vmCompose.AllocateVMContext(context.Background(), "groupB"); vm == nil || vm.Host() != "host1" {
+		t.Errorf("Expected groupB to start its round robin on host1, got %v", vm)
+	}
+	if vm, _ := vmCompose.AllocateVMContext(context.Background(), "groupA"); vm == nil || vm.Host() != "host2" {
+		t.Errorf("Expected groupA to go on with its round robin on host2, got %v", vm)
+	}
+}
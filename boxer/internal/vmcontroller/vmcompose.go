@@ -1,28 +1,119 @@
 package vmcontroller
 
 import (
+	"context"
 	"fmt"
-	"sync/atomic"
+	"slices"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/hongsam14/boxer/config"
 	berror "github.com/hongsam14/boxer/error"
+	"github.com/hongsam14/boxer/vmstate"
 )
 
 // VMCompose allocates and Frees VMContexts based on the VMInfoMap and VMPolicy.
 // It manages groups of VMContexts and ensures that the maximum number of VM operations is not exceeded.
 // It provides methods to allocate and free VMContexts from the specified groups.
+// The free VMContext allocated from a group is picked by the AllocationStrategy of the group.
+// By default the allocations are spread across the hypervisor hosts: the free VMContext on the host
+// with the fewest allocated VMContexts is allocated first.
+// It tracks the consecutive failed operations of each VMContext, and quarantines a VMContext
+// reaching the quarantine threshold of the policy, so it is not allocated until it is released.
+// A VMContext in the ERROR state is not released by the quarantine duration.
+// If the policy sets a lease duration, every allocation holds a lease which must be renewed before it expires,
+// and the expired allocations are handed to the reaper to be reclaimed.
+// A set of VMContexts of several groups can be allocated all at once or not at all. A set waiting for
+// its whole set is not starved by the younger waiters, which do not take the VMContexts it needs.
+// A VMCompose is safe for concurrent use by multiple goroutines.
 type VMCompose interface {
 	// AllocateVMContext allocates a VMContext from the specified group.
 	// It returns the VMContext if available, or nil if all VMContexts are allocated.
-	AllocateVMContext(groupName string) (*VMContext, error)
+	// It returns an error without allocating if ctx is already done.
+	AllocateVMContext(ctx context.Context, groupName string) (*VMContext, error)
+	// AllocateVMContextWait allocates a VMContext from the specified group.
+	// Unlike AllocateVMContext, it waits in a FIFO queue of the group until a VMContext is available
+	// or ctx is done.
+	AllocateVMContextWait(ctx context.Context, groupName string) (*VMContext, error)
 	// FreeVMContext frees a VMContext and adds it back to the group.
+	// If callers are waiting for the group, the VMContext is handed to the longest waiter.
 	FreeVMContext(free *VMContext) error
+	// AllocateVMContextSelector allocates a free VMContext of any group whose labels match the selector.
+	// It returns nil if no matching VMContext is available, like AllocateVMContext.
+	AllocateVMContextSelector(ctx context.Context, selector config.Selector) (*VMContext, error)
+	// SetAllocationStrategy sets the strategy picking the VMContext allocated from the group.
+	SetAllocationStrategy(groupName string, strategy AllocationStrategy) error
+	// AllocateVMContexts allocates the VMContexts of every GroupCount all at once, or none of them.
+	// It returns nil if the whole set is not available, like AllocateVMContext.
+	AllocateVMContexts(ctx context.Context, counts []GroupCount) ([]*VMContext, error)
+	// AllocateVMContextsWait allocates the VMContexts of every GroupCount all at once.
+	// Unlike AllocateVMContexts, it waits in a FIFO queue until the whole set is available or ctx is done.
+	AllocateVMContextsWait(ctx context.Context, counts []GroupCount) ([]*VMContext, error)
+	// VMContexts returns every VMContext of every group, allocated, free or quarantined.
+	// The VMContexts are ordered by group and machine name.
+	VMContexts() []*VMContext
+
+	// ReportResult records the result of an operation on the VMContext.
+	// A success resets the consecutive failures of the VMContext. A VMContext whose consecutive failures
+	// reach the quarantine threshold is quarantined: at once if it is free, or when it is freed if it is allocated.
+	ReportResult(vmContext *VMContext, failed bool)
+	// Quarantine quarantines the allocated or free VMContext at once, whatever its failures are.
+	// An allocated VMContext is freed into the quarantine, so it is not handed to the waiters.
+	// The VMContext is kept until it is released manually, whatever the quarantine duration is.
+	Quarantine(vmContext *VMContext) error
+	// Quarantined returns the quarantined VMContexts, ordered by group and machine name.
+	Quarantined() []QuarantinedVM
+	// Unquarantine releases the quarantined VMContext of the group, so it can be allocated again.
+	// It returns berror.InvalidArgument if the VMContext is not quarantined.
+	Unquarantine(groupName, machine string) error
+
+	// Lease returns the expiry of the lease of the allocated VMContext.
+	// It returns false if the leases are disabled or the VMContext holds no lease, e.g. because it has expired.
+	Lease(vmContext *VMContext) (time.Time, bool)
+	// Renew extends the lease of the allocated VMContext by the lease duration and returns the new expiry.
+	// It returns berror.LeaseExpired if the lease has expired, and the zero time if the leases are disabled.
+	Renew(vmContext *VMContext) (time.Time, error)
+	// Expire takes the leases of the allocated VMContexts expired at now and returns the VMContexts,
+	// ordered by group and machine name. They stay allocated until they are freed, but cannot be renewed.
+	Expire(now time.Time) []*VMContext
+	// Reap calls reclaim for every VMContext whose lease expires, checking every interval until ctx is done.
+	// Each reclaim runs in its own goroutine, and Reap returns after the running ones return.
+	Reap(ctx context.Context, interval time.Duration, reclaim func(*VMContext))
+}
+
+// QuarantinedVM is a VMContext kept out of the allocation because its operations keep failing.
+type QuarantinedVM struct {
+	VM       *VMContext
+	Failures uint      // Failures is the number of consecutive failed operations of the VM
+	Since    time.Time // Since is when the VM is quarantined
+	// Until is when the VM is released, zero if it is kept until it is released manually
+	Until time.Time
 }
 
 type vmCompose struct {
+	// mux guards the groups and the currentVMOperations.
+	// groupMap itself is not modified after NewVMCompose.
+	mux                 sync.Mutex
 	groupMap            map[string]*vmContextGroup
 	maxVMOperations     uint32
 	currentVMOperations uint32
+	// hostLoad is the number of the allocated VMContexts on each host, keyed by the host name.
+	hostLoad map[string]int
+	// waiterSeq is the sequence number of the next waiter.
+	// it orders the waiters of different groups when a VM operation slot is freed.
+	waiterSeq uint64
+	// gangWaiters is the FIFO queue of the callers waiting for a set of VMContexts allocated all at once
+	gangWaiters []*gangWaiter
+	// quarantineThreshold is the number of consecutive failures quarantining a VMContext, zero disables it.
+	quarantineThreshold uint
+	// quarantineDuration is the time after which a quarantined VMContext is released, zero keeps it.
+	quarantineDuration time.Duration
+	// leaseDuration is the time an allocation is held without being renewed, zero disables the leases.
+	leaseDuration time.Duration
+	// labelIndex is every VMContext keyed by the key and the value of its labels,
+	// ordered by group and machine name. It is not modified after NewVMCompose.
+	labelIndex map[string]map[string][]*VMContext
 }
 
 // NewVMCompose creates a new vmCompose with the given VMInfoMap and VMPolicy.
@@ -39,6 +130,10 @@ func NewVMCompose(vmInfoMap map[string]config.VMInfoConfig, vmPolicy *config.VMC
 	newCompose.groupMap = make(map[string]*vmContextGroup)
 	newCompose.maxVMOperations = uint32(vmPolicy.MaxVMOperations)
 	newCompose.currentVMOperations = 0
+	newCompose.hostLoad = make(map[string]int)
+	newCompose.quarantineThreshold = vmPolicy.QuarantineThreshold
+	newCompose.quarantineDuration = time.Duration(vmPolicy.QuarantineSec) * time.Second
+	newCompose.leaseDuration = time.Duration(vmPolicy.LeaseSec) * time.Second
 
 	// create groupMap based on the VMInfoMap
 	for _, vmInfo := range vmInfoMap {
@@ -65,6 +160,7 @@ func NewVMCompose(vmInfoMap map[string]config.VMInfoConfig, vmPolicy *config.VMC
 			newCompose.groupMap[vmInfo.Group] = newGroup
 		}
 	}
+	newCompose.indexLabels()
 
 	return newCompose, nil
 }
@@ -73,7 +169,16 @@ func NewVMCompose(vmInfoMap map[string]config.VMInfoConfig, vmPolicy *config.VMC
 // It returns the VMContext if available, or nil if all VMContexts are allocated.
 // It also checks if the group exists and if the maximum number of VM operations has been reached.
 // If the maximum number of VM operations is reached, it returns nil without an error.
-func (vc *vmCompose) AllocateVMContext(groupName string) (*VMContext, error) {
+// If ctx is already done, it returns berror.Canceled or berror.Timeout without allocating.
+func (vc *vmCompose) AllocateVMContext(ctx context.Context, groupName string) (*VMContext, error) {
+	// check if the caller is still waiting for the VMContext
+	if err := ctx.Err(); err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.ContextErrorCode(err),
+			Msg:    "error in boxCompose AllocateVMContext",
+			Origin: err,
+		}
+	}
 	// check if the group exists
 	group, exists := vc.groupMap[groupName]
 	if !exists {
@@ -83,17 +188,237 @@ func (vc *vmCompose) AllocateVMContext(groupName string) (*VMContext, error) {
 			Origin: fmt.Errorf("group %s does not exist", groupName),
 		}
 	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	// do not overtake the callers waiting for the group
+	if len(group.waiters) > 0 || vc.gangBlocksLocked(group, vc.waiterSeq) {
+		return nil, nil
+	}
+	return vc.allocateLocked(group)
+}
+
+// AllocateVMContextWait allocates a VMContext from the specified group.
+// If no VMContext can be allocated, the caller is appended to the FIFO wait queue of the group
+// and blocked until a VMContext is handed to it by FreeVMContext.
+// If ctx is done while waiting, the caller leaves the queue and berror.Canceled or berror.Timeout is returned.
+func (vc *vmCompose) AllocateVMContextWait(ctx context.Context, groupName string) (*VMContext, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.ContextErrorCode(err),
+			Msg:    "error in boxCompose AllocateVMContextWait",
+			Origin: err,
+		}
+	}
+	group, exists := vc.groupMap[groupName]
+	if !exists {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxCompose AllocateVMContextWait",
+			Origin: fmt.Errorf("group %s does not exist", groupName),
+		}
+	}
+	vc.mux.Lock()
+	if len(group.waiters) == 0 && !vc.gangBlocksLocked(group, vc.waiterSeq) {
+		vmContext, err := vc.allocateLocked(group)
+		if err != nil || vmContext != nil {
+			vc.mux.Unlock()
+			return vmContext, err
+		}
+	}
+	// no VMContext is available, wait in the queue of the group
+	waiter := &vmWaiter{
+		seq:   vc.waiterSeq,
+		ready: make(chan *VMContext, 1),
+	}
+	vc.waiterSeq++
+	group.waiters = append(group.waiters, waiter)
+	vc.mux.Unlock()
+
+	select {
+	case vmContext := <-waiter.ready:
+		return vmContext, nil
+	case <-ctx.Done():
+	}
+	vc.mux.Lock()
+	removed := group.removeWaiter(waiter)
+	vc.mux.Unlock()
+	if !removed {
+		// the VMContext is handed to the waiter right before ctx is done.
+		// give it back so that the next waiter can take it.
+		if err := vc.FreeVMContext(<-waiter.ready); err != nil {
+			return nil, berror.BoxerError{
+				Code:   berror.InternalError,
+				Msg:    "error in boxCompose AllocateVMContextWait",
+				Origin: fmt.Errorf("failed to give back VMContext after %v: %w", ctx.Err(), err),
+			}
+		}
+	}
+	return nil, berror.BoxerError{
+		Code:   berror.ContextErrorCode(ctx.Err()),
+		Msg:    "error in boxCompose AllocateVMContextWait",
+		Origin: ctx.Err(),
+	}
+}
+
+// AllocateVMContextSelector allocates a free VMContext of any group whose labels match the selector.
+// The candidates are looked up by the label index if the selector requires a label value.
+// The group whose matching VMContexts include one on the least loaded host is chosen, the first by group name
+// on a tie, and its allocation strategy picks one of its matching VMContexts. The strategies of the other
+// groups are not called, so their state, e.g. the last host of a round robin, is kept.
+// It returns nil without an error if no matching VMContext is free or the maximum number of VM operations is reached.
+// The groups with waiting callers are skipped, so the waiters are not overtaken.
+func (vc *vmCompose) AllocateVMContextSelector(ctx context.Context, selector config.Selector) (*VMContext, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.ContextErrorCode(err),
+			Msg:    "error in boxCompose AllocateVMContextSelector",
+			Origin: err,
+		}
+	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	if vc.currentVMOperations >= vc.maxVMOperations {
+		return nil, nil
+	}
+	var (
+		best    *VMContext
+		chosen  *vmContextGroup
+		matched = make(map[*VMContext]bool)
+	)
+	for _, vmContext := range vc.candidatesLocked(selector) {
+		group := vc.groupMap[vmContext.Group()]
+		if len(group.waiters) > 0 || vc.gangBlocksLocked(group, vc.waiterSeq) || !selector.Matches(vmContext.labels) {
+			continue
+		}
+		if !slices.Contains(group.vmInfoPool, vmContext) {
+			// allocated or quarantined
+			continue
+		}
+		matched[vmContext] = true
+		// the candidates are ordered by group name, so the first group wins a tie
+		if best == nil || vc.hostLoad[vmContext.Host()] < vc.hostLoad[best.Host()] {
+			best, chosen = vmContext, group
+		}
+	}
+	if chosen == nil {
+		return nil, nil
+	}
+	// the matching VMContexts keep the order of the pool, the one freed longest ago first
+	var pool []*VMContext
+	for _, vmContext := range chosen.vmInfoPool {
+		if matched[vmContext] {
+			pool = append(pool, vmContext)
+		}
+	}
+	idx := chosen.strategy.Pick(AllocationCandidates{
+		Pool:     pool,
+		LastUsed: chosen.lastUsedOf(pool),
+		HostLoad: vc.hostLoad,
+	})
+	if idx < 0 || idx >= len(pool) {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidOperation,
+			Msg:    "error in boxCompose AllocateVMContextSelector",
+			Origin: fmt.Errorf("allocation strategy of group %s picked index %d out of %d candidates", chosen.GroupName(), idx, len(pool)),
+		}
+	}
+	return vc.allocateAtLocked(chosen, slices.Index(chosen.vmInfoPool, pool[idx]))
+}
+
+// candidatesLocked returns the VMContexts which may match the selector, ordered by group and machine name.
+// They are looked up by the label index if the selector requires a label value, otherwise they are the free VMContexts.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) candidatesLocked(selector config.Selector) []*VMContext {
+	var candidates []*VMContext
+	if key, values, ok := selector.Required(); ok {
+		for _, value := range values {
+			candidates = append(candidates, vc.labelIndex[key][value]...)
+		}
+	} else {
+		for _, group := range vc.groupMap {
+			candidates = append(candidates, group.vmInfoPool...)
+		}
+	}
+	sortVMContexts(candidates)
+	return candidates
+}
+
+// indexLabels builds the label index of every VMContext of every group.
+func (vc *vmCompose) indexLabels() {
+	vc.labelIndex = make(map[string]map[string][]*VMContext)
+	for _, group := range vc.groupMap {
+		for _, vmContext := range group.vmInfoPool {
+			for key, value := range vmContext.labels {
+				if vc.labelIndex[key] == nil {
+					vc.labelIndex[key] = make(map[string][]*VMContext)
+				}
+				vc.labelIndex[key][value] = append(vc.labelIndex[key][value], vmContext)
+			}
+		}
+	}
+	for _, values := range vc.labelIndex {
+		for _, vmContexts := range values {
+			sortVMContexts(vmContexts)
+		}
+	}
+}
+
+// sortVMContexts sorts the VMContexts by group and machine name.
+func sortVMContexts(vmContexts []*VMContext) {
+	sort.Slice(vmContexts, func(i, j int) bool {
+		if vmContexts[i].Group() != vmContexts[j].Group() {
+			return vmContexts[i].Group() < vmContexts[j].Group()
+		}
+		return vmContexts[i].Machine() < vmContexts[j].Machine()
+	})
+}
+
+// allocateLocked allocates a VMContext from the group and counts it as a VM operation.
+// It returns nil without an error if the group is empty or the maximum number of VM operations is reached.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) allocateLocked(group *vmContextGroup) (*VMContext, error) {
 	// check if the group has reached the maximum number of VM operations
-	if atomic.LoadUint32(&vc.currentVMOperations) >= vc.maxVMOperations {
+	if vc.currentVMOperations >= vc.maxVMOperations {
 		return nil, nil // no VMContext can be allocated because the maximum number of VM operations is reached
 	}
-	// allocate a VMContext from the group
-	vmContext, err := group.AllocateVMContext()
+	if len(group.vmInfoPool) == 0 {
+		return nil, nil
+	}
+	// allocate the VMContext picked by the strategy of the group
+	return vc.allocateAtLocked(group, group.strategy.Pick(AllocationCandidates{
+		Pool:     group.vmInfoPool,
+		LastUsed: group.lastUsedOf(group.vmInfoPool),
+		HostLoad: vc.hostLoad,
+	}))
+}
+
+// SetAllocationStrategy sets the strategy picking the VMContext allocated from the group.
+// It returns berror.InvalidArgument if the group does not exist or the strategy is nil.
+func (vc *vmCompose) SetAllocationStrategy(groupName string, strategy AllocationStrategy) error {
+	group, exists := vc.groupMap[groupName]
+	if !exists || strategy == nil {
+		return berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxCompose SetAllocationStrategy",
+			Origin: fmt.Errorf("group %s does not exist or the strategy is nil", groupName),
+		}
+	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	group.strategy = strategy
+	return nil
+}
+
+// allocateAtLocked allocates the VMContext at the index of the pool of the group and counts it as a VM operation.
+// The caller checks the maximum number of VM operations.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) allocateAtLocked(group *vmContextGroup, idx int) (*VMContext, error) {
+	vmContext, err := group.AllocateVMContextAt(idx)
 	if err != nil {
 		return nil, berror.BoxerError{
 			Code:   berror.InvalidOperation,
 			Msg:    "error in boxCompose AllocateVMContext",
-			Origin: fmt.Errorf("failed to allocate VMContext from group %s: %w", groupName, err),
+			Origin: fmt.Errorf("failed to allocate VMContext from group %s: %w", group.GroupName(), err),
 		}
 	}
 	if vmContext == nil {
@@ -101,11 +426,76 @@ func (vc *vmCompose) AllocateVMContext(groupName string) (*VMContext, error) {
 		return nil, nil
 	}
 	// increment the current VM operations count
-	// compare and swap the currentVMOperations with the incremented value
-	atomic.AddUint32(&vc.currentVMOperations, 1)
+	vc.currentVMOperations++
+	vc.hostLoad[vmContext.Host()]++
+	vc.leaseLocked(group, vmContext)
 	return vmContext, nil
 }
 
+// dispatchLocked hands the available VMContexts to the waiters.
+// The oldest set waiting for its whole set is served first if it is available.
+// A set which fails to be allocated, or is stalled by the quarantine, is given up with the error,
+// so it does not block the sets and the waiters behind it.
+// Then the oldest waiter among the groups that have a free VMContext is served,
+// unless an older set needs the VMContext, until the maximum number of VM operations is reached.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) dispatchLocked() {
+	for len(vc.gangWaiters) > 0 {
+		gang := vc.gangWaiters[0]
+		err := vc.gangStalledLocked(gang)
+		var vmContexts []*VMContext
+		if err == nil {
+			if !vc.gangAvailableLocked(gang, true) {
+				break
+			}
+			vmContexts, err = vc.allocateGangLocked(gang)
+		}
+		vc.removeGangWaiterLocked(gang)
+		gang.ready <- gangResult{vmContexts: vmContexts, err: err}
+	}
+	for vc.currentVMOperations < vc.maxVMOperations {
+		var oldest *vmContextGroup
+		for _, group := range vc.groupMap {
+			if len(group.waiters) == 0 || len(group.vmInfoPool) == 0 {
+				continue
+			}
+			if vc.gangBlocksLocked(group, group.waiters[0].seq) {
+				continue
+			}
+			if oldest == nil || group.waiters[0].seq < oldest.waiters[0].seq {
+				oldest = group
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		vmContext, err := vc.allocateLocked(oldest)
+		if err != nil || vmContext == nil {
+			return
+		}
+		oldest.popWaiter().ready <- vmContext
+	}
+}
+
+// VMContexts returns every VMContext of every group, allocated or not.
+// The VMContexts are ordered by group and machine name.
+func (vc *vmCompose) VMContexts() []*VMContext {
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	var vmContexts []*VMContext
+	for _, group := range vc.groupMap {
+		vmContexts = append(vmContexts, group.vmInfoPool...)
+		for _, vmContext := range group.allocatedVMInfo {
+			vmContexts = append(vmContexts, vmContext)
+		}
+		for _, quarantined := range group.quarantined {
+			vmContexts = append(vmContexts, quarantined.VM)
+		}
+	}
+	sortVMContexts(vmContexts)
+	return vmContexts
+}
+
 // FreeVMContext frees a VMContext and adds it back to the group.
 // It checks if the group exists and if the VMContext is in the allocated VMContexts.
 // It decrements the current VM operations count after freeing the VMContext.
@@ -120,6 +510,36 @@ func (vc *vmCompose) FreeVMContext(free *VMContext) error {
 			Origin: fmt.Errorf("group %s does not exist", free.Group()),
 		}
 	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	// a VMContext failing too often is quarantined instead of being handed out again
+	_, allocated := group.allocatedVMInfo[free.Machine()]
+	if allocated && vc.quarantineThreshold != 0 && group.failures[free.Machine()] >= vc.quarantineThreshold {
+		if err := vc.quarantineLocked(group, free, vc.quarantineDuration); err != nil {
+			return err
+		}
+		vc.currentVMOperations--
+		vc.hostLoad[free.Host()]--
+		vc.dispatchLocked()
+		return nil
+	}
+	// hand the VMContext directly to the longest waiter of the group.
+	// it stays allocated, so the current VM operations count does not change.
+	// if an older set needs it, it is freed and dispatched instead.
+	if len(group.waiters) > 0 && !vc.gangBlocksLocked(group, group.waiters[0].seq) {
+		if !allocated {
+			return berror.BoxerError{
+				Code:   berror.InvalidOperation,
+				Msg:    "error in boxCompose FreeVMContext",
+				Origin: fmt.Errorf("VMContext %s is not allocated in group %s", free.Machine(), free.Group()),
+			}
+		}
+		// the waiter holds a new lease, and the VMContext is used again for the allocation strategy
+		vc.leaseLocked(group, free)
+		group.markUsed(free)
+		group.popWaiter().ready <- free
+		return nil
+	}
 	// free the VMContext in the group
 	err := group.FreeVMContext(free)
 	if err != nil {
@@ -130,17 +550,295 @@ func (vc *vmCompose) FreeVMContext(free *VMContext) error {
 		}
 	}
 	// decrement the current VM operations count
-	atomic.AddUint32(&vc.currentVMOperations, ^uint32(0)) // decrement by 1
+	vc.currentVMOperations--
+	vc.hostLoad[free.Host()]--
+	// the freed slot may be taken by a waiter of another group
+	vc.dispatchLocked()
+	return nil
+}
+
+// ReportResult records the result of an operation on the VMContext.
+// A success resets the consecutive failures of the VMContext. A VMContext whose consecutive failures
+// reach the quarantine threshold is quarantined: at once if it is free, or when it is freed if it is allocated.
+func (vc *vmCompose) ReportResult(vmContext *VMContext, failed bool) {
+	group, exists := vc.groupMap[vmContext.Group()]
+	if !exists {
+		return
+	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	if !failed {
+		delete(group.failures, vmContext.Machine())
+		return
+	}
+	group.failures[vmContext.Machine()]++
+	if vc.quarantineThreshold == 0 || group.failures[vmContext.Machine()] < vc.quarantineThreshold {
+		return
+	}
+	// an allocated VMContext is quarantined when it is freed, so its user is not disturbed
+	if _, allocated := group.allocatedVMInfo[vmContext.Machine()]; allocated {
+		return
+	}
+	if err := vc.quarantineLocked(group, vmContext, vc.quarantineDuration); err == nil {
+		// a waiting set may be stalled by the quarantine
+		vc.dispatchLocked()
+	}
+}
+
+// Quarantine quarantines the allocated or free VMContext at once, whatever its failures are.
+// An allocated VMContext is freed into the quarantine, so it is not handed to the waiters,
+// and its VM operation slot is given to the waiters of the other groups.
+// It is not released after the quarantine duration, since nothing tells it is clean again.
+func (vc *vmCompose) Quarantine(vmContext *VMContext) error {
+	group, exists := vc.groupMap[vmContext.Group()]
+	if !exists {
+		return berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxCompose Quarantine",
+			Origin: fmt.Errorf("group %s does not exist", vmContext.Group()),
+		}
+	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	_, allocated := group.allocatedVMInfo[vmContext.Machine()]
+	if err := vc.quarantineLocked(group, vmContext, 0); err != nil {
+		return err
+	}
+	if allocated {
+		vc.currentVMOperations--
+		vc.hostLoad[vmContext.Host()]--
+	}
+	// a waiting set may be stalled by the quarantine
+	vc.dispatchLocked()
+	return nil
+}
+
+// quarantineLocked moves the allocated or free VMContext into the quarantine of the group.
+// The VMContext is released after the duration, or never if it is zero.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) quarantineLocked(group *vmContextGroup, vmContext *VMContext, duration time.Duration) error {
+	entry, err := group.QuarantineVMContext(vmContext, duration)
+	if err != nil {
+		return berror.BoxerError{
+			Code:   berror.InvalidOperation,
+			Msg:    "error in boxCompose quarantine",
+			Origin: fmt.Errorf("failed to quarantine VMContext %s in group %s: %w", vmContext.Machine(), group.GroupName(), err),
+		}
+	}
+	if duration > 0 {
+		vc.scheduleReleaseLocked(group, entry)
+	}
+	return nil
+}
+
+// scheduleReleaseLocked releases the quarantined VMContext when its quarantine is over.
+// A VMContext still in the ERROR state is not released into the pool, its quarantine is extended
+// by the quarantine duration instead, until its state is corrected, e.g. by the reconciler.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) scheduleReleaseLocked(group *vmContextGroup, entry *QuarantinedVM) {
+	time.AfterFunc(time.Until(entry.Until), func() {
+		vc.mux.Lock()
+		defer vc.mux.Unlock()
+		machine := entry.VM.Machine()
+		// the VMContext may be released manually and quarantined again meanwhile
+		if group.quarantined[machine] != entry {
+			return
+		}
+		if entry.VM.State() == vmstate.ERROR {
+			entry.Until = time.Now().Add(vc.quarantineDuration)
+			vc.scheduleReleaseLocked(group, entry)
+			// a waiting set may be stalled by the VMContext in the ERROR state
+			vc.dispatchLocked()
+			return
+		}
+		vc.releaseLocked(group, machine)
+	})
+}
+
+// releaseLocked moves the quarantined VMContext back to the pool of the group and serves the waiters.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) releaseLocked(group *vmContextGroup, machine string) error {
+	if err := group.ReleaseVMContext(machine); err != nil {
+		return err
+	}
+	vc.dispatchLocked()
 	return nil
 }
 
+// Quarantined returns the quarantined VMContexts, ordered by group and machine name.
+func (vc *vmCompose) Quarantined() []QuarantinedVM {
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	var quarantined []QuarantinedVM
+	for _, group := range vc.groupMap {
+		for _, entry := range group.quarantined {
+			quarantined = append(quarantined, *entry)
+		}
+	}
+	sort.Slice(quarantined, func(i, j int) bool {
+		if quarantined[i].VM.Group() != quarantined[j].VM.Group() {
+			return quarantined[i].VM.Group() < quarantined[j].VM.Group()
+		}
+		return quarantined[i].VM.Machine() < quarantined[j].VM.Machine()
+	})
+	return quarantined
+}
+
+// Unquarantine releases the quarantined VMContext of the group, so it can be allocated again.
+// Its consecutive failures are reset, and it is handed to the waiters of the group if there are any.
+// It returns berror.InvalidArgument if the group does not exist or the VMContext is not quarantined.
+func (vc *vmCompose) Unquarantine(groupName, machine string) error {
+	group, exists := vc.groupMap[groupName]
+	if !exists {
+		return berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxCompose Unquarantine",
+			Origin: fmt.Errorf("group %s does not exist", groupName),
+		}
+	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	if err := vc.releaseLocked(group, machine); err != nil {
+		return berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxCompose Unquarantine",
+			Origin: err,
+		}
+	}
+	return nil
+}
+
+// leaseLocked gives a new lease to the allocated VMContext if the leases are enabled.
+// vc.mux must be held by the caller.
+func (vc *vmCompose) leaseLocked(group *vmContextGroup, vmContext *VMContext) {
+	if vc.leaseDuration > 0 {
+		group.leases[vmContext.Machine()] = time.Now().Add(vc.leaseDuration)
+	}
+}
+
+// Lease returns the expiry of the lease of the allocated VMContext.
+// It returns false if the leases are disabled or the VMContext holds no lease, e.g. because it has expired.
+func (vc *vmCompose) Lease(vmContext *VMContext) (time.Time, bool) {
+	group, exists := vc.groupMap[vmContext.Group()]
+	if !exists {
+		return time.Time{}, false
+	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	expiry, leased := group.leases[vmContext.Machine()]
+	return expiry, leased
+}
+
+// Renew extends the lease of the allocated VMContext by the lease duration and returns the new expiry.
+// It returns berror.InvalidArgument if the VMContext is not allocated, berror.LeaseExpired if its lease
+// has expired, and the zero time if the leases are disabled.
+func (vc *vmCompose) Renew(vmContext *VMContext) (time.Time, error) {
+	group, exists := vc.groupMap[vmContext.Group()]
+	if !exists {
+		return time.Time{}, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxCompose Renew",
+			Origin: fmt.Errorf("group %s does not exist", vmContext.Group()),
+		}
+	}
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	if _, allocated := group.allocatedVMInfo[vmContext.Machine()]; !allocated {
+		return time.Time{}, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxCompose Renew",
+			Origin: fmt.Errorf("VMContext %s is not allocated in group %s", vmContext.Machine(), group.GroupName()),
+		}
+	}
+	if vc.leaseDuration == 0 {
+		return time.Time{}, nil
+	}
+	if _, leased := group.leases[vmContext.Machine()]; !leased {
+		return time.Time{}, berror.BoxerError{
+			Code:   berror.LeaseExpired,
+			Msg:    "error in boxCompose Renew",
+			Origin: fmt.Errorf("lease of VMContext %s in group %s has expired", vmContext.Machine(), group.GroupName()),
+		}
+	}
+	expiry := time.Now().Add(vc.leaseDuration)
+	group.leases[vmContext.Machine()] = expiry
+	return expiry, nil
+}
+
+// Expire takes the leases of the allocated VMContexts expired at now and returns the VMContexts,
+// ordered by group and machine name. They stay allocated until they are freed, but cannot be renewed.
+func (vc *vmCompose) Expire(now time.Time) []*VMContext {
+	vc.mux.Lock()
+	defer vc.mux.Unlock()
+	var expired []*VMContext
+	for _, group := range vc.groupMap {
+		for machine, expiry := range group.leases {
+			if expiry.After(now) {
+				continue
+			}
+			delete(group.leases, machine)
+			expired = append(expired, group.allocatedVMInfo[machine])
+		}
+	}
+	sortVMContexts(expired)
+	return expired
+}
+
+// Reap calls reclaim for every VMContext whose lease expires, checking every interval until ctx is done.
+// reclaim is expected to free the VMContext, e.g. after resetting the VM.
+// Each reclaim runs in its own goroutine, so a slow reset does not delay the other expired leases
+// or the next check. The commands of the resets are bounded by the limits of the VMController.
+// Reap returns after the running reclaims return.
+func (vc *vmCompose) Reap(ctx context.Context, interval time.Duration, reclaim func(*VMContext)) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// an expired lease is taken once, so a VMContext is never reclaimed twice at the same time
+			for _, vmContext := range vc.Expire(now) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					reclaim(vmContext)
+				}()
+			}
+		}
+	}
+}
+
+// vmWaiter is a caller waiting in the queue of a vmContextGroup.
+type vmWaiter struct {
+	seq   uint64
+	ready chan *VMContext // ready receives the allocated VMContext, it is buffered so that the sender never blocks
+}
+
 // vmContextGroup is a struct that holds a group of VMContexts.
 // It is used to manage the allocation and deallocation of VMContexts.
+// It is not safe for concurrent use, the vmCompose serializes the access to its groups.
 type vmContextGroup struct {
 	groupName       string
 	size            int
 	vmInfoPool      []*VMContext
 	allocatedVMInfo map[string]*VMContext
+	// quarantined are the VMContexts kept out of the allocation, keyed by the machine name
+	quarantined map[string]*QuarantinedVM
+	// failures is the number of consecutive failed operations of each VMContext, keyed by the machine name
+	failures map[string]uint
+	// leases is the expiry of the lease of each allocated VMContext, keyed by the machine name
+	leases map[string]time.Time
+	// strategy picks the VMContext allocated from the pool
+	strategy AllocationStrategy
+	// lastUsed is the allocation sequence number of each VMContext allocated once, keyed by the machine name,
+	// and useSeq is the sequence number of the last allocation
+	lastUsed map[string]uint64
+	useSeq   uint64
+	// waiters is the FIFO queue of the callers waiting for a VMContext of the group
+	waiters []*vmWaiter
 }
 
 // GroupName returns the name of the VMContextGroup.
@@ -148,6 +846,26 @@ func (vg *vmContextGroup) GroupName() string {
 	return vg.groupName
 }
 
+// popWaiter removes and returns the longest waiter of the group.
+func (vg *vmContextGroup) popWaiter() *vmWaiter {
+	waiter := vg.waiters[0]
+	vg.waiters[0] = nil
+	vg.waiters = vg.waiters[1:]
+	return waiter
+}
+
+// removeWaiter removes the waiter from the queue of the group.
+// It returns false if the waiter is not in the queue, which means it has already been served.
+func (vg *vmContextGroup) removeWaiter(waiter *vmWaiter) bool {
+	for idx, queued := range vg.waiters {
+		if queued == waiter {
+			vg.waiters = append(vg.waiters[:idx], vg.waiters[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 // newVMGroup creates a new vmContextGroup with the given groupName and VMInfos.
 func newVMGroup(groupName string, vmInfos ...config.VMInfoConfig) (*vmContextGroup, error) {
 	newGroup := new(vmContextGroup)
@@ -180,6 +898,11 @@ func newVMGroup(groupName string, vmInfos ...config.VMInfoConfig) (*vmContextGro
 	}
 	// allocate the allocatedVMInfo map
 	newGroup.allocatedVMInfo = make(map[string]*VMContext)
+	newGroup.quarantined = make(map[string]*QuarantinedVM)
+	newGroup.failures = make(map[string]uint)
+	newGroup.leases = make(map[string]time.Time)
+	newGroup.strategy = SpreadStrategy{}
+	newGroup.lastUsed = make(map[string]uint64)
 	// set the size of the group to the number of VM infos
 	newGroup.size = len(vmInfos)
 	return newGroup, nil
@@ -188,24 +911,38 @@ func newVMGroup(groupName string, vmInfos ...config.VMInfoConfig) (*vmContextGro
 // AllocateVMContext allocates a VMContext from the group.
 // It returns the VMContext if available, or nil if all VMContexts are allocated.
 func (vg *vmContextGroup) AllocateVMContext() (*VMContext, error) {
-	// get the first VMContext from the pool
+	return vg.AllocateVMContextAt(0)
+}
+
+// AllocateVMContextAt allocates the VMContext at the given index of the pool.
+// It returns nil if all VMContexts are allocated.
+func (vg *vmContextGroup) AllocateVMContextAt(idx int) (*VMContext, error) {
+	// get the VMContext from the pool
 	if len(vg.vmInfoPool) == 0 {
 		// all the VMContexts are allocated, return an nil because there is no VMContext available.
 		// and this is not an error, just a normal case.
 		return nil, nil
 	}
-	vmContext := vg.vmInfoPool[0]
-	// remove the VMContext from the pool
-	vg.vmInfoPool = vg.vmInfoPool[1:]
+	if idx < 0 || idx >= len(vg.vmInfoPool) {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxGroup AllocateVMContext",
+			Origin: fmt.Errorf("index %d is out of the pool of group %s", idx, vg.groupName),
+		}
+	}
+	vmContext := vg.vmInfoPool[idx]
+	// remove the VMContext from the pool, keeping the order of the others
+	vg.vmInfoPool = append(vg.vmInfoPool[:idx:idx], vg.vmInfoPool[idx+1:]...)
 	// add the VMContext to the allocatedVMInfo map
 	vg.allocatedVMInfo[vmContext.Machine()] = vmContext
-	// check if the size of the group is equal to the size of the vmInfoPool + len(allocatedVMInfo)
-	if len(vg.vmInfoPool)+len(vg.allocatedVMInfo) != vg.size {
+	vg.markUsed(vmContext)
+	// check if the size of the group is equal to the number of the free, allocated and quarantined VMContexts
+	if vg.count() != vg.size {
 		// return an error if the size is not equal
 		return nil, berror.BoxerError{
 			Code:   berror.InvalidOperation,
 			Msg:    "error in boxGroup AllocateVMContext",
-			Origin: fmt.Errorf("group %s size mismatch: expected %d, got %d", vg.groupName, vg.size, len(vg.vmInfoPool)+len(vg.allocatedVMInfo)),
+			Origin: fmt.Errorf("group %s size mismatch: expected %d, got %d", vg.groupName, vg.size, vg.count()),
 		}
 	}
 	// return the VMContext
@@ -224,16 +961,102 @@ func (bg *vmContextGroup) FreeVMContext(vmContext *VMContext) error {
 	}
 	// remove the VMContext from the allocatedVMInfo map
 	delete(bg.allocatedVMInfo, vmContext.Machine())
+	delete(bg.leases, vmContext.Machine())
 	// add the VMContext back to the vmInfoPool
 	bg.vmInfoPool = append(bg.vmInfoPool, vmContext)
-	// check if the size of the group is equal to the size of the vmInfoPool + len(allocatedVMInfo)
-	if len(bg.vmInfoPool)+len(bg.allocatedVMInfo) != bg.size {
+	// check if the size of the group is equal to the number of the free, allocated and quarantined VMContexts
+	if bg.count() != bg.size {
 		return berror.BoxerError{
 			Code:   berror.InvalidOperation,
 			Msg:    "error in boxGroup FreeVMContext",
-			Origin: fmt.Errorf("group %s size mismatch: expected %d, got %d", bg.groupName, bg.size, len(bg.vmInfoPool)+len(bg.allocatedVMInfo)),
+			Origin: fmt.Errorf("group %s size mismatch: expected %d, got %d", bg.groupName, bg.size, bg.count()),
+		}
+	}
+	return nil
+}
+
+// markUsed records the VMContext as allocated last, whether it is taken from the pool or handed to a waiter.
+func (vg *vmContextGroup) markUsed(vmContext *VMContext) {
+	vg.useSeq++
+	vg.lastUsed[vmContext.Machine()] = vg.useSeq
+}
+
+// lastUsedOf returns the allocation sequence number of each VMContext of the pool, zero if it is never allocated.
+func (vg *vmContextGroup) lastUsedOf(pool []*VMContext) []uint64 {
+	lastUsed := make([]uint64, len(pool))
+	for i, vmContext := range pool {
+		lastUsed[i] = vg.lastUsed[vmContext.Machine()]
+	}
+	return lastUsed
+}
+
+// stuckQuarantined returns the number of the quarantined VMContexts which are not released by the quarantine duration:
+// the ones quarantined until they are released manually, and the ones in the ERROR state, whose quarantine is extended.
+func (vg *vmContextGroup) stuckQuarantined() int {
+	stuck := 0
+	for _, entry := range vg.quarantined {
+		if entry.Until.IsZero() || entry.VM.State() == vmstate.ERROR {
+			stuck++
+		}
+	}
+	return stuck
+}
+
+// count returns the number of the free, allocated and quarantined VMContexts of the group.
+func (vg *vmContextGroup) count() int {
+	return len(vg.vmInfoPool) + len(vg.allocatedVMInfo) + len(vg.quarantined)
+}
+
+// QuarantineVMContext moves the allocated or free VMContext into the quarantine.
+// The returned QuarantinedVM is released after the duration, or never if it is zero.
+func (vg *vmContextGroup) QuarantineVMContext(vmContext *VMContext, duration time.Duration) (*QuarantinedVM, error) {
+	machine := vmContext.Machine()
+	if _, allocated := vg.allocatedVMInfo[machine]; allocated {
+		delete(vg.allocatedVMInfo, machine)
+		delete(vg.leases, machine)
+	} else {
+		idx := slices.Index(vg.vmInfoPool, vmContext)
+		if idx < 0 {
+			return nil, berror.BoxerError{
+				Code:   berror.InvalidArgument,
+				Msg:    "error in boxGroup QuarantineVMContext",
+				Origin: fmt.Errorf("VMContext %s is neither allocated nor free in group %s", machine, vg.groupName),
+			}
+		}
+		vg.vmInfoPool = append(vg.vmInfoPool[:idx:idx], vg.vmInfoPool[idx+1:]...)
+	}
+	entry := &QuarantinedVM{
+		VM:       vmContext,
+		Failures: vg.failures[machine],
+		Since:    time.Now(),
+	}
+	if duration > 0 {
+		entry.Until = entry.Since.Add(duration)
+	}
+	vg.quarantined[machine] = entry
+	if vg.count() != vg.size {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidOperation,
+			Msg:    "error in boxGroup QuarantineVMContext",
+			Origin: fmt.Errorf("group %s size mismatch: expected %d, got %d", vg.groupName, vg.size, vg.count()),
+		}
+	}
+	return entry, nil
+}
+
+// ReleaseVMContext moves the quarantined VMContext back to the pool and resets its failures.
+func (vg *vmContextGroup) ReleaseVMContext(machine string) error {
+	entry, exists := vg.quarantined[machine]
+	if !exists {
+		return berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error in boxGroup ReleaseVMContext",
+			Origin: fmt.Errorf("VMContext %s is not quarantined in group %s", machine, vg.groupName),
 		}
 	}
+	delete(vg.quarantined, machine)
+	delete(vg.failures, machine)
+	vg.vmInfoPool = append(vg.vmInfoPool, entry.VM)
 	return nil
 }
 
@@ -262,12 +1085,12 @@ func (bg *vmContextGroup) AppendVMContext(added config.VMInfoConfig) error {
 	bg.vmInfoPool = append(bg.vmInfoPool, addedVMContext)
 	// increase the size of the group
 	bg.size++
-	// check if the size of the group is equal to the size of the vmInfoPool + len(allocatedVMInfo)
-	if len(bg.vmInfoPool)+len(bg.allocatedVMInfo) != bg.size {
+	// check if the size of the group is equal to the number of the free, allocated and quarantined VMContexts
+	if bg.count() != bg.size {
 		return berror.BoxerError{
 			Code:   berror.InvalidOperation,
 			Msg:    "error in boxGroup AppendVMContext",
-			Origin: fmt.Errorf("group %s size mismatch: expected %d, got %d", bg.groupName, bg.size, len(bg.vmInfoPool)+len(bg.allocatedVMInfo)),
+			Origin: fmt.Errorf("group %s size mismatch: expected %d, got %d", bg.groupName, bg.size, bg.count()),
 		}
 	}
 	return nil
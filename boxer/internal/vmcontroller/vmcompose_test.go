@@ -1,11 +1,18 @@
 package vmcontroller_test
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
 	"github.com/hongsam14/boxer/internal/vmcontroller"
+	"github.com/hongsam14/boxer/vmstate"
 )
 
 func TestVMComposeAllocateAndFree(t *testing.T) {
@@ -43,7 +50,7 @@ func TestVMComposeAllocateAndFree(t *testing.T) {
 		return
 	}
 	// Allocate VMs
-	vm1, err := vmCompose.AllocateVMContext("group1")
+	vm1, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatalf("Failed to allocate VM1: %v", err)
 		return
@@ -54,7 +61,7 @@ func TestVMComposeAllocateAndFree(t *testing.T) {
 	}
 	t.Logf("Allocated VM1: %s %s", vm1.Machine(), vm1.Group())
 	// Allocate another VM in the same group
-	vm2, err := vmCompose.AllocateVMContext("group1")
+	vm2, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatalf("Failed to allocate VM2: %v", err)
 		return
@@ -65,7 +72,7 @@ func TestVMComposeAllocateAndFree(t *testing.T) {
 	}
 	t.Logf("Allocated VM2: %s %s", vm2.Machine(), vm2.Group())
 	// Allocate a VM in a different group
-	vm3, err := vmCompose.AllocateVMContext("group2")
+	vm3, err := vmCompose.AllocateVMContext(context.Background(), "group2")
 	if err != nil {
 		t.Fatalf("Failed to allocate VM3: %v", err)
 		return
@@ -93,26 +100,26 @@ func TestVMComposeAllocateAndFree(t *testing.T) {
 	}
 	t.Log("Successfully freed all allocated VMs")
 	// Check if all VMs are freed by trying to allocate again
-	_, err = vmCompose.AllocateVMContext("group1")
+	_, err = vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatal("Expected error when allocating VM after freeing, but got none")
 		return
 	}
 	t.Log("Successfully allocated a new VM after freeing all previous VMs")
-	_, err = vmCompose.AllocateVMContext("group1")
+	_, err = vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatal("Expected error when allocating VM after freeing, but got none")
 		return
 	}
 	t.Log("Successfully allocated another new VM after freeing all previous VMs")
-	_, err = vmCompose.AllocateVMContext("group2")
+	_, err = vmCompose.AllocateVMContext(context.Background(), "group2")
 	if err != nil {
 		t.Fatal("Expected error when allocating VM after freeing, but got none")
 		return
 	}
 	t.Log("Successfully allocated a new VM in a different group after freeing all previous VMs")
 	// Final check to ensure all VMs are allocated correctly
-	out, err := vmCompose.AllocateVMContext("group1")
+	out, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 	if out != nil {
 		t.Fatalf("Expected no VM to be allocated after freeing, but got: %s", out.Machine())
 		return
@@ -154,7 +161,7 @@ func TestVMComposeAllocateNonExistentGroup(t *testing.T) {
 		return
 	}
 	// Try to allocate a VM from a non-existent group
-	out, err := vmCompose.AllocateVMContext("nonExistentGroup")
+	out, err := vmCompose.AllocateVMContext(context.Background(), "nonExistentGroup")
 	if err == nil || out != nil {
 		t.Fatal("Expected error when allocating VM from non-existent group, but got none")
 		return
@@ -197,7 +204,7 @@ func TestVMComposeAllocateExceedingLimit(t *testing.T) {
 		return
 	}
 	// Allocate VMs up to the limit
-	vm1, err := vmCompose.AllocateVMContext("group1")
+	vm1, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatalf("Failed to allocate VM1: %v", err)
 		return
@@ -206,7 +213,7 @@ func TestVMComposeAllocateExceedingLimit(t *testing.T) {
 		t.Fatal("Allocated VM1 is nil")
 		return
 	}
-	vm2, err := vmCompose.AllocateVMContext("group2")
+	vm2, err := vmCompose.AllocateVMContext(context.Background(), "group2")
 	if err != nil {
 		t.Fatalf("Failed to allocate VM2: %v", err)
 		return
@@ -216,7 +223,7 @@ func TestVMComposeAllocateExceedingLimit(t *testing.T) {
 		return
 	}
 	// Try to allocate a third VM which should exceed the limit
-	out, err := vmCompose.AllocateVMContext("group1")
+	out, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatal("error when allocating VM exceeding limit")
 		return
@@ -263,7 +270,7 @@ func TestVMComposeAllocateMaximumNumberOfVMsGroup(t *testing.T) {
 		return
 	}
 	// Allocate VMs up to the limit
-	vm1, err := vmCompose.AllocateVMContext("group1")
+	vm1, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatalf("Failed to allocate VM1: %v", err)
 		return
@@ -272,7 +279,7 @@ func TestVMComposeAllocateMaximumNumberOfVMsGroup(t *testing.T) {
 		t.Fatal("Allocated VM1 is nil")
 		return
 	}
-	vm2, err := vmCompose.AllocateVMContext("group1")
+	vm2, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatalf("Failed to allocate VM2: %v", err)
 		return
@@ -282,7 +289,7 @@ func TestVMComposeAllocateMaximumNumberOfVMsGroup(t *testing.T) {
 		return
 	}
 	// Try to allocate a third VM which should exceed the limit
-	out, err := vmCompose.AllocateVMContext("group1")
+	out, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatal("error when allocating VM exceeding limit")
 		return
@@ -329,7 +336,7 @@ func TestVMComposeFreeDuplicatedVMContext(t *testing.T) {
 		return
 	}
 	// Allocate VMs up to the limit
-	vm1, err := vmCompose.AllocateVMContext("group1")
+	vm1, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 	if err != nil {
 		t.Fatalf("Failed to allocate VM1: %v", err)
 		return
@@ -441,7 +448,7 @@ func TestVMComposeAllocateAndFreeMultipleLoops(t *testing.T) {
 	for i := 0; i < rand.Intn(10)+1; i++ {
 		t.Logf("Loop iteration %d", i+1)
 		// Allocate VMs
-		vm1, err := vmCompose.AllocateVMContext("group1")
+		vm1, err := vmCompose.AllocateVMContext(context.Background(), "group1")
 		if err != nil {
 			t.Fatalf("Failed to allocate VM1: %v", err)
 			return
@@ -452,7 +459,7 @@ func TestVMComposeAllocateAndFreeMultipleLoops(t *testing.T) {
 		}
 		t.Logf("Allocated VM1: %s %s", vm1.Machine(), vm1.Group())
 
-		vm2, err := vmCompose.AllocateVMContext("group2")
+		vm2, err := vmCompose.AllocateVMContext(context.Background(), "group2")
 		if err != nil {
 			t.Fatalf("Failed to allocate VM2: %v", err)
 			return
@@ -480,3 +487,624 @@ func TestVMComposeAllocateAndFreeMultipleLoops(t *testing.T) {
 	}
 
 }
+
+func TestVMComposeConcurrentAllocateAndFree(t *testing.T) {
+	vmInfoMap := map[string]config.VMInfoConfig{}
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("vm%d", i)
+		vmInfoMap[name] = config.VMInfoConfig{
+			Name:     name,
+			Snapshot: "snapshot",
+			IP:       "127.0.0.1",
+			OS:       "linux",
+			Group:    "group1",
+		}
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec:     10,
+		TimeoutSec:      30,
+		MaxVMOperations: 3,
+	}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+		return
+	}
+	var (
+		wg      sync.WaitGroup
+		inUse   sync.Map
+		current int32
+	)
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				vm, err := vmCompose.AllocateVMContext(context.Background(), "group1")
+				if err != nil {
+					t.Errorf("Failed to allocate VM: %v", err)
+					return
+				}
+				if vm == nil {
+					continue
+				}
+				if n := atomic.AddInt32(&current, 1); n > int32(vmPolicy.MaxVMOperations) {
+					t.Errorf("Allocated %d VMs, exceeding the limit %d", n, vmPolicy.MaxVMOperations)
+				}
+				if _, loaded := inUse.LoadOrStore(vm.Machine(), true); loaded {
+					t.Errorf("VM %s is allocated twice", vm.Machine())
+				}
+				inUse.Delete(vm.Machine())
+				atomic.AddInt32(&current, -1)
+				if err := vmCompose.FreeVMContext(vm); err != nil {
+					t.Errorf("Failed to free VM: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestVMComposeAllocateWaitFIFO(t *testing.T) {
+	vmInfoMap := map[string]config.VMInfoConfig{
+		"vm1": {
+			Name:     "vm1",
+			Snapshot: "snapshot1",
+			IP:       "127.0.0.1",
+			OS:       "linux",
+			Group:    "group1",
+		},
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec:     10,
+		TimeoutSec:      30,
+		MaxVMOperations: 1,
+	}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	vm1, err := vmCompose.AllocateVMContextWait(context.Background(), "group1")
+	if err != nil || vm1 == nil {
+		t.Fatalf("Failed to allocate VM1: %v", err)
+	}
+	// queue the waiters one by one, so that their order is known
+	const numWaiters = 3
+	served := make(chan int, numWaiters)
+	for i := 0; i < numWaiters; i++ {
+		go func(idx int) {
+			vm, err := vmCompose.AllocateVMContextWait(context.Background(), "group1")
+			if err != nil {
+				t.Errorf("Waiter %d failed: %v", idx, err)
+				return
+			}
+			served <- idx
+			if err := vmCompose.FreeVMContext(vm); err != nil {
+				t.Errorf("Waiter %d failed to free: %v", idx, err)
+			}
+		}(i)
+		time.Sleep(50 * time.Millisecond)
+	}
+	// a non-waiting allocation does not overtake the waiters
+	if out, err := vmCompose.AllocateVMContext(context.Background(), "group1"); out != nil || err != nil {
+		t.Fatalf("Expected no VM to be allocated while waiters are queued, got %v %v", out, err)
+	}
+	if err := vmCompose.FreeVMContext(vm1); err != nil {
+		t.Fatalf("Failed to free VM1: %v", err)
+	}
+	for i := 0; i < numWaiters; i++ {
+		select {
+		case idx := <-served:
+			if idx != i {
+				t.Errorf("Expected waiter %d to be served, got %d", i, idx)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Waiter %d is not served", i)
+		}
+	}
+}
+
+func TestVMComposeAllocateWaitCanceled(t *testing.T) {
+	vmInfoMap := map[string]config.VMInfoConfig{
+		"vm1": {
+			Name:     "vm1",
+			Snapshot: "snapshot1",
+			IP:       "127.0.0.1",
+			OS:       "linux",
+			Group:    "group1",
+		},
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec:     10,
+		TimeoutSec:      30,
+		MaxVMOperations: 1,
+	}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	vm1, err := vmCompose.AllocateVMContextWait(context.Background(), "group1")
+	if err != nil || vm1 == nil {
+		t.Fatalf("Failed to allocate VM1: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	out, err := vmCompose.AllocateVMContextWait(ctx, "group1")
+	if out != nil || !berror.Is(err, berror.Timeout) {
+		t.Fatalf("Expected timeout error, got %v %v", out, err)
+	}
+	// the canceled waiter has left the queue, so the VM goes back to the pool
+	if err := vmCompose.FreeVMContext(vm1); err != nil {
+		t.Fatalf("Failed to free VM1: %v", err)
+	}
+	if out, err := vmCompose.AllocateVMContext(context.Background(), "group1"); out == nil || err != nil {
+		t.Fatalf("Expected VM1 to be allocated, got %v %v", out, err)
+	}
+}
+
+func TestVMComposeAllocateWaitMaxVMOperations(t *testing.T) {
+	vmInfoMap := map[string]config.VMInfoConfig{
+		"vm1": {
+			Name:     "vm1",
+			Snapshot: "snapshot1",
+			IP:       "127.0.0.1",
+			OS:       "linux",
+			Group:    "group1",
+		},
+		"vm2": {
+			Name:     "vm2",
+			Snapshot: "snapshot2",
+			IP:       "127.0.0.2",
+			OS:       "linux",
+			Group:    "group2",
+		},
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec:     10,
+		TimeoutSec:      30,
+		MaxVMOperations: 1,
+	}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	vm1, err := vmCompose.AllocateVMContextWait(context.Background(), "group1")
+	if err != nil || vm1 == nil {
+		t.Fatalf("Failed to allocate VM1: %v", err)
+	}
+	// group2 has a free VM, but the maximum number of VM operations is reached
+	served := make(chan *vmcontroller.VMContext, 1)
+	go func() {
+		vm, err := vmCompose.AllocateVMContextWait(context.Background(), "group2")
+		if err != nil {
+			t.Errorf("Waiter failed: %v", err)
+		}
+		served <- vm
+	}()
+	select {
+	case <-served:
+		t.Fatal("Waiter is served while the maximum number of VM operations is reached")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := vmCompose.FreeVMContext(vm1); err != nil {
+		t.Fatalf("Failed to free VM1: %v", err)
+	}
+	select {
+	case vm := <-served:
+		if vm == nil || vm.Machine() != "vm2" {
+			t.Fatalf("Expected vm2 to be served, got %v", vm)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiter is not served after the VM operation slot is freed")
+	}
+}
+
+func TestVMComposeSpreadAcrossHosts(t *testing.T) {
+	vmInfoMap := make(map[string]config.VMInfoConfig)
+	for i := 1; i <= 4; i++ {
+		name := fmt.Sprintf("vm%d", i)
+		vmInfoMap[name] = config.VMInfoConfig{
+			Name:     name,
+			Snapshot: "snapshot1",
+			IP:       fmt.Sprintf("127.0.0.%d", i),
+			OS:       "linux",
+			Group:    "group1",
+			// vm1 and vm3 are on hv1, vm2 and vm4 are on hv2
+			Host: fmt.Sprintf("hv%d", 2-i%2),
+		}
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec:     10,
+		TimeoutSec:      30,
+		MaxVMOperations: 4,
+	}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	allocate := func() *vmcontroller.VMContext {
+		t.Helper()
+		vm, err := vmCompose.AllocateVMContext(context.Background(), "group1")
+		if err != nil || vm == nil {
+			t.Fatalf("Failed to allocate VM: %v %v", vm, err)
+		}
+		return vm
+	}
+	first, second := allocate(), allocate()
+	if first.Host() == second.Host() {
+		t.Errorf("Expected the allocations to be spread across the hosts, got both on %s", first.Host())
+	}
+	third, fourth := allocate(), allocate()
+	if third.Host() == fourth.Host() {
+		t.Errorf("Expected the allocations to be spread across the hosts, got both on %s", third.Host())
+	}
+	// the freed VM is on the only host with a free slot
+	if err := vmCompose.FreeVMContext(first); err != nil {
+		t.Fatalf("Failed to free VM: %v", err)
+	}
+	if vm := allocate(); vm.Host() != first.Host() {
+		t.Errorf("Expected a VM on %s, got %s on %s", first.Host(), vm.Machine(), vm.Host())
+	}
+}
+
+func newQuarantineTestCompose(t *testing.T, quarantineSec uint) vmcontroller.VMCompose {
+	t.Helper()
+	vmInfoMap := map[string]config.VMInfoConfig{
+		"vm1": {
+			Name:     "vm1",
+			Snapshot: "snapshot1",
+			IP:       "127.0.0.1",
+			OS:       "linux",
+			Group:    "group1",
+		},
+		"vm2": {
+			Name:     "vm2",
+			Snapshot: "snapshot2",
+			IP:       "127.0.0.2",
+			OS:       "linux",
+			Group:    "group1",
+		},
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec:         10,
+		TimeoutSec:          30,
+		MaxVMOperations:     2,
+		QuarantineThreshold: 2,
+		QuarantineSec:       quarantineSec,
+	}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	return vmCompose
+}
+
+func TestVMComposeQuarantine(t *testing.T) {
+	vmCompose := newQuarantineTestCompose(t, 0)
+	vm, err := vmCompose.AllocateVMContext(context.Background(), "group1")
+	if err != nil || vm == nil {
+		t.Fatalf("Failed to allocate VM: %v %v", vm, err)
+	}
+	// a success resets the consecutive failures
+	vmCompose.ReportResult(vm, true)
+	vmCompose.ReportResult(vm, false)
+	vmCompose.ReportResult(vm, true)
+	if err := vmCompose.FreeVMContext(vm); err != nil {
+		t.Fatalf("Failed to free VM: %v", err)
+	}
+	if quarantined := vmCompose.Quarantined(); len(quarantined) != 0 {
+		t.Fatalf("Expected no quarantined VM, got %v", quarantined)
+	}
+
+	vm, _ = vmCompose.AllocateVMContext(context.Background(), "group1")
+	vmCompose.ReportResult(vm, true)
+	vmCompose.ReportResult(vm, true)
+	// the allocated VM is quarantined when it is freed
+	if quarantined := vmCompose.Quarantined(); len(quarantined) != 0 {
+		t.Fatalf("Expected the allocated VM not to be quarantined yet, got %v", quarantined)
+	}
+	if err := vmCompose.FreeVMContext(vm); err != nil {
+		t.Fatalf("Failed to free VM: %v", err)
+	}
+	quarantined := vmCompose.Quarantined()
+	if len(quarantined) != 1 || quarantined[0].VM != vm || quarantined[0].Failures != 2 || !quarantined[0].Until.IsZero() {
+		t.Fatalf("Expected %s to be quarantined without a release time, got %+v", vm.Machine(), quarantined)
+	}
+	// only the other VM is allocated
+	other, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	if other == nil || other == vm {
+		t.Fatalf("Expected the other VM to be allocated, got %v", other)
+	}
+	if next, _ := vmCompose.AllocateVMContext(context.Background(), "group1"); next != nil {
+		t.Fatalf("Expected the quarantined VM not to be allocated, got %s", next.Machine())
+	}
+	if len(vmCompose.VMContexts()) != 2 {
+		t.Errorf("Expected VMContexts to include the quarantined VM")
+	}
+
+	if err := vmCompose.Unquarantine("group1", other.Machine()); !berror.Is(err, berror.InvalidArgument) {
+		t.Errorf("Expected InvalidArgument error for a VM not quarantined, got %v", err)
+	}
+	if err := vmCompose.Unquarantine("group1", vm.Machine()); err != nil {
+		t.Fatalf("Unquarantine failed: %v", err)
+	}
+	if next, _ := vmCompose.AllocateVMContext(context.Background(), "group1"); next != vm {
+		t.Errorf("Expected the released VM to be allocated, got %v", next)
+	}
+}
+
+func TestVMComposeQuarantineFreeVM(t *testing.T) {
+	vmCompose := newQuarantineTestCompose(t, 0)
+	// the failures of a free VM, e.g. reported by the reconciler, quarantine it at once
+	vm := vmCompose.VMContexts()[0]
+	vmCompose.ReportResult(vm, true)
+	vmCompose.ReportResult(vm, true)
+	if quarantined := vmCompose.Quarantined(); len(quarantined) != 1 || quarantined[0].VM != vm {
+		t.Fatalf("Expected %s to be quarantined, got %+v", vm.Machine(), quarantined)
+	}
+}
+
+func TestVMComposeQuarantineTimed(t *testing.T) {
+	vmCompose := newQuarantineTestCompose(t, 1)
+	vm1, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	vm2, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	vmCompose.ReportResult(vm1, true)
+	vmCompose.ReportResult(vm1, true)
+	if err := vmCompose.FreeVMContext(vm1); err != nil {
+		t.Fatalf("Failed to free VM: %v", err)
+	}
+	if quarantined := vmCompose.Quarantined(); len(quarantined) != 1 || quarantined[0].Until.Sub(quarantined[0].Since) != time.Second {
+		t.Fatalf("Expected %s to be quarantined for a second, got %+v", vm1.Machine(), quarantined)
+	}
+	// the waiter is served when the quarantine is over
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	vm, err := vmCompose.AllocateVMContextWait(ctx, "group1")
+	if err != nil || vm != vm1 {
+		t.Fatalf("Expected the released VM to be handed to the waiter, got %v %v", vm, err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Expected the waiter to wait for the quarantine, got %v", elapsed)
+	}
+	if err := vmCompose.FreeVMContext(vm2); err != nil {
+		t.Fatalf("Failed to free VM: %v", err)
+	}
+}
+
+func TestVMComposeQuarantineAllocatedVM(t *testing.T) {
+	vmCompose := newQuarantineTestCompose(t, 0)
+	vm1, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	vm2, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	if vm1 == nil || vm2 == nil {
+		t.Fatalf("Failed to allocate VMs: %v %v", vm1, vm2)
+	}
+	// the allocated VM is quarantined at once, without failures
+	if err := vmCompose.Quarantine(vm1); err != nil {
+		t.Fatalf("Quarantine failed: %v", err)
+	}
+	if quarantined := vmCompose.Quarantined(); len(quarantined) != 1 || quarantined[0].VM != vm1 {
+		t.Fatalf("Expected %s to be quarantined, got %+v", vm1.Machine(), quarantined)
+	}
+	if err := vmCompose.Unquarantine("group1", vm1.Machine()); err != nil {
+		t.Fatalf("Unquarantine failed: %v", err)
+	}
+	// the VM operation slot of the quarantined VM is given back
+	if vm, err := vmCompose.AllocateVMContext(context.Background(), "group1"); vm != vm1 {
+		t.Fatalf("Expected the released VM to be allocated, got %v %v", vm, err)
+	}
+	vmCompose.FreeVMContext(vm1)
+	vmCompose.FreeVMContext(vm2)
+}
+
+func TestVMComposeQuarantineUntimed(t *testing.T) {
+	vmCompose := newQuarantineTestCompose(t, 1)
+	vm1, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	if vm1 == nil {
+		t.Fatal("Failed to allocate VM")
+	}
+	// the quarantine duration does not release a VM quarantined at once, e.g. after its reset failed
+	if err := vmCompose.Quarantine(vm1); err != nil {
+		t.Fatalf("Quarantine failed: %v", err)
+	}
+	quarantined := vmCompose.Quarantined()
+	if len(quarantined) != 1 || !quarantined[0].Until.IsZero() {
+		t.Fatalf("Expected %s to be quarantined until it is released, got %+v", vm1.Machine(), quarantined)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if quarantined := vmCompose.Quarantined(); len(quarantined) != 1 || quarantined[0].VM != vm1 {
+		t.Fatalf("Expected %s to be kept in the quarantine, got %+v", vm1.Machine(), quarantined)
+	}
+}
+
+func TestVMComposeLease(t *testing.T) {
+	vmInfoMap := map[string]config.VMInfoConfig{
+		"vm1": {
+			Name:     "vm1",
+			Snapshot: "snapshot1",
+			IP:       "127.0.0.1",
+			OS:       "linux",
+			Group:    "group1",
+		},
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		MaxVMOperations: 1,
+		LeaseSec:        60,
+	}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	vm, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	if vm == nil {
+		t.Fatal("Failed to allocate VM")
+	}
+	expiry, leased := vmCompose.Lease(vm)
+	if !leased || time.Until(expiry) <= 0 {
+		t.Fatalf("Expected the allocated VM to hold a lease, got %v %v", expiry, leased)
+	}
+	renewed, err := vmCompose.Renew(vm)
+	if err != nil || renewed.Before(expiry) {
+		t.Fatalf("Expected the lease to be extended, got %v %v", renewed, err)
+	}
+	if expired := vmCompose.Expire(time.Now()); len(expired) != 0 {
+		t.Fatalf("Expected no expired lease, got %v", expired)
+	}
+	// the expired VM stays allocated until it is reclaimed, but cannot be renewed
+	if expired := vmCompose.Expire(renewed); len(expired) != 1 || expired[0] != vm {
+		t.Fatalf("Expected the lease of %s to expire, got %v", vm.Machine(), expired)
+	}
+	if _, err := vmCompose.Renew(vm); !berror.Is(err, berror.LeaseExpired) {
+		t.Errorf("Expected LeaseExpired error, got %v", err)
+	}
+	if next, _ := vmCompose.AllocateVMContext(context.Background(), "group1"); next != nil {
+		t.Fatalf("Expected the expired VM to stay allocated, got %s", next.Machine())
+	}
+	if err := vmCompose.FreeVMContext(vm); err != nil {
+		t.Fatalf("Failed to free VM: %v", err)
+	}
+	if _, err := vmCompose.Renew(vm); !berror.Is(err, berror.InvalidArgument) {
+		t.Errorf("Expected InvalidArgument error for a free VM, got %v", err)
+	}
+	// the next holder gets a new lease
+	vm, _ = vmCompose.AllocateVMContext(context.Background(), "group1")
+	if _, leased := vmCompose.Lease(vm); !leased {
+		t.Errorf("Expected the allocated VM to hold a new lease")
+	}
+}
+
+func TestVMComposeAllocateSelector(t *testing.T) {
+	vmInfoMap := map[string]config.VMInfoConfig{
+		"win10": {
+			Name: "win10", Snapshot: "snapshot0", IP: "127.0.0.1", OS: "windows", Group: "desktop",
+			Labels: map[string]string{"version": "10", "office": "2019"},
+		},
+		"win11": {
+			Name: "win11", Snapshot: "snapshot0", IP: "127.0.0.2", OS: "windows", Group: "desktop",
+			Labels: map[string]string{"version": "11"},
+		},
+		"ubuntu": {
+			Name: "ubuntu", Snapshot: "snapshot0", IP: "127.0.0.3", OS: "linux", Group: "server",
+		},
+	}
+	vmPolicy := config.VMControlPolicyConfig{MaxVMOperations: 3}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	allocate := func(expr string) *vmcontroller.VMContext {
+		t.Helper()
+		selector, err := config.ParseSelector(expr)
+		if err != nil {
+			t.Fatalf("ParseSelector failed: %v", err)
+		}
+		vm, err := vmCompose.AllocateVMContextSelector(context.Background(), selector)
+		if err != nil {
+			t.Fatalf("AllocateVMContextSelector(%q) failed: %v", expr, err)
+		}
+		return vm
+	}
+	if vm := allocate("os=windows, office"); vm == nil || vm.Machine() != "win10" {
+		t.Fatalf("Expected win10 to be allocated, got %v", vm)
+	}
+	// the only matching VM is allocated
+	if vm := allocate("office"); vm != nil {
+		t.Fatalf("Expected no VM to be allocated, got %s", vm.Machine())
+	}
+	if vm := allocate("version in (10, 11)"); vm == nil || vm.Machine() != "win11" {
+		t.Fatalf("Expected win11 to be allocated, got %v", vm)
+	}
+	// a selector without a required value matches every free VM across the groups
+	vm := allocate("!version")
+	if vm == nil || vm.Machine() != "ubuntu" || vm.Group() != "server" {
+		t.Fatalf("Expected ubuntu to be allocated, got %v", vm)
+	}
+	if err := vmCompose.FreeVMContext(vm); err != nil {
+		t.Fatalf("Failed to free VM: %v", err)
+	}
+	if vm := allocate(""); vm == nil || vm.Machine() != "ubuntu" {
+		t.Fatalf("Expected the freed ubuntu to be allocated, got %v", vm)
+	}
+}
+
+func TestVMComposeQuarantineTimedError(t *testing.T) {
+	vmController := newStatusTestController()
+	vmPolicy := config.VMControlPolicyConfig{MaxVMOperations: 1, QuarantineThreshold: 1, QuarantineSec: 1}
+	vmCompose, err := vmcontroller.NewVMCompose(map[string]config.VMInfoConfig{
+		"vm1": newStatusTestVMInfo("crashed"),
+	}, &vmPolicy)
+	if err != nil {
+		t.Fatalf("NewVMCompose failed: %v", err)
+	}
+	vm := vmCompose.VMContexts()[0]
+	if change, err := vmController.Refresh(context.Background(), vm); err != nil || change.New != vmstate.ERROR {
+		t.Fatalf("Expected the VM to be in error, got %+v %v", change, err)
+	}
+	vmCompose.ReportResult(vm, true)
+	// the VM still in error is not released when the quarantine is over
+	time.Sleep(1200 * time.Millisecond)
+	quarantined := vmCompose.Quarantined()
+	if len(quarantined) != 1 || !quarantined[0].Until.After(time.Now()) {
+		t.Fatalf("Expected the quarantine of the VM in error to be extended, got %+v", quarantined)
+	}
+	if _, err := vmController.RecoverVM(context.Background(), vm); err != nil {
+		t.Fatalf("RecoverVM failed: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if out, err := vmCompose.AllocateVMContextWait(ctx, "testGroup"); err != nil || out != vm {
+		t.Fatalf("Expected the recovered VM to be released, got %v %v", out, err)
+	}
+}
+
+func TestVMComposeReapConcurrent(t *testing.T) {
+	vmInfoMap := map[string]config.VMInfoConfig{
+		"vm1": {Name: "vm1", Snapshot: "snapshot1", IP: "127.0.0.1", OS: "linux", Group: "group1"},
+		"vm2": {Name: "vm2", Snapshot: "snapshot2", IP: "127.0.0.2", OS: "linux", Group: "group1"},
+	}
+	vmPolicy := config.VMControlPolicyConfig{MaxVMOperations: 2, LeaseSec: 1}
+	vmCompose, err := vmcontroller.NewVMCompose(vmInfoMap, &vmPolicy)
+	if err != nil {
+		t.Fatalf("Failed to create VMCompose: %v", err)
+	}
+	vm1, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	vm2, _ := vmCompose.AllocateVMContext(context.Background(), "group1")
+	if vm1 == nil || vm2 == nil {
+		t.Fatalf("Failed to allocate VMs: %v %v", vm1, vm2)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	blocked := make(chan struct{})
+	reclaimed := make(chan *vmcontroller.VMContext, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vmCompose.Reap(ctx, 10*time.Millisecond, func(vm *vmcontroller.VMContext) {
+			// the reset of vm1 hangs until the reaper is stopped
+			if vm == vm1 {
+				<-blocked
+			}
+			vmCompose.FreeVMContext(vm)
+			reclaimed <- vm
+		})
+	}()
+	select {
+	case vm := <-reclaimed:
+		if vm != vm2 {
+			t.Errorf("Expected %s to be reclaimed, got %s", vm2.Machine(), vm.Machine())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected vm2 to be reclaimed while the reclaim of vm1 hangs")
+	}
+	cancel()
+	select {
+	case <-done:
+		t.Fatal("Expected Reap to wait for the running reclaim")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(blocked)
+	<-done
+	if vm := <-reclaimed; vm != vm1 {
+		t.Errorf("Expected %s to be reclaimed, got %s", vm1.Machine(), vm.Machine())
+	}
+}
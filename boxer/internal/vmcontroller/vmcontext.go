@@ -1,13 +1,26 @@
 package vmcontroller
 
 import (
+	"context"
+	"sync"
+
 	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
 	"github.com/hongsam14/boxer/vmstate"
 )
 
+// VMContext holds the information and the state of a VM.
+// The information is immutable, and the state is guarded by a mutex,
+// so a VMContext is safe for concurrent use by multiple goroutines.
 type VMContext struct {
-	info  config.VMInfoConfig
-	state vmstate.VMState
+	info config.VMInfoConfig
+	// labels are the labels of the VM including the standard labels, computed once from the info
+	labels   map[string]string
+	stateMux sync.RWMutex
+	state    vmstate.VMState
+	// opMux is held while a control command runs on the VM, so the commands on the VM are serialized.
+	// it is a channel instead of sync.Mutex so that waiting for it can be canceled.
+	opMux chan struct{}
 }
 
 // Machine returns the name of the VM.
@@ -35,20 +48,65 @@ func (vc *VMContext) Group() string {
 	return vc.info.Group
 }
 
+// Labels returns a copy of the labels of the VM, including the standard labels os and group.
+func (vc *VMContext) Labels() map[string]string {
+	labels := make(map[string]string, len(vc.labels))
+	for key, value := range vc.labels {
+		labels[key] = value
+	}
+	return labels
+}
+
+// Host returns the name of the hypervisor host of the VM, empty for the boxer host.
+func (vc *VMContext) Host() string {
+	return vc.info.Host
+}
+
+// Policy returns the VM control policy of the VM.
+func (vc *VMContext) Policy() config.VMControlPolicyConfig {
+	return vc.info.VMControlPolicy
+}
+
 // State returns the current state of the VM.
 func (vc *VMContext) State() vmstate.VMState {
+	vc.stateMux.RLock()
+	defer vc.stateMux.RUnlock()
 	return vc.state
 }
 
 // SetState sets the current state of the VM.
 func (vc *VMContext) setState(state vmstate.VMState) {
+	vc.stateMux.Lock()
+	defer vc.stateMux.Unlock()
 	vc.state = state
 }
 
+// lockOperation waits until no control command runs on the VM and holds the VM for a command.
+// It returns berror.Canceled or berror.Timeout if ctx is done first.
+func (vc *VMContext) lockOperation(ctx context.Context) error {
+	select {
+	case vc.opMux <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return berror.BoxerError{
+			Code:   berror.ContextErrorCode(ctx.Err()),
+			Msg:    "error while VMContext.lockOperation",
+			Origin: ctx.Err(),
+		}
+	}
+}
+
+// unlockOperation releases the VM held by lockOperation.
+func (vc *VMContext) unlockOperation() {
+	<-vc.opMux
+}
+
 // NewVMContext creates a new VMContext with the provided VMInfoConfig.
 func NewVMContext(info config.VMInfoConfig) *VMContext {
 	return &VMContext{
-		info:  info,
-		state: vmstate.STOPPED, // Default state is STOPPED
+		info:   info,
+		labels: info.LabelSet(),
+		state:  vmstate.STOPPED, // Default state is STOPPED
+		opMux:  make(chan struct{}, 1),
 	}
 }
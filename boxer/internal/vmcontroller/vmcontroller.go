@@ -1,9 +1,13 @@
 package vmcontroller
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
-	"strings"
+	"time"
 
 	"github.com/hongsam14/boxer/config"
 	berror "github.com/hongsam14/boxer/error"
@@ -14,70 +18,364 @@ import (
 // VMController is an interface that defines the methods for controlling a VM.
 // It provides methods to start, stop, and restore snapshots of the VM.
 // The VMController uses a VMContext to manage the state and information of the VM.
+//
+// A VMController is safe for concurrent use by multiple goroutines.
+// The control commands on the same VM are serialized, and the state of the VMContext
+// is checked again after the VM is locked, so conflicting operations on the same VM are rejected.
+// Each hypervisor host runs at most its MaxOperations commands in parallel, and all the hosts together
+// run at most MaxCommands commands of the policy if it is set.
+// The VMs without a host share the boxer host, which runs MaxCommands commands in parallel,
+// or one command at a time if MaxCommands is not set.
+// The interval pads the slot of the host, or the VM itself if the Padding of the policy is machine.
+// The start, stop and restore snapshot commands also wait for the RateLimit of the policy,
+// before they lock the VM and take the slots.
+//
+// Every method takes a context.Context. When the context is canceled or its deadline expires,
+// the running control command is killed and the locks are released.
+//
+// Every method returns the CommandResult of the control command with the captured stdout and stderr.
+// The CommandResult is also attached to the returned error, see berror.ResultOf.
 type VMController interface {
 	// StartVM starts the VM with the given context.
-	StartVM(vctx *VMContext) error
+	StartVM(ctx context.Context, vctx *VMContext) (*berror.CommandResult, error)
 	// StopVM stops the VM with the given context.
-	StopVM(vctx *VMContext) error
+	StopVM(ctx context.Context, vctx *VMContext) (*berror.CommandResult, error)
 	// RestoreSnapshot restores the snapshot of the VM with the given context.
-	RestoreSnapshot(vctx *VMContext) error
+	RestoreSnapshot(ctx context.Context, vctx *VMContext) (*berror.CommandResult, error)
+	// RecoverVM brings the VM back to the stopped state from any state, e.g. from the error state,
+	// by hard-stopping it and restoring its snapshot.
+	RecoverVM(ctx context.Context, vctx *VMContext) (*berror.CommandResult, error)
+	// Refresh probes the actual state of the VM with the status command
+	// and corrects the state of the VMContext if it differs.
+	Refresh(ctx context.Context, vctx *VMContext) (StateChange, error)
 }
 
 type vmController struct {
 	vmControl *config.VMControlConfig
 	vmPolicy  *config.VMControlPolicyConfig
-	mux       *exec.PaddedMutex
+	hosts     map[string]config.HostConfig
+	// hostMux limits the commands run in parallel on each host, keyed by the host name.
+	// the VMs without a host use the semaphore of the empty host name.
+	hostMux map[string]*exec.PaddedSemaphore
+	// commandMux limits the commands run in parallel on all the hosts. it is nil if there is no limit.
+	commandMux *exec.PaddedSemaphore
+	// startLimiter, stopLimiter and restoreLimiter limit the rate of each kind of command.
+	// they are nil if there is no limit.
+	startLimiter, stopLimiter, restoreLimiter *exec.RateLimiter
 
-	fdin  *os.File // file descriptor for stdin, used for executing commands
-	fdout *os.File // file descriptor for stdout, used for executing commands
+	executor exec.Executor // executor runs the control commands of the VMs on the boxer host
+	// hostExecutors run the control commands of the VMs on the remote hosts, keyed by the host name
+	hostExecutors map[string]exec.Executor
+	fdout         *os.File // file descriptor for stdout, the output of the commands is copied to it if it is not nil
 }
 
-// NewVMController creates a new VMController with the given VMControlConfig.
+// NewVMController creates a new VMController with the given Executor and VMControlConfig.
+// The control commands are run by the executor. A nil executor runs them as local subprocesses
+// reading os.Stdin, see exec.NewProcessExecutor.
+// The commands of a VM on a remote host in hosts are run on that host with ssh instead, see exec.NewSSHExecutor.
+// The given VMControlConfig and VMControlPolicyConfig are the defaults, which are overridden
+// per VM by the VMControl and VMControlPolicy of the VMInfoConfig (see config.BoxerConfig.ResolveVMInfo).
 // The VMController is responsible for executing the commands and managing the state of the VM.
 // It uses the VMControlConfig to execute commands for starting, stopping, and restoring snapshots of the VM.
-// It initializes the padded mutex to prevent concurrent execution of VM control commands.
+// It initializes a padded semaphore per host, and a global one if MaxCommands of vmPolicy is set,
+// to limit the parallel execution of VM control commands, and a rate limiter per kind of command
+// if the RateLimit of vmPolicy is set. The rate limiters tell the time by clock, a nil clock is exec.SystemClock.
+// The stdout and stderr of the commands are always captured. If fdout is not nil,
+// the output of the start, stop and restore snapshot commands is also written to fdout and os.Stderr.
 // It also uses the VMContext to manage the state and information of the VM.
 func NewVMController(
-	fdin *os.File,
+	executor exec.Executor,
 	fdout *os.File,
 	vmControlConfig *config.VMControlConfig,
-	vmPolicy *config.VMControlPolicyConfig) VMController {
+	vmPolicy *config.VMControlPolicyConfig,
+	hosts map[string]config.HostConfig,
+	clock exec.Clock) VMController {
 
-	return &vmController{
-		fdin:      fdin,
-		fdout:     fdout,
-		vmControl: vmControlConfig,
-		vmPolicy:  vmPolicy,
-		mux:       exec.InitPaddedMutex(vmPolicy.IntervalSec),
+	if executor == nil {
+		executor = exec.NewProcessExecutor(os.Stdin)
+	}
+	hostExecutors := make(map[string]exec.Executor)
+	// the boxer host has no max_operations of its own, so it is limited by MaxCommands
+	localMaxOperations := uint(1)
+	if vmPolicy != nil && vmPolicy.MaxCommands != 0 {
+		localMaxOperations = vmPolicy.MaxCommands
+	}
+	hostMux := map[string]*exec.PaddedSemaphore{
+		"": exec.InitPaddedSemaphore(localMaxOperations),
+	}
+	for hostName, host := range hosts {
+		if host.IsRemote() {
+			hostExecutors[hostName] = exec.NewSSHExecutor(sshTarget(&host))
+		}
+		hostMux[hostName] = exec.InitPaddedSemaphore(host.MaxOperations)
+	}
+	newController := &vmController{
+		executor:      executor,
+		hostExecutors: hostExecutors,
+		fdout:         fdout,
+		vmControl:     vmControlConfig,
+		vmPolicy:      vmPolicy,
+		hosts:         hosts,
+		hostMux:       hostMux,
+	}
+	if vmPolicy != nil {
+		if vmPolicy.MaxCommands != 0 {
+			newController.commandMux = exec.InitPaddedSemaphore(vmPolicy.MaxCommands)
+		}
+		rateLimit := &vmPolicy.RateLimit
+		newController.startLimiter = exec.NewRateLimiter(rateLimit.Start.PerMinute, rateLimit.Start.Burst, clock)
+		newController.stopLimiter = exec.NewRateLimiter(rateLimit.Stop.PerMinute, rateLimit.Stop.Burst, clock)
+		newController.restoreLimiter = exec.NewRateLimiter(rateLimit.Restore.PerMinute, rateLimit.Restore.Burst, clock)
+	}
+	return newController
+}
+
+// sshTarget returns the exec.SSHTarget of the remote host.
+func sshTarget(host *config.HostConfig) exec.SSHTarget {
+	connectTimeout := host.ConnectTimeoutSec
+	if connectTimeout == 0 {
+		connectTimeout = config.DEFAULT_SSH_CONNECT_TIMEOUT_SEC
+	}
+	return exec.SSHTarget{
+		Host:           host.Address,
+		Port:           host.Port,
+		User:           host.User,
+		KeyPath:        host.KeyPath,
+		KnownHosts:     host.KnownHosts,
+		ConnectTimeout: time.Duration(connectTimeout) * time.Second,
 	}
 }
 
-// replaceReservedKeyword replaces the reserved keywords in the command with the actual values from the VMContext.
-// It replaces the $machine keyword with the name of the VM and the $snapshot keyword with the name of the snapshot.
-func (vc *vmController) replaceReservedKeyword(command string, vctx *VMContext) (argvs []string) {
+// executorOf returns the Executor running the control commands of the VM.
+func (vc *vmController) executorOf(vctx *VMContext) exec.Executor {
+	if executor, exists := vc.hostExecutors[vctx.Host()]; exists {
+		return executor
+	}
+	return vc.executor
+}
+
+// replaceReservedKeyword splits the command into arguments and replaces the reserved keywords
+// with the actual values from the VMContext.
+// It replaces the $machine keyword with the name of the VM, the $snapshot keyword with the name of the snapshot,
+// $ip, $os and $group with the other fields of the VM, and $name with the user-defined variable of the VM.
+// The keywords are replaced after the command is split, so each value stays a single argument.
+func (vc *vmController) replaceReservedKeyword(command string, vctx *VMContext) (argvs []string, err error) {
 	if vctx == nil {
-		return nil
+		return nil, nil
 	}
 	if command == "" {
-		return nil
+		return nil, nil
 	}
 	// split command first, and then replace the reserved keywords
-	sourceArgvs := strings.Split(command, " ")
-	// replace reserved keywords in the command
-	retArgvs := make([]string, len(sourceArgvs))
-	for i, arg := range sourceArgvs {
-		retArgvs[i] = strings.ReplaceAll(arg, config.MACHINE_KEYWORD, fmt.Sprintf("%s", vctx.Machine()))
-		retArgvs[i] = strings.ReplaceAll(retArgvs[i], config.SNAPSHOT_KEYWORD, fmt.Sprintf("%s", vctx.Snapshot()))
-	}
-	return retArgvs
+	parsed, err := config.ParseCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	return parsed.Expand(vctx.info.PlaceholderValues()), nil
+}
+
+// resolveControl returns the effective VMControlConfig of the VM.
+// The commands of the controller are overridden by the non-empty commands of the VM.
+func (vc *vmController) resolveControl(vctx *VMContext) config.VMControlConfig {
+	return vc.vmControl.Merge(&vctx.info.VMControl)
+}
+
+// resolvePolicy returns the effective VMControlPolicyConfig of the VM.
+// The policy of the controller is overridden by the non-zero fields of the host of the VM,
+// which are overridden by the non-zero fields of the VM.
+func (vc *vmController) resolvePolicy(vctx *VMContext) config.VMControlPolicyConfig {
+	host := vc.hosts[vctx.Host()]
+	policy := vc.vmPolicy.Merge(&host.VMControlPolicy)
+	return policy.Merge(&vctx.info.VMControlPolicy)
+}
+
+// commandLock is the lock of a VM and the slots of its host and of all the hosts, taken by lock for a control command.
+type commandLock struct {
+	vctx       *VMContext
+	padding    string
+	hostMux    *exec.PaddedSemaphore
+	commandMux *exec.PaddedSemaphore // commandMux is nil if there is no global limit
+	// slotsHeld tells if the slots are held, they are given up while a command waits to be retried
+	slotsHeld bool
+}
+
+// lock locks the VM and takes a slot of its host and a global slot, waiting until all are available or ctx is done.
+// The returned commandLock releases them with unlock.
+func (vc *vmController) lock(ctx context.Context, vctx *VMContext, padding string) (*commandLock, error) {
+	hostMux, exists := vc.hostMux[vctx.Host()]
+	if !exists {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.lock",
+			Origin: fmt.Errorf("VM %s references an unknown host %s", vctx.Machine(), vctx.Host()),
+		}
+	}
+	// the locks are always taken in the same order, VM, host and global, so they cannot deadlock
+	if err := vctx.lockOperation(ctx); err != nil {
+		return nil, err
+	}
+	held := &commandLock{vctx: vctx, padding: padding, hostMux: hostMux, commandMux: vc.commandMux}
+	if err := held.acquireSlots(ctx); err != nil {
+		vctx.unlockOperation()
+		return nil, err
+	}
+	return held, nil
+}
+
+// acquireSlots takes a slot of the host and a global slot, waiting until both are available or ctx is done.
+func (l *commandLock) acquireSlots(ctx context.Context) error {
+	if err := l.hostMux.AcquireContext(ctx); err != nil {
+		return err
+	}
+	if l.commandMux != nil {
+		if err := l.commandMux.AcquireContext(ctx); err != nil {
+			l.hostMux.ReleaseWithPeriod(0)
+			return err
+		}
+	}
+	l.slotsHeld = true
+	return nil
+}
+
+// releaseSlots releases the global slot at once and the slot of the host after the given period in seconds.
+// It does nothing if the slots are not held.
+func (l *commandLock) releaseSlots(period uint) {
+	if !l.slotsHeld {
+		return
+	}
+	l.slotsHeld = false
+	if l.commandMux != nil {
+		l.commandMux.ReleaseWithPeriod(0)
+	}
+	l.hostMux.ReleaseWithPeriod(period)
+}
+
+// unlock releases the slots and the VM. The given period in seconds pads the slot of the host,
+// or the VM if padding is config.PADDING_MACHINE.
+func (l *commandLock) unlock(period uint) {
+	if l.padding != config.PADDING_MACHINE || period == 0 {
+		l.releaseSlots(period)
+		l.vctx.unlockOperation()
+		return
+	}
+	l.releaseSlots(0)
+	time.AfterFunc(time.Duration(period)*time.Second, l.vctx.unlockOperation)
+}
+
+// commandContext returns a context for a control command derived from ctx.
+// The context is bounded by the timeout of the given VMControlPolicyConfig.
+// A zero timeout means the command has no deadline other than the one of ctx.
+func (vc *vmController) commandContext(ctx context.Context, policy *config.VMControlPolicyConfig) (context.Context, context.CancelFunc) {
+	if policy.TimeoutSec == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(policy.TimeoutSec)*time.Second)
+}
+
+// commandErrorCode returns the error code to report for an error of a control command.
+// Timeouts, cancellations and connection errors are kept so that callers can distinguish them from failures.
+func commandErrorCode(err error) berror.BoxerErrorCode {
+	if berror.Is(err, berror.Timeout) {
+		return berror.Timeout
+	}
+	if berror.Is(err, berror.Canceled) {
+		return berror.Canceled
+	}
+	if berror.Is(err, berror.ConnectionError) {
+		return berror.ConnectionError
+	}
+	return berror.SystemError
+}
+
+// runCommand executes the command with the executor and waits for it to finish.
+// The stdout and stderr are captured into bounded buffers,
+// and copied to fdout and os.Stderr if tee is true and fdout is set.
+// The returned CommandResult is nil only if the command is not started.
+func (vc *vmController) runCommand(ctx context.Context, vctx *VMContext, argv []string, tee bool) (*berror.CommandResult, error) {
+	stdout := exec.NewLimitedBuffer(exec.DEFAULT_OUTPUT_LIMIT)
+	stderr := exec.NewLimitedBuffer(exec.DEFAULT_OUTPUT_LIMIT)
+	var outStream, errStream io.Writer = stdout, stderr
+	if tee && vc.fdout != nil {
+		outStream = io.MultiWriter(stdout, vc.fdout)
+		errStream = io.MultiWriter(stderr, os.Stderr)
+	}
+	start := time.Now()
+	exitCode, err := vc.executorOf(vctx).Execute(ctx, argv, outStream, errStream)
+	if errors.Is(err, exec.ErrNotStarted) {
+		return nil, err
+	}
+	return &berror.CommandResult{
+		Argv:      argv,
+		ExitCode:  exitCode,
+		Duration:  time.Since(start),
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		Truncated: stdout.Truncated() || stderr.Truncated(),
+	}, err
+}
+
+// runAttempts runs the command like runCommand, each attempt bounded by the policy timeout.
+// A command failing with a retryable exit code or stderr is run again after a backoff,
+// up to the MaxAttempts of the retry policy. The returned CommandResult is the one of the last attempt,
+// and holds the failed attempts before it. If ctx is done during a backoff, the last result is returned
+// with berror.Canceled or berror.Timeout.
+// The slots of held are given up during a backoff, so the other VMs run their commands meanwhile,
+// while the VM stays locked. They are taken again before the next attempt.
+func (vc *vmController) runAttempts(ctx context.Context, held *commandLock, argv []string, policy *config.VMControlPolicyConfig) (*berror.CommandResult, error) {
+	vctx := held.vctx
+	retry := &policy.Retry
+	var attempts []*berror.CommandResult
+	for attempt := uint(1); ; attempt++ {
+		cmdCtx, cancel := vc.commandContext(ctx, policy)
+		result, err := vc.runCommand(cmdCtx, vctx, argv, true)
+		cancel()
+		if result == nil {
+			return nil, err
+		}
+		result.Attempts = attempts
+		if err != nil || attempt >= retry.MaxAttempts {
+			return result, err
+		}
+		retryable, retryErr := retry.Retryable(result.ExitCode, result.Stderr)
+		if retryErr != nil {
+			return result, berror.BoxerError{
+				Code:   berror.InvalidConfig,
+				Msg:    "error while vmcontroller.runAttempts",
+				Origin: fmt.Errorf("failed to check whether %v is retryable: %w", argv, retryErr),
+			}
+		}
+		if !retryable {
+			return result, err
+		}
+		attempts = append(attempts, result)
+		held.releaseSlots(0)
+		select {
+		case <-time.After(retry.Backoff(attempt, rand.Float64())):
+		case <-ctx.Done():
+			return result, berror.BoxerError{
+				Code:   berror.ContextErrorCode(ctx.Err()),
+				Msg:    "error while vmcontroller.runAttempts",
+				Origin: fmt.Errorf("canceled while waiting to retry %v: %w", argv, ctx.Err()),
+			}
+		}
+		if err := held.acquireSlots(ctx); err != nil {
+			return result, berror.BoxerError{
+				Code:   commandErrorCode(err),
+				Msg:    "error while vmcontroller.runAttempts",
+				Origin: fmt.Errorf("failed to wait for the turn to retry %v: %w", argv, err),
+			}
+		}
+	}
 }
 
 // StartVM starts the VM with the given context.
 // It checks if the VM is in a stopped state before executing the start command.
+// If the command does not finish within the policy timeout, it is killed and berror.Timeout is returned.
+// If ctx is done first, the command is killed and berror.Canceled or berror.Timeout is returned.
 // It sets the VM state to OFFLINE after starting the VM.
-func (vc *vmController) StartVM(vctx *VMContext) (err error) {
+func (vc *vmController) StartVM(ctx context.Context, vctx *VMContext) (result *berror.CommandResult, err error) {
 	if vctx.State() != vmstate.STOPPED {
-		return berror.BoxerError{
+		return nil, berror.BoxerError{
 			Code:   berror.InvalidState,
 			Msg:    "error while vmcontroller.StartVM",
 			Origin: fmt.Errorf("VM is not a stopped state. current state: %s, expected: %s", vctx.State(), vmstate.STOPPED),
@@ -85,60 +383,93 @@ func (vc *vmController) StartVM(vctx *VMContext) (err error) {
 	}
 
 	// create the arguments for the start command by replacing reserved keywords
-	argv := vc.replaceReservedKeyword(vc.vmControl.StartCmd, vctx)
+	control := vc.resolveControl(vctx)
+	policy := vc.resolvePolicy(vctx)
+	argv, err := vc.replaceReservedKeyword(control.StartCmd, vctx)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.StartVM",
+			Origin: fmt.Errorf("failed to parse start command: %w", err),
+		}
+	}
 	if len(argv) == 0 {
-		return berror.BoxerError{
+		return nil, berror.BoxerError{
 			Code:   berror.InvalidArgument,
 			Msg:    "error while vmcontroller.StartVM",
-			Origin: fmt.Errorf("start command is empty after replacing reserved keywords %v", vc.vmControl.StartCmd),
+			Origin: fmt.Errorf("start command is empty after replacing reserved keywords %v", control.StartCmd),
 		}
 	}
 
-	// lock the padded mutex to prevent concurrent execution of vm control commands
-	vc.mux.Lock()
-	defer vc.mux.Release()
-
-	// Execute the start command
-	promise, err := exec.Run(vc.fdin, vc.fdout, argv[0], argv[1:]...)
+	// wait for the rate limit of the start commands before locking,
+	// so a throttled command does not hold the VM or a slot while it waits
+	if err := vc.startLimiter.Wait(ctx); err != nil {
+		return nil, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.StartVM",
+			Origin: fmt.Errorf("failed to wait for the start command rate limit: %w", err),
+		}
+	}
+	// lock the VM and its host to prevent conflicting execution of vm control commands
+	held, err := vc.lock(ctx, vctx, policy.Padding)
 	if err != nil {
-		return berror.BoxerError{
-			Code:   berror.SystemError,
+		return nil, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.StartVM",
+			Origin: fmt.Errorf("failed to wait for the start command turn: %w", err),
+		}
+	}
+	defer held.unlock(policy.IntervalSec)
+	// check the state again, because another goroutine may have changed it while waiting for the lock
+	if state := vctx.State(); state != vmstate.STOPPED {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidState,
 			Msg:    "error while vmcontroller.StartVM",
-			Origin: fmt.Errorf("failed to execute start command %v: %w", argv, err),
+			Origin: fmt.Errorf("VM state is changed while waiting for the start command turn. current state: %s, expected: %s", state, vmstate.STOPPED),
 		}
 	}
-	// Wait for the command to finish
-	exitCode, err := promise.Wait()
-	// check wait result
+	// Execute the start command and wait for it to finish, retrying it by the policy
+	result, err = vc.runAttempts(ctx, held, argv, &policy)
 	if err != nil {
+		if result == nil {
+			return nil, berror.BoxerError{
+				Code:   commandErrorCode(err),
+				Msg:    "error while vmcontroller.StartVM",
+				Origin: fmt.Errorf("failed to execute start command %v: %w", argv, err),
+			}
+		}
 		// change the vm state to error state if the command failed
 		vctx.setState(vmstate.ERROR)
-		return berror.BoxerError{
-			Code:   berror.SystemError,
+		return result, berror.BoxerError{
+			Code:   commandErrorCode(err),
 			Msg:    "error while vmcontroller.StartVM",
 			Origin: fmt.Errorf("error while waiting for start command to finish: %w", err),
+			Result: result,
 		}
 	}
-	if exitCode != 0 {
+	if result.ExitCode != 0 {
 		// change the vm state to error state if the command failed
 		vctx.setState(vmstate.ERROR)
-		return berror.BoxerError{
+		return result, berror.BoxerError{
 			Code:   berror.SystemError,
 			Msg:    "error while vmcontroller.StartVM",
-			Origin: fmt.Errorf("start command exited with non-zero exit code %d", exitCode),
+			Origin: fmt.Errorf("start command exited with non-zero exit code %d: %s", result.ExitCode, result.Message()),
+			Result: result,
 		}
 	}
 	// Set the VM state to RUNNING after starting the VM
 	vctx.setState(vmstate.RUNNING)
-	return nil
+	return result, nil
 }
 
 // StopVM stops the VM with the given context.
 // It checks if the VM is in an active state before executing the stop command.
+// If the command does not finish within the policy timeout, it is killed and berror.Timeout is returned.
+// If ctx is done first, the command is killed and berror.Canceled or berror.Timeout is returned.
 // It sets the VM state to STOPPED after stopping the VM.
-func (vc *vmController) StopVM(vctx *VMContext) (err error) {
+func (vc *vmController) StopVM(ctx context.Context, vctx *VMContext) (result *berror.CommandResult, err error) {
 	if vctx.State() != vmstate.RUNNING {
-		return berror.BoxerError{
+		return nil, berror.BoxerError{
 			Code:   berror.InvalidState,
 			Msg:    "error while vmcontroller.StopVM",
 			Origin: fmt.Errorf("VM is not in an active state. current state: %s, expected: %s", vctx.State(), vmstate.RUNNING),
@@ -146,61 +477,93 @@ func (vc *vmController) StopVM(vctx *VMContext) (err error) {
 	}
 
 	// create the arguments for the stop command by replacing reserved keywords
-	argv := vc.replaceReservedKeyword(vc.vmControl.StopCmd, vctx)
+	control := vc.resolveControl(vctx)
+	policy := vc.resolvePolicy(vctx)
+	argv, err := vc.replaceReservedKeyword(control.StopCmd, vctx)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.StopVM",
+			Origin: fmt.Errorf("failed to parse stop command: %w", err),
+		}
+	}
 	if len(argv) == 0 {
-		return berror.BoxerError{
+		return nil, berror.BoxerError{
 			Code:   berror.InvalidArgument,
 			Msg:    "error while vmcontroller.StopVM",
-			Origin: fmt.Errorf("stop command is empty after replacing reserved keywords %v", vc.vmControl.StopCmd),
+			Origin: fmt.Errorf("stop command is empty after replacing reserved keywords %v", control.StopCmd),
 		}
 	}
-	// lock the padded mutex to prevent concurrent execution of vm control commands
-	vc.mux.Lock()
-	defer vc.mux.Release()
-	// Execute the stop command
-	promise, err := exec.Run(vc.fdin, vc.fdout, argv[0], argv[1:]...)
+	// wait for the rate limit of the stop commands before locking, like StartVM
+	if err := vc.stopLimiter.Wait(ctx); err != nil {
+		return nil, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.StopVM",
+			Origin: fmt.Errorf("failed to wait for the stop command rate limit: %w", err),
+		}
+	}
+	// lock the VM and its host to prevent conflicting execution of vm control commands
+	held, err := vc.lock(ctx, vctx, policy.Padding)
 	if err != nil {
-		// change the vm state to error state if the command failed
-		vctx.setState(vmstate.ERROR)
-		// return an error if the command failed to execute
-		return berror.BoxerError{
-			Code:   berror.SystemError,
+		return nil, berror.BoxerError{
+			Code:   commandErrorCode(err),
 			Msg:    "error while vmcontroller.StopVM",
-			Origin: fmt.Errorf("failed to execute stop command %v: %w", argv, err),
+			Origin: fmt.Errorf("failed to wait for the stop command turn: %w", err),
 		}
 	}
-	// Wait for the command to finish
-	exitCode, err := promise.Wait()
+	defer held.unlock(policy.IntervalSec)
+	// check the state again, because another goroutine may have changed it while waiting for the lock
+	if state := vctx.State(); state != vmstate.RUNNING {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidState,
+			Msg:    "error while vmcontroller.StopVM",
+			Origin: fmt.Errorf("VM state is changed while waiting for the stop command turn. current state: %s, expected: %s", state, vmstate.RUNNING),
+		}
+	}
+	// Execute the stop command and wait for it to finish, retrying it by the policy
+	result, err = vc.runAttempts(ctx, held, argv, &policy)
 	if err != nil {
 		// change the vm state to error state if the command failed
 		vctx.setState(vmstate.ERROR)
+		if result == nil {
+			// return an error if the command failed to execute
+			return nil, berror.BoxerError{
+				Code:   commandErrorCode(err),
+				Msg:    "error while vmcontroller.StopVM",
+				Origin: fmt.Errorf("failed to execute stop command %v: %w", argv, err),
+			}
+		}
 		// return an error if the command failed to finish
-		return berror.BoxerError{
-			Code:   berror.SystemError,
+		return result, berror.BoxerError{
+			Code:   commandErrorCode(err),
 			Msg:    "error while vmcontroller.StopVM",
 			Origin: fmt.Errorf("error while waiting for stop command to finish: %w", err),
+			Result: result,
 		}
 	}
-	if exitCode != 0 {
+	if result.ExitCode != 0 {
 		// change the vm state to error state if the command failed
 		vctx.setState(vmstate.ERROR)
 		// return an error if the command exited with a non-zero exit code
-		return berror.BoxerError{
+		return result, berror.BoxerError{
 			Code:   berror.SystemError,
 			Msg:    "error while vmcontroller.StopVM",
-			Origin: fmt.Errorf("stop command exited with non-zero exit code %d", exitCode),
+			Origin: fmt.Errorf("stop command exited with non-zero exit code %d: %s", result.ExitCode, result.Message()),
+			Result: result,
 		}
 	}
 	vctx.setState(vmstate.STOPPED)
-	return nil
+	return result, nil
 }
 
 // RestoreSnapshot restores the snapshot of the VM with the given context.
 // It checks if the VM is in a stopped state before executing the restore snapshot command.
+// If the command does not finish within the policy timeout, it is killed and berror.Timeout is returned.
+// If ctx is done first, the command is killed and berror.Canceled or berror.Timeout is returned.
 // It sets the VM state to STOPPED after restoring the snapshot.
-func (vc *vmController) RestoreSnapshot(vctx *VMContext) (err error) {
+func (vc *vmController) RestoreSnapshot(ctx context.Context, vctx *VMContext) (result *berror.CommandResult, err error) {
 	if vctx.State() != vmstate.STOPPED {
-		return berror.BoxerError{
+		return nil, berror.BoxerError{
 			Code:   berror.InvalidState,
 			Msg:    "error while vmcontroller.RestoreSnapshot",
 			Origin: fmt.Errorf("VM is not in a stopped state. current state: %s, expected: %s", vctx.State(), vmstate.STOPPED),
@@ -208,53 +571,277 @@ func (vc *vmController) RestoreSnapshot(vctx *VMContext) (err error) {
 	}
 
 	// create the arguments for the restore snapshot command by replacing reserved keywords
-	argv := vc.replaceReservedKeyword(vc.vmControl.RestoreSnapshotCmd, vctx)
+	control := vc.resolveControl(vctx)
+	policy := vc.resolvePolicy(vctx)
+	argv, err := vc.replaceReservedKeyword(control.RestoreSnapshotCmd, vctx)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.RestoreSnapshot",
+			Origin: fmt.Errorf("failed to parse restore snapshot command: %w", err),
+		}
+	}
 	if len(argv) == 0 {
-		return berror.BoxerError{
+		return nil, berror.BoxerError{
 			Code:   berror.InvalidArgument,
 			Msg:    "error while vmcontroller.RestoreSnapshot",
-			Origin: fmt.Errorf("restore snapshot command is empty after replacing reserved keywords %v", vc.vmControl.RestoreSnapshotCmd),
+			Origin: fmt.Errorf("restore snapshot command is empty after replacing reserved keywords %v", control.RestoreSnapshotCmd),
 		}
 	}
-	// lock the padded mutex to prevent concurrent execution of vm control commands
-	vc.mux.Lock()
-	defer vc.mux.Release()
-	// Execute the restore snapshot command
-	promise, err := exec.Run(vc.fdin, vc.fdout, argv[0], argv[1:]...)
+	// wait for the rate limit of the restore snapshot commands before locking, like StartVM
+	if err := vc.restoreLimiter.Wait(ctx); err != nil {
+		return nil, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.RestoreSnapshot",
+			Origin: fmt.Errorf("failed to wait for the restore snapshot command rate limit: %w", err),
+		}
+	}
+	// lock the VM and its host to prevent conflicting execution of vm control commands
+	held, err := vc.lock(ctx, vctx, policy.Padding)
 	if err != nil {
-		// change the vm state to error state if the command failed
-		vctx.setState(vmstate.ERROR)
-		// return an error if the command failed to execute
-		return berror.BoxerError{
-			Code:   berror.SystemError,
+		return nil, berror.BoxerError{
+			Code:   commandErrorCode(err),
 			Msg:    "error while vmcontroller.RestoreSnapshot",
-			Origin: fmt.Errorf("failed to execute restore snapshot command %v: %w", argv, err),
+			Origin: fmt.Errorf("failed to wait for the restore snapshot command turn: %w", err),
+		}
+	}
+	defer held.unlock(policy.IntervalSec)
+	// check the state again, because another goroutine may have changed it while waiting for the lock
+	if state := vctx.State(); state != vmstate.STOPPED {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidState,
+			Msg:    "error while vmcontroller.RestoreSnapshot",
+			Origin: fmt.Errorf("VM state is changed while waiting for the restore snapshot command turn. current state: %s, expected: %s", state, vmstate.STOPPED),
 		}
 	}
 	vctx.setState(vmstate.RESTORING)
-	// Wait for the command to finish
-	exitCode, err := promise.Wait()
+	// Execute the restore snapshot command and wait for it to finish, retrying it by the policy
+	result, err = vc.runAttempts(ctx, held, argv, &policy)
 	if err != nil {
 		// change the vm state to error state if the command failed
 		vctx.setState(vmstate.ERROR)
+		if result == nil {
+			// return an error if the command failed to execute
+			return nil, berror.BoxerError{
+				Code:   commandErrorCode(err),
+				Msg:    "error while vmcontroller.RestoreSnapshot",
+				Origin: fmt.Errorf("failed to execute restore snapshot command %v: %w", argv, err),
+			}
+		}
 		// return an error if the command failed to finish
-		return berror.BoxerError{
-			Code:   berror.SystemError,
+		return result, berror.BoxerError{
+			Code:   commandErrorCode(err),
 			Msg:    "error while vmcontroller.RestoreSnapshot",
 			Origin: fmt.Errorf("error while waiting for restore snapshot command to finish: %w", err),
+			Result: result,
 		}
 	}
-	if exitCode != 0 {
+	if result.ExitCode != 0 {
 		// change the vm state to error state if the command failed
 		vctx.setState(vmstate.ERROR)
 		// return an error if the command exited with a non-zero exit code
-		return berror.BoxerError{
+		return result, berror.BoxerError{
 			Code:   berror.SystemError,
 			Msg:    "error while vmcontroller.RestoreSnapshot",
-			Origin: fmt.Errorf("restore snapshot command exited with non-zero exit code %d", exitCode),
+			Origin: fmt.Errorf("restore snapshot command exited with non-zero exit code %d: %s", result.ExitCode, result.Message()),
+			Result: result,
 		}
 	}
 	// Set the VM state to STOPPED after restoring snapshot
-	vctx.setState(vmstate.RUNNING)
-	return nil
+	vctx.setState(vmstate.STOPPED)
+	return result, nil
+}
+
+// RecoverVM brings the VM back to the stopped state from any state, so a VM in the error state can be used again.
+// It runs the force stop command, or the stop command if there is none, and then the restore snapshot command.
+// The force stop command is expected to fail if the VM is not running, so its failure is ignored
+// unless ctx is done; the restore snapshot command decides the result.
+// It sets the VM state to STOPPED after recovering the VM, or to ERROR if the restore snapshot command fails.
+func (vc *vmController) RecoverVM(ctx context.Context, vctx *VMContext) (result *berror.CommandResult, err error) {
+	// create the arguments for the force stop and restore snapshot commands by replacing reserved keywords
+	control := vc.resolveControl(vctx)
+	policy := vc.resolvePolicy(vctx)
+	forceStopCmd := control.ForceStopCmd
+	if forceStopCmd == "" {
+		forceStopCmd = control.StopCmd
+	}
+	stopArgv, err := vc.replaceReservedKeyword(forceStopCmd, vctx)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.RecoverVM",
+			Origin: fmt.Errorf("failed to parse force stop command: %w", err),
+		}
+	}
+	restoreArgv, err := vc.replaceReservedKeyword(control.RestoreSnapshotCmd, vctx)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.RecoverVM",
+			Origin: fmt.Errorf("failed to parse restore snapshot command: %w", err),
+		}
+	}
+	if len(stopArgv) == 0 || len(restoreArgv) == 0 {
+		return nil, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.RecoverVM",
+			Origin: fmt.Errorf("force stop or restore snapshot command is empty after replacing reserved keywords %v, %v", forceStopCmd, control.RestoreSnapshotCmd),
+		}
+	}
+	// wait for the rate limits of both commands before locking, like StartVM
+	if err := vc.stopLimiter.Wait(ctx); err != nil {
+		return nil, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.RecoverVM",
+			Origin: fmt.Errorf("failed to wait for the stop command rate limit: %w", err),
+		}
+	}
+	if err := vc.restoreLimiter.Wait(ctx); err != nil {
+		return nil, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.RecoverVM",
+			Origin: fmt.Errorf("failed to wait for the restore snapshot command rate limit: %w", err),
+		}
+	}
+	// lock the VM and its host to prevent conflicting execution of vm control commands
+	held, err := vc.lock(ctx, vctx, policy.Padding)
+	if err != nil {
+		return nil, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.RecoverVM",
+			Origin: fmt.Errorf("failed to wait for the recover turn: %w", err),
+		}
+	}
+	defer held.unlock(policy.IntervalSec)
+	// hard-stop the VM, it may be already stopped
+	result, err = vc.runAttempts(ctx, held, stopArgv, &policy)
+	if ctx.Err() != nil {
+		vctx.setState(vmstate.ERROR)
+		return result, berror.BoxerError{
+			Code:   berror.ContextErrorCode(ctx.Err()),
+			Msg:    "error while vmcontroller.RecoverVM",
+			Origin: fmt.Errorf("error while waiting for force stop command to finish: %w", ctx.Err()),
+			Result: result,
+		}
+	}
+	vctx.setState(vmstate.RESTORING)
+	// Execute the restore snapshot command and wait for it to finish, retrying it by the policy
+	result, err = vc.runAttempts(ctx, held, restoreArgv, &policy)
+	if err != nil {
+		// change the vm state to error state if the command failed
+		vctx.setState(vmstate.ERROR)
+		if result == nil {
+			return nil, berror.BoxerError{
+				Code:   commandErrorCode(err),
+				Msg:    "error while vmcontroller.RecoverVM",
+				Origin: fmt.Errorf("failed to execute restore snapshot command %v: %w", restoreArgv, err),
+			}
+		}
+		return result, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.RecoverVM",
+			Origin: fmt.Errorf("error while waiting for restore snapshot command to finish: %w", err),
+			Result: result,
+		}
+	}
+	if result.ExitCode != 0 {
+		// change the vm state to error state if the command failed
+		vctx.setState(vmstate.ERROR)
+		return result, berror.BoxerError{
+			Code:   berror.SystemError,
+			Msg:    "error while vmcontroller.RecoverVM",
+			Origin: fmt.Errorf("restore snapshot command exited with non-zero exit code %d: %s", result.ExitCode, result.Message()),
+			Result: result,
+		}
+	}
+	// Set the VM state to STOPPED after recovering the VM
+	vctx.setState(vmstate.STOPPED)
+	return result, nil
+}
+
+// Refresh probes the actual state of the VM with the status command.
+// The stdout and the exit code of the status command are mapped to a VM state by the status rules,
+// and the state of the VMContext is set to it if it differs. The returned StateChange tells what changed.
+// It returns berror.InvalidOperation if the VM has no status command.
+// If the command fails or no status rule matches, the state of the VMContext is kept as it is.
+func (vc *vmController) Refresh(ctx context.Context, vctx *VMContext) (change StateChange, err error) {
+	// create the arguments for the status command by replacing reserved keywords
+	control := vc.resolveControl(vctx)
+	policy := vc.resolvePolicy(vctx)
+	if control.StatusCmd == "" {
+		return StateChange{}, berror.BoxerError{
+			Code:   berror.InvalidOperation,
+			Msg:    "error while vmcontroller.Refresh",
+			Origin: fmt.Errorf("status command is not configured for VM %s", vctx.Machine()),
+		}
+	}
+	argv, err := vc.replaceReservedKeyword(control.StatusCmd, vctx)
+	if err != nil {
+		return StateChange{}, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.Refresh",
+			Origin: fmt.Errorf("failed to parse status command: %w", err),
+		}
+	}
+	if len(argv) == 0 {
+		return StateChange{}, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.Refresh",
+			Origin: fmt.Errorf("status command is empty after replacing reserved keywords %v", control.StatusCmd),
+		}
+	}
+	// lock the VM, so that the state is not probed in the middle of another control command
+	held, err := vc.lock(ctx, vctx, policy.Padding)
+	if err != nil {
+		return StateChange{}, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.Refresh",
+			Origin: fmt.Errorf("failed to wait for the status command turn: %w", err),
+		}
+	}
+	// probing does not change the VM, so the next command does not have to wait for the interval
+	defer held.unlock(0)
+	// bound the command by the policy timeout
+	cmdCtx, cancel := vc.commandContext(ctx, &policy)
+	defer cancel()
+	// Execute the status command and wait for it to finish.
+	// the status is probed periodically, so its output is only captured
+	result, err := vc.runCommand(cmdCtx, vctx, argv, false)
+	if err != nil {
+		if result == nil {
+			return StateChange{}, berror.BoxerError{
+				Code:   commandErrorCode(err),
+				Msg:    "error while vmcontroller.Refresh",
+				Origin: fmt.Errorf("failed to execute status command %v: %w", argv, err),
+			}
+		}
+		return StateChange{Result: result}, berror.BoxerError{
+			Code:   commandErrorCode(err),
+			Msg:    "error while vmcontroller.Refresh",
+			Origin: fmt.Errorf("error while waiting for status command to finish: %w", err),
+			Result: result,
+		}
+	}
+	state, matched, err := control.MatchStatus(result.Stdout, result.ExitCode)
+	if err != nil {
+		return StateChange{Result: result}, berror.BoxerError{
+			Code:   berror.InvalidArgument,
+			Msg:    "error while vmcontroller.Refresh",
+			Origin: err,
+			Result: result,
+		}
+	}
+	if !matched {
+		return StateChange{Result: result}, berror.BoxerError{
+			Code:   berror.SystemError,
+			Msg:    "error while vmcontroller.Refresh",
+			Origin: fmt.Errorf("no status rule matches the status command result. exit code: %d, output: %q", result.ExitCode, result.Message()),
+			Result: result,
+		}
+	}
+	change = StateChange{VM: vctx, Old: vctx.State(), New: state, Result: result}
+	if change.Changed() {
+		vctx.setState(state)
+	}
+	return change, nil
 }
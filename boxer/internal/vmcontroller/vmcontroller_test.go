@@ -1,12 +1,22 @@
 package vmcontroller_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/hongsam14/boxer/config"
+	berror "github.com/hongsam14/boxer/error"
 	"github.com/hongsam14/boxer/internal/vmcontroller"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec"
+	"github.com/hongsam14/boxer/internal/vmcontroller/exec/exectest"
 	"github.com/hongsam14/boxer/vmstate"
 )
 
@@ -35,9 +45,9 @@ func TestVMController(t *testing.T) {
 		TimeoutSec:  300, // Timeout in seconds for the VM control commands
 	}
 	vctx := vmcontroller.NewVMContext(vmInfo)
-	vmController := vmcontroller.NewVMController(os.Stdin, os.Stdout, &vmControlConfig, &vmPolicy)
+	vmController := vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), os.Stdout, &vmControlConfig, &vmPolicy, nil, nil)
 
-	err := vmController.StartVM(vctx)
+	_, err := vmController.StartVM(context.Background(), vctx)
 	if err != nil {
 		t.Errorf("StartVM failed: %v", err)
 		return
@@ -51,7 +61,7 @@ func TestVMController(t *testing.T) {
 	t.Logf("Waiting 10 sec...")
 	time.Sleep(10 * time.Second)
 	// stop the VM
-	err = vmController.StopVM(vctx)
+	_, err = vmController.StopVM(context.Background(), vctx)
 	if err != nil {
 		t.Errorf("StopVM failed: %v", err)
 		return
@@ -62,7 +72,7 @@ func TestVMController(t *testing.T) {
 	}
 	t.Logf("VM %s stopped successfully", vctx.Machine())
 	// restore the snapshot
-	err = vmController.RestoreSnapshot(vctx)
+	_, err = vmController.RestoreSnapshot(context.Background(), vctx)
 	if err != nil {
 		t.Errorf("RestoreSnapshot failed: %v", err)
 		return
@@ -73,3 +83,936 @@ func TestVMController(t *testing.T) {
 	}
 	t.Logf("Snapshot %s restored successfully for VM %s", vctx.Snapshot(), vctx.Machine())
 }
+
+func TestVMControllerTimeout(t *testing.T) {
+	vmInfo := config.VMInfoConfig{
+		// the machine name is used as the sleep duration of the start command
+		Name:     "10",
+		Snapshot: "snapshot0",
+		IP:       "127.0.0.1",
+		OS:       "linux",
+		Group:    "test",
+	}
+	vmControlConfig := config.VMControlConfig{
+		StartCmd:           "sleep $machine",
+		StopCmd:            "true $machine",
+		RestoreSnapshotCmd: "true $machine $snapshot",
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec: 1,
+		TimeoutSec:  1,
+	}
+	vctx := vmcontroller.NewVMContext(vmInfo)
+	vmController := vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), os.Stdout, &vmControlConfig, &vmPolicy, nil, nil)
+
+	start := time.Now()
+	_, err := vmController.StartVM(context.Background(), vctx)
+	elapsed := time.Since(start)
+	if !berror.Is(err, berror.Timeout) {
+		t.Errorf("Expected timeout error, got %v", err)
+		return
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("StartVM should return right after the timeout, elapsed %v", elapsed)
+	}
+	if vctx.State() != vmstate.ERROR {
+		t.Errorf("Expected VM state to be ERROR, got %s", vctx.State())
+	}
+}
+
+func TestVMControllerCanceled(t *testing.T) {
+	vmInfo := config.VMInfoConfig{
+		// the machine name is used as the sleep duration of the start command
+		Name:     "10",
+		Snapshot: "snapshot0",
+		IP:       "127.0.0.1",
+		OS:       "linux",
+		Group:    "test",
+	}
+	vmControlConfig := config.VMControlConfig{
+		StartCmd:           "sleep $machine",
+		StopCmd:            "true $machine",
+		RestoreSnapshotCmd: "true $machine $snapshot",
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec: 1,
+		TimeoutSec:  30,
+	}
+	vctx := vmcontroller.NewVMContext(vmInfo)
+	vmController := vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), os.Stdout, &vmControlConfig, &vmPolicy, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	_, err := vmController.StartVM(ctx, vctx)
+	if !berror.Is(err, berror.Canceled) {
+		t.Errorf("Expected canceled error, got %v", err)
+		return
+	}
+	if vctx.State() != vmstate.ERROR {
+		t.Errorf("Expected VM state to be ERROR, got %s", vctx.State())
+	}
+	// the padded mutex is released, so the next command gets its turn after the interval
+	other := vmcontroller.NewVMContext(config.VMInfoConfig{
+		Name:     "0",
+		Snapshot: "snapshot0",
+		IP:       "127.0.0.1",
+		OS:       "linux",
+		Group:    "test",
+	})
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	if _, err := vmController.StartVM(waitCtx, other); err != nil {
+		t.Errorf("StartVM failed after cancel: %v", err)
+	}
+}
+
+func TestVMControllerQuotedArguments(t *testing.T) {
+	vmInfo := config.VMInfoConfig{
+		Name:     "my vm",
+		Snapshot: "Snapshot 1",
+		IP:       "127.0.0.1",
+		OS:       "linux",
+		Group:    "test",
+	}
+	// test(1) fails if the values are split into several arguments
+	vmControlConfig := config.VMControlConfig{
+		StartCmd:           "test $machine = 'my vm'",
+		StopCmd:            `test "$machine" = "my vm"`,
+		RestoreSnapshotCmd: `test $machine = my\ vm -a $snapshot = "Snapshot 1"`,
+	}
+	if !vmControlConfig.CheckReservedKeyword() {
+		t.Errorf("CheckReservedKeyword failed")
+		return
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec: 0,
+		TimeoutSec:  30,
+	}
+	vctx := vmcontroller.NewVMContext(vmInfo)
+	vmController := vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), os.Stdout, &vmControlConfig, &vmPolicy, nil, nil)
+	if _, err := vmController.StartVM(context.Background(), vctx); err != nil {
+		t.Errorf("StartVM failed: %v", err)
+		return
+	}
+	if _, err := vmController.StopVM(context.Background(), vctx); err != nil {
+		t.Errorf("StopVM failed: %v", err)
+		return
+	}
+	if _, err := vmController.RestoreSnapshot(context.Background(), vctx); err != nil {
+		t.Errorf("RestoreSnapshot failed: %v", err)
+	}
+}
+
+func TestVMControllerPlaceholders(t *testing.T) {
+	vmInfo := config.VMInfoConfig{
+		Name:     "vm1",
+		Snapshot: "snapshot0",
+		IP:       "10.0.0.7",
+		OS:       "windows",
+		Group:    "test group",
+		Vars:     map[string]string{"pool": "fast pool"},
+	}
+	// test(1) fails if a placeholder is not substituted as expected
+	vmControlConfig := config.VMControlConfig{
+		StartCmd:           "test $machine/$ip/$os = vm1/10.0.0.7/windows",
+		StopCmd:            `test "$machine" = vm1 -a $group = "test group" -a ${pool} = "fast pool"`,
+		RestoreSnapshotCmd: "true $machine $snapshot",
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec: 0,
+		TimeoutSec:  30,
+	}
+	vctx := vmcontroller.NewVMContext(vmInfo)
+	vmController := vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), os.Stdout, &vmControlConfig, &vmPolicy, nil, nil)
+	if _, err := vmController.StartVM(context.Background(), vctx); err != nil {
+		t.Errorf("StartVM failed: %v", err)
+		return
+	}
+	if _, err := vmController.StopVM(context.Background(), vctx); err != nil {
+		t.Errorf("StopVM failed: %v", err)
+	}
+}
+
+func TestVMControllerOverride(t *testing.T) {
+	vmInfo := config.VMInfoConfig{
+		Name:     "vm1",
+		Snapshot: "snapshot0",
+		IP:       "127.0.0.1",
+		OS:       "linux",
+		Group:    "test",
+		Vars:     map[string]string{"duration": "10"},
+		// the VM overrides the start command and the timeout of the controller
+		VMControl: config.VMControlConfig{
+			StartCmd: "sleep $duration",
+		},
+		VMControlPolicy: config.VMControlPolicyConfig{
+			TimeoutSec: 1,
+		},
+	}
+	vmControlConfig := config.VMControlConfig{
+		StartCmd:           "true $machine",
+		StopCmd:            "true $machine",
+		RestoreSnapshotCmd: "true $machine $snapshot",
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec: 0,
+		TimeoutSec:  300,
+	}
+	vctx := vmcontroller.NewVMContext(vmInfo)
+	vmController := vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), os.Stdout, &vmControlConfig, &vmPolicy, nil, nil)
+	start := time.Now()
+	_, err := vmController.StartVM(context.Background(), vctx)
+	if !berror.Is(err, berror.Timeout) {
+		t.Errorf("Expected timeout error from the overridden command, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("StartVM should use the overridden timeout, elapsed %v", elapsed)
+	}
+}
+
+// newStatusTestController returns a VMController whose status command prints the status var of the VM.
+func newStatusTestController() vmcontroller.VMController {
+	vmControlConfig := config.VMControlConfig{
+		StartCmd:           "true $machine",
+		StopCmd:            "true $machine",
+		RestoreSnapshotCmd: "true $machine $snapshot",
+		StatusCmd:          "echo $status",
+		StatusRules: []config.VMStatusRuleConfig{
+			{State: "running", Regex: "^running"},
+			{State: "stopped", Regex: "^(poweroff|aborted)"},
+			{State: "error", Regex: "^crashed"},
+		},
+	}
+	vmPolicy := config.VMControlPolicyConfig{
+		IntervalSec: 0,
+		TimeoutSec:  30,
+	}
+	return vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), os.Stdout, &vmControlConfig, &vmPolicy, nil, nil)
+}
+
+func newStatusTestVMInfo(status string) config.VMInfoConfig {
+	return config.VMInfoConfig{
+		Name:     "vm1",
+		Snapshot: "snapshot0",
+		IP:       "127.0.0.1",
+		OS:       "linux",
+		Group:    "testGroup",
+		Vars:     map[string]string{"status": status},
+	}
+}
+
+func TestVMControllerRefresh(t *testing.T) {
+	vmController := newStatusTestController()
+	// the VM is powered off outside of boxer after it is started
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo("poweroff"))
+	if _, err := vmController.StartVM(context.Background(), vctx); err != nil {
+		t.Fatalf("StartVM failed: %v", err)
+	}
+	change, err := vmController.Refresh(context.Background(), vctx)
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if !change.Changed() || change.Old != vmstate.RUNNING || change.New != vmstate.STOPPED {
+		t.Errorf("Expected change from RUNNING to STOPPED, got %s to %s", change.Old, change.New)
+	}
+	if vctx.State() != vmstate.STOPPED {
+		t.Errorf("Expected state STOPPED, got %s", vctx.State())
+	}
+	// the state is already right, so nothing changes
+	change, err = vmController.Refresh(context.Background(), vctx)
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if change.Changed() {
+		t.Errorf("Expected no change, got %s to %s", change.Old, change.New)
+	}
+}
+
+func TestVMControllerRefreshUnknownStatus(t *testing.T) {
+	vmController := newStatusTestController()
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo("paused"))
+	_, err := vmController.Refresh(context.Background(), vctx)
+	if !berror.Is(err, berror.SystemError) {
+		t.Errorf("Expected SystemError for an unknown status, got %v", err)
+	}
+	if vctx.State() != vmstate.STOPPED {
+		t.Errorf("Expected the state to be kept, got %s", vctx.State())
+	}
+}
+
+func TestVMControllerRefreshExitCode(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{
+		StartCmd:           "true $machine",
+		StopCmd:            "true $machine",
+		RestoreSnapshotCmd: "true $machine $snapshot",
+		StatusCmd:          "sh -c 'exit 3' $machine",
+		StatusRules: []config.VMStatusRuleConfig{
+			{State: "running", ExitCode: new(int)},
+			{State: "error", Regex: ".*"},
+		},
+	}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 30}
+	vmController := vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), os.Stdout, &vmControlConfig, &vmPolicy, nil, nil)
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+	if _, err := vmController.Refresh(context.Background(), vctx); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if vctx.State() != vmstate.ERROR {
+		t.Errorf("Expected state ERROR, got %s", vctx.State())
+	}
+}
+
+func TestVMControllerRefreshWithoutStatusCmd(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{
+		StartCmd:           "true $machine",
+		StopCmd:            "true $machine",
+		RestoreSnapshotCmd: "true $machine $snapshot",
+	}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 30}
+	vmController := vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), os.Stdout, &vmControlConfig, &vmPolicy, nil, nil)
+	_, err := vmController.Refresh(context.Background(), vmcontroller.NewVMContext(newStatusTestVMInfo("running")))
+	if !berror.Is(err, berror.InvalidOperation) {
+		t.Errorf("Expected InvalidOperation error, got %v", err)
+	}
+}
+
+func TestVMControllerCommandResult(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{
+		StartCmd:           "sh -c 'echo starting $0' $machine",
+		StopCmd:            "true $machine",
+		RestoreSnapshotCmd: "sh -c 'echo \"snapshot $1 not found\" >&2; exit 1' $machine $snapshot",
+	}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 30}
+	// without fdout the output is only captured
+	vmController := vmcontroller.NewVMController(exec.NewProcessExecutor(os.Stdin), nil, &vmControlConfig, &vmPolicy, nil, nil)
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+
+	result, err := vmController.StartVM(context.Background(), vctx)
+	if err != nil {
+		t.Fatalf("StartVM failed: %v", err)
+	}
+	if result.ExitCode != 0 || result.Stdout != "starting vm1\n" || result.Argv[len(result.Argv)-1] != "vm1" {
+		t.Errorf("Unexpected result %s, stdout %q", result, result.Stdout)
+	}
+	if _, err := vmController.StopVM(context.Background(), vctx); err != nil {
+		t.Fatalf("StopVM failed: %v", err)
+	}
+
+	result, err = vmController.RestoreSnapshot(context.Background(), vctx)
+	if !berror.Is(err, berror.SystemError) {
+		t.Fatalf("Expected SystemError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "snapshot snapshot0 not found") {
+		t.Errorf("Expected the stderr in the error, got %v", err)
+	}
+	if attached := berror.ResultOf(err); attached != result || result.ExitCode != 1 || result.Stderr != "snapshot snapshot0 not found\n" {
+		t.Errorf("Expected the result to be attached to the error, got %v", attached)
+	}
+}
+
+func TestVMControllerScriptedExecutor(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_VIRTUALBOX}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 30}
+	executor := exectest.NewExecutor()
+	executor.Script("VBoxManage",
+		exectest.Response{},
+		exectest.Response{},
+		exectest.Response{ExitCode: 1, Stderr: "VBoxManage: error: Could not find a snapshot named 'snapshot0'"},
+	)
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, nil, nil)
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+
+	if _, err := vmController.StartVM(context.Background(), vctx); err != nil {
+		t.Fatalf("StartVM failed: %v", err)
+	}
+	if _, err := vmController.StopVM(context.Background(), vctx); err != nil {
+		t.Fatalf("StopVM failed: %v", err)
+	}
+	result, err := vmController.RestoreSnapshot(context.Background(), vctx)
+	if !berror.Is(err, berror.SystemError) || !strings.Contains(result.Message(), "Could not find a snapshot") {
+		t.Errorf("Expected the scripted failure, got %v", err)
+	}
+	if vctx.State() != vmstate.ERROR {
+		t.Errorf("Expected state ERROR, got %s", vctx.State())
+	}
+	want := [][]string{
+		{"VBoxManage", "startvm", "vm1", "--type", "headless"},
+		{"VBoxManage", "controlvm", "vm1", "poweroff"},
+		{"VBoxManage", "snapshot", "vm1", "restore", "snapshot0"},
+	}
+	invocations := executor.Invocations()
+	if len(invocations) != len(want) {
+		t.Fatalf("Expected %d invocations, got %d", len(want), len(invocations))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(invocations[i].Argv, want[i]) {
+			t.Errorf("Expected invocation %v, got %v", want[i], invocations[i].Argv)
+		}
+	}
+}
+
+func TestVMControllerScriptedTimeout(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_LIBVIRT}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 1}
+	executor := exectest.NewExecutor()
+	executor.Script("virsh", exectest.Response{Delay: time.Minute})
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, nil, nil)
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+	_, err := vmController.StartVM(context.Background(), vctx)
+	if !berror.Is(err, berror.Timeout) {
+		t.Errorf("Expected Timeout error, got %v", err)
+	}
+	if vctx.State() != vmstate.ERROR {
+		t.Errorf("Expected state ERROR, got %s", vctx.State())
+	}
+}
+
+func TestVMControllerScriptedNotStarted(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_VMRUN}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 30}
+	executor := exectest.NewExecutor()
+	executor.Script("vmrun", exectest.Response{Err: errors.New("executable file not found in $PATH")})
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, nil, nil)
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+	result, err := vmController.StartVM(context.Background(), vctx)
+	if err == nil || result != nil {
+		t.Errorf("Expected an error without a result, got %v, %v", result, err)
+	}
+	// the VM is not touched, so it is still stopped
+	if vctx.State() != vmstate.STOPPED {
+		t.Errorf("Expected state STOPPED, got %s", vctx.State())
+	}
+}
+
+func TestVMControllerRemoteHost(t *testing.T) {
+	// the fake ssh client fails to connect to any host
+	dir := t.TempDir()
+	fakeSSH := "#!/bin/sh\necho 'ssh: Could not resolve hostname hv1.example.com' >&2\nexit 255\n"
+	if err := os.WriteFile(dir+"/ssh", []byte(fakeSSH), 0o755); err != nil {
+		t.Fatalf("failed to write the fake ssh client: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_LIBVIRT}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 30}
+	hosts := map[string]config.HostConfig{
+		"hv1":   {Transport: config.TRANSPORT_SSH, Address: "hv1.example.com"},
+		"local": {Transport: config.TRANSPORT_LOCAL},
+	}
+	executor := exectest.NewExecutor()
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, hosts, nil)
+
+	remote := newStatusTestVMInfo("")
+	remote.Host = "hv1"
+	_, err := vmController.StartVM(context.Background(), vmcontroller.NewVMContext(remote))
+	if !berror.Is(err, berror.ConnectionError) {
+		t.Errorf("Expected ConnectionError, got %v", err)
+	}
+	local := newStatusTestVMInfo("")
+	local.Host = "local"
+	if _, err := vmController.StartVM(context.Background(), vmcontroller.NewVMContext(local)); err != nil {
+		t.Fatalf("StartVM failed: %v", err)
+	}
+	// only the VM on the local host is started by the local executor
+	if invocations := executor.Invocations(); len(invocations) != 1 {
+		t.Errorf("Expected 1 local invocation, got %d", len(invocations))
+	}
+}
+
+func TestVMControllerHostMaxOperations(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_LIBVIRT}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 30}
+	hosts := map[string]config.HostConfig{
+		"hv1": {MaxOperations: 2},
+		"hv2": {},
+	}
+	executor := exectest.NewExecutor()
+	executor.SetDefault(exectest.Response{Delay: delay})
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, hosts, nil)
+
+	startAll := func(host string) []time.Time {
+		t.Helper()
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			vmInfo := newStatusTestVMInfo("")
+			vmInfo.Name = fmt.Sprintf("%s-vm%d", host, i)
+			vmInfo.Host = host
+			vctx := vmcontroller.NewVMContext(vmInfo)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := vmController.StartVM(context.Background(), vctx); err != nil {
+					t.Errorf("StartVM failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		var starts []time.Time
+		for _, invocation := range executor.Invocations() {
+			if strings.HasPrefix(invocation.Argv[2], host) {
+				starts = append(starts, invocation.Start)
+			}
+		}
+		if len(starts) != 2 {
+			t.Fatalf("Expected 2 invocations on %s, got %d", host, len(starts))
+		}
+		return starts
+	}
+	gap := func(starts []time.Time) time.Duration {
+		d := starts[1].Sub(starts[0])
+		if d < 0 {
+			d = -d
+		}
+		return d
+	}
+	// hv1 runs two commands in parallel
+	if d := gap(startAll("hv1")); d >= delay {
+		t.Errorf("Expected the commands on hv1 to run in parallel, got a gap of %v", d)
+	}
+	// hv2 runs one command at a time
+	if d := gap(startAll("hv2")); d < delay {
+		t.Errorf("Expected the commands on hv2 to be serialized, got a gap of %v", d)
+	}
+}
+
+func TestVMControllerMaxCommands(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_LIBVIRT}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 30, MaxCommands: 1}
+	hosts := map[string]config.HostConfig{
+		"hv1": {MaxOperations: 2},
+		"hv2": {MaxOperations: 2},
+	}
+	executor := exectest.NewExecutor()
+	executor.SetDefault(exectest.Response{Delay: delay})
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, hosts, nil)
+
+	var wg sync.WaitGroup
+	for _, host := range []string{"hv1", "hv2"} {
+		vmInfo := newStatusTestVMInfo("")
+		vmInfo.Name = host + "-vm"
+		vmInfo.Host = host
+		vctx := vmcontroller.NewVMContext(vmInfo)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := vmController.StartVM(context.Background(), vctx); err != nil {
+				t.Errorf("StartVM failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	invocations := executor.Invocations()
+	if len(invocations) != 2 {
+		t.Fatalf("Expected 2 invocations, got %d", len(invocations))
+	}
+	// the hosts have free slots, but only one command runs at a time on all the hosts
+	if d := invocations[1].Start.Sub(invocations[0].Start); d < delay {
+		t.Errorf("Expected the commands to be serialized, got a gap of %v", d)
+	}
+}
+
+func TestVMControllerLocalMaxCommands(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_LIBVIRT}
+	executor := exectest.NewExecutor()
+	executor.SetDefault(exectest.Response{Delay: delay})
+	startBoth := func(vmPolicy config.VMControlPolicyConfig) time.Duration {
+		t.Helper()
+		vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, nil, nil)
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			vmInfo := newStatusTestVMInfo("")
+			vmInfo.Name = fmt.Sprintf("vm%d", i)
+			vctx := vmcontroller.NewVMContext(vmInfo)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := vmController.StartVM(context.Background(), vctx); err != nil {
+					t.Errorf("StartVM failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+	// the boxer host runs one command at a time by default
+	if elapsed := startBoth(config.VMControlPolicyConfig{TimeoutSec: 30}); elapsed < 2*delay {
+		t.Errorf("Expected the commands on the boxer host to be serialized, took %v", elapsed)
+	}
+	// max_commands raises the limit of the boxer host
+	if elapsed := startBoth(config.VMControlPolicyConfig{TimeoutSec: 30, MaxCommands: 2}); elapsed >= 2*delay {
+		t.Errorf("Expected the commands on the boxer host to run in parallel, took %v", elapsed)
+	}
+}
+
+func TestVMControllerPaddingMachine(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_LIBVIRT}
+	vmPolicy := config.VMControlPolicyConfig{IntervalSec: 1, TimeoutSec: 30, Padding: config.PADDING_MACHINE}
+	executor := exectest.NewExecutor()
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, nil, nil)
+	vm1 := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+	vmInfo := newStatusTestVMInfo("")
+	vmInfo.Name = "vm2"
+	vm2 := vmcontroller.NewVMContext(vmInfo)
+
+	start := time.Now()
+	if _, err := vmController.StartVM(context.Background(), vm1); err != nil {
+		t.Fatalf("StartVM failed: %v", err)
+	}
+	// the host is not padded, so another VM on it runs at once
+	if _, err := vmController.StartVM(context.Background(), vm2); err != nil {
+		t.Fatalf("StartVM failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected the second VM not to wait for the interval, got %v", elapsed)
+	}
+	// the VM itself is padded
+	if _, err := vmController.StopVM(context.Background(), vm1); err != nil {
+		t.Fatalf("StopVM failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected the same VM to wait for the interval, got %v", elapsed)
+	}
+}
+
+// benchmarkVMs is the number of VMs restored in parallel by each iteration of the benchmarks.
+const benchmarkVMs = 10
+
+// newBenchmarkExecutor returns an Executor whose commands take a millisecond.
+func newBenchmarkExecutor() *exectest.Executor {
+	executor := exectest.NewExecutor()
+	executor.SetDefault(exectest.Response{Delay: time.Millisecond})
+	return executor
+}
+
+// benchmarkIntervalSec is the interval padding the commands in the benchmarks of the padded commands.
+const benchmarkIntervalSec = 1
+
+// BenchmarkRestoreGlobalMutex restores the VMs like the controller did before the per-VM locks:
+// every command of every VM takes a single PaddedMutex, which is released after the interval.
+func BenchmarkRestoreGlobalMutex(b *testing.B) {
+	executor := newBenchmarkExecutor()
+	pMux := exec.InitPaddedMutex(benchmarkIntervalSec)
+	argv := []string{"virsh", "snapshot-revert", "vm", "snapshot0"}
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < benchmarkVMs; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pMux.Lock()
+				defer pMux.Release()
+				if _, err := executor.Execute(context.Background(), argv, io.Discard, io.Discard); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// BenchmarkRestorePaddedMachine restores the VMs of the boxer host in parallel with the same interval
+// padding each VM instead of the whole controller, to compare with BenchmarkRestoreGlobalMutex.
+func BenchmarkRestorePaddedMachine(b *testing.B) {
+	benchmarkRestore(b, config.VMControlPolicyConfig{
+		IntervalSec: benchmarkIntervalSec,
+		TimeoutSec:  30,
+		MaxCommands: benchmarkVMs,
+		Padding:     config.PADDING_MACHINE,
+	}, nil)
+}
+
+// benchmarkRestore restores benchmarkVMs VMs in parallel with a controller of the given policy and hosts.
+// The VMs are assigned to the hosts in turn, or run on the boxer host if there is no host.
+func benchmarkRestore(b *testing.B, vmPolicy config.VMControlPolicyConfig, hosts map[string]config.HostConfig) {
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_LIBVIRT}
+	vmController := vmcontroller.NewVMController(newBenchmarkExecutor(), nil, &vmControlConfig, &vmPolicy, hosts, nil)
+	hostNames := []string{""}
+	if len(hosts) > 0 {
+		hostNames = hostNames[:0]
+		for name := range hosts {
+			hostNames = append(hostNames, name)
+		}
+	}
+	vctxs := make([]*vmcontroller.VMContext, benchmarkVMs)
+	for i := range vctxs {
+		vmInfo := newStatusTestVMInfo("")
+		vmInfo.Name = fmt.Sprintf("vm%d", i)
+		vmInfo.Host = hostNames[i%len(hostNames)]
+		vctxs[i] = vmcontroller.NewVMContext(vmInfo)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for _, vctx := range vctxs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := vmController.RestoreSnapshot(context.Background(), vctx); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// BenchmarkRestoreSerial restores the VMs of the boxer host one at a time, like the controller did
+// before the commands of different VMs could run in parallel.
+func BenchmarkRestoreSerial(b *testing.B) {
+	benchmarkRestore(b, config.VMControlPolicyConfig{TimeoutSec: 30, MaxCommands: 1}, nil)
+}
+
+// BenchmarkRestoreParallel restores the VMs of the boxer host all at once through the same path.
+func BenchmarkRestoreParallel(b *testing.B) {
+	benchmarkRestore(b, config.VMControlPolicyConfig{TimeoutSec: 30, MaxCommands: benchmarkVMs}, nil)
+}
+
+// BenchmarkRestorePerMachine restores the VMs on a single host running all of them at once,
+// without a global command limit.
+func BenchmarkRestorePerMachine(b *testing.B) {
+	hosts := map[string]config.HostConfig{
+		"local": {MaxOperations: benchmarkVMs},
+	}
+	benchmarkRestore(b, config.VMControlPolicyConfig{TimeoutSec: 30}, hosts)
+}
+
+// BenchmarkRestoreMaxCommands restores the VMs on a single host running all of them at once,
+// capped by a global limit of four commands.
+func BenchmarkRestoreMaxCommands(b *testing.B) {
+	hosts := map[string]config.HostConfig{
+		"local": {MaxOperations: benchmarkVMs},
+	}
+	benchmarkRestore(b, config.VMControlPolicyConfig{TimeoutSec: 30, MaxCommands: 4}, hosts)
+}
+
+// BenchmarkRestoreMultipleHosts restores the VMs spread over two hosts running two commands each.
+func BenchmarkRestoreMultipleHosts(b *testing.B) {
+	hosts := map[string]config.HostConfig{
+		"hv1": {MaxOperations: 2},
+		"hv2": {MaxOperations: 2},
+	}
+	benchmarkRestore(b, config.VMControlPolicyConfig{TimeoutSec: 30}, hosts)
+}
+
+func TestVMControllerRateLimit(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_LIBVIRT}
+	vmPolicy := config.VMControlPolicyConfig{
+		TimeoutSec: 30,
+		// a start every 100ms, the stop commands are not limited
+		RateLimit: config.RateLimitsConfig{Start: config.RateLimitConfig{PerMinute: 600}},
+	}
+	clock := exectest.NewClock(time.Now())
+	// a single slot, so a throttled start holding it would block the stop
+	hosts := map[string]config.HostConfig{"local": {MaxOperations: 1}}
+	vmController := vmcontroller.NewVMController(exectest.NewExecutor(), nil, &vmControlConfig, &vmPolicy, hosts, clock)
+	vctxs := make([]*vmcontroller.VMContext, 2)
+	for i := range vctxs {
+		vmInfo := newStatusTestVMInfo("")
+		vmInfo.Name = fmt.Sprintf("vm%d", i)
+		vmInfo.Host = "local"
+		vctxs[i] = vmcontroller.NewVMContext(vmInfo)
+	}
+	if _, err := vmController.StartVM(context.Background(), vctxs[0]); err != nil {
+		t.Fatalf("StartVM failed: %v", err)
+	}
+	started := make(chan error, 1)
+	go func() {
+		_, err := vmController.StartVM(context.Background(), vctxs[1])
+		started <- err
+	}()
+	clock.BlockUntil(1)
+	select {
+	case err := <-started:
+		t.Fatalf("Expected the second start to wait for the rate limit, got %v", err)
+	default:
+	}
+	// the throttled start holds no slot, and the stops are not limited
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := vmController.StopVM(ctx, vctxs[0]); err != nil {
+		t.Fatalf("StopVM failed while a start is throttled: %v", err)
+	}
+	clock.Advance(100 * time.Millisecond)
+	if err := <-started; err != nil {
+		t.Fatalf("StartVM failed: %v", err)
+	}
+	// the next start token is too far for the deadline
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := vmController.StartVM(ctx, vctxs[0]); !berror.Is(err, berror.Timeout) {
+		t.Errorf("Expected Timeout error, got %v", err)
+	}
+}
+
+func TestVMControllerRetry(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_VIRTUALBOX}
+	vmPolicy := config.VMControlPolicyConfig{
+		TimeoutSec: 30,
+		Retry: config.RetryConfig{
+			MaxAttempts: 3,
+			BackoffMs:   1,
+			StderrRegex: []string{`(?i)session is locked`},
+		},
+	}
+	locked := exectest.Response{ExitCode: 1, Stderr: "VBoxManage: error: Session is locked\n"}
+	executor := exectest.NewExecutor()
+	executor.Script("VBoxManage",
+		// the start succeeds at the second attempt
+		locked, exectest.Response{},
+		// the stop fails with a permanent error
+		exectest.Response{ExitCode: 1, Stderr: "VBoxManage: error: Could not find a registered machine\n"},
+	)
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, nil, nil)
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+
+	result, err := vmController.StartVM(context.Background(), vctx)
+	if err != nil {
+		t.Fatalf("StartVM failed: %v", err)
+	}
+	if vctx.State() != vmstate.RUNNING {
+		t.Errorf("Expected state RUNNING, got %s", vctx.State())
+	}
+	if result.AttemptCount() != 2 || result.Attempts[0].Stderr != locked.Stderr {
+		t.Errorf("Expected the failed attempt to be recorded, got %+v", result.Attempts)
+	}
+	result, err = vmController.StopVM(context.Background(), vctx)
+	if !berror.Is(err, berror.SystemError) {
+		t.Fatalf("Expected SystemError, got %v", err)
+	}
+	if result.AttemptCount() != 1 {
+		t.Errorf("Expected a permanent error not to be retried, got %d attempts", result.AttemptCount())
+	}
+	if len(executor.Invocations()) != 3 {
+		t.Errorf("Expected 3 invocations, got %d", len(executor.Invocations()))
+	}
+}
+
+func TestVMControllerRetryReleasesSlots(t *testing.T) {
+	const backoff = 500 * time.Millisecond
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_VIRTUALBOX}
+	vmPolicy := config.VMControlPolicyConfig{
+		TimeoutSec: 30,
+		Retry: config.RetryConfig{
+			MaxAttempts: 2,
+			BackoffMs:   uint(backoff / time.Millisecond),
+			StderrRegex: []string{`(?i)session is locked`},
+		},
+	}
+	executor := exectest.NewExecutor()
+	executor.Script("VBoxManage",
+		exectest.Response{ExitCode: 1, Stderr: "VBoxManage: error: Session is locked\n"},
+		exectest.Response{},
+		exectest.Response{},
+	)
+	// the boxer host runs one command at a time
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, nil, nil)
+	vm0 := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+	vmInfo := newStatusTestVMInfo("")
+	vmInfo.Name = "vm1"
+	vm1 := vmcontroller.NewVMContext(vmInfo)
+
+	done := make(chan *berror.CommandResult, 1)
+	go func() {
+		result, err := vmController.StartVM(context.Background(), vm0)
+		if err != nil {
+			t.Errorf("StartVM of vm0 failed: %v", err)
+		}
+		done <- result
+	}()
+	for len(executor.Invocations()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// vm0 waits to be retried without the slot of the host, so vm1 runs meanwhile
+	start := time.Now()
+	if _, err := vmController.StartVM(context.Background(), vm1); err != nil {
+		t.Fatalf("StartVM of vm1 failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= backoff {
+		t.Errorf("Expected vm1 not to wait for the backoff of vm0, took %v", elapsed)
+	}
+	if result := <-done; result == nil || result.AttemptCount() != 2 {
+		t.Errorf("Expected vm0 to start at the second attempt, got %+v", result)
+	}
+}
+
+func TestVMControllerRetryExhausted(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_VIRTUALBOX}
+	vmPolicy := config.VMControlPolicyConfig{
+		TimeoutSec: 30,
+		Retry:      config.RetryConfig{MaxAttempts: 3, BackoffMs: 1, ExitCodes: []int{1}},
+	}
+	executor := exectest.NewExecutor()
+	executor.Script("VBoxManage", exectest.Response{ExitCode: 1, Stderr: "VBoxManage: error: Session is locked\n"})
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, nil, nil)
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+
+	_, err := vmController.RestoreSnapshot(context.Background(), vctx)
+	if !berror.Is(err, berror.SystemError) {
+		t.Fatalf("Expected SystemError, got %v", err)
+	}
+	if vctx.State() != vmstate.ERROR {
+		t.Errorf("Expected state ERROR, got %s", vctx.State())
+	}
+	// every attempt is recorded in the result attached to the error
+	if result := berror.ResultOf(err); result == nil || result.AttemptCount() != 3 {
+		t.Errorf("Expected 3 attempts in the error, got %v", result)
+	}
+}
+
+func TestVMControllerRecoverVM(t *testing.T) {
+	vmControlConfig := config.VMControlConfig{Backend: config.BACKEND_VIRTUALBOX, StopMode: config.STOP_MODE_SHUTDOWN}
+	vmPolicy := config.VMControlPolicyConfig{TimeoutSec: 30}
+	executor := exectest.NewExecutor()
+	executor.Script("VBoxManage",
+		// the start fails and leaves the VM in ERROR
+		exectest.Response{ExitCode: 1, Stderr: "VBoxManage: error: The VM session was aborted\n"},
+		// the hard stop fails because the VM is not running
+		exectest.Response{ExitCode: 1, Stderr: "VBoxManage: error: Machine 'vm1' is not currently running\n"},
+		exectest.Response{},
+	)
+	vmController := vmcontroller.NewVMController(executor, nil, &vmControlConfig, &vmPolicy, nil, nil)
+	vctx := vmcontroller.NewVMContext(newStatusTestVMInfo(""))
+	if _, err := vmController.StartVM(context.Background(), vctx); err == nil || vctx.State() != vmstate.ERROR {
+		t.Fatalf("Expected StartVM to fail into ERROR, got %s %v", vctx.State(), err)
+	}
+	if _, err := vmController.RestoreSnapshot(context.Background(), vctx); !berror.Is(err, berror.InvalidState) {
+		t.Fatalf("Expected InvalidState error, got %v", err)
+	}
+	if _, err := vmController.RecoverVM(context.Background(), vctx); err != nil {
+		t.Fatalf("RecoverVM failed: %v", err)
+	}
+	if vctx.State() != vmstate.STOPPED {
+		t.Errorf("Expected state STOPPED, got %s", vctx.State())
+	}
+	// the VM is powered off for the recovery, even if the stop mode is shutdown
+	want := [][]string{
+		{"VBoxManage", "startvm", "vm1", "--type", "headless"},
+		{"VBoxManage", "controlvm", "vm1", "poweroff"},
+		{"VBoxManage", "snapshot", "vm1", "restore", "snapshot0"},
+	}
+	invocations := executor.Invocations()
+	if len(invocations) != len(want) {
+		t.Fatalf("Expected %d invocations, got %d", len(want), len(invocations))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(invocations[i].Argv, want[i]) {
+			t.Errorf("Expected invocation %v, got %v", want[i], invocations[i].Argv)
+		}
+	}
+
+	// a failed restore leaves the VM in ERROR
+	executor.Script("VBoxManage", exectest.Response{ExitCode: 1, Stderr: "VBoxManage: error: Snapshot not found\n"})
+	if _, err := vmController.RecoverVM(context.Background(), vctx); !berror.Is(err, berror.SystemError) {
+		t.Errorf("Expected SystemError, got %v", err)
+	}
+	if vctx.State() != vmstate.ERROR {
+		t.Errorf("Expected state ERROR, got %s", vctx.State())
+	}
+}
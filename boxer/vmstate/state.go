@@ -1,5 +1,10 @@
 package vmstate
 
+import (
+	"fmt"
+	"strings"
+)
+
 type VMState int
 
 const (
@@ -23,3 +28,14 @@ func (s VMState) String() string {
 		return "UNKNOWN"
 	}
 }
+
+// Parse returns the VMState of the given name.
+// The name is case-insensitive, so both "running" and "RUNNING" are accepted.
+func Parse(name string) (VMState, error) {
+	for _, state := range []VMState{STOPPED, RUNNING, RESTORING, ERROR} {
+		if strings.EqualFold(name, state.String()) {
+			return state, nil
+		}
+	}
+	return ERROR, fmt.Errorf("unknown VM state %q", name)
+}